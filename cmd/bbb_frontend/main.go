@@ -13,12 +13,6 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/go-redis/redis"
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
@@ -28,81 +22,76 @@ import (
 	"google.golang.org/grpc"
 )
 
-type stringList []string
-
-func (i *stringList) String() string {
-	return "my string representation"
-}
-
-func (i *stringList) Set(value string) error {
-	*i = append(*i, value)
-	return nil
-}
-
 func main() {
-	var schedulersList stringList
+	var instanceDigestFunctionsList, instanceQuotasList, schedulersList util.StringList
+	storageFlags := blobstore.RegisterStorageFlags()
 	var (
-		redisEndpoint     = flag.String("redis-endpoint", "", "Redis endpoint for the Content Addressable Storage and the Action Cache")
-		s3Endpoint        = flag.String("s3-endpoint", "", "S3 compatible object storage endpoint for the Content Addressable Storage and the Action Cache")
-		s3AccessKeyId     = flag.String("s3-access-key-id", "", "Access key for the object storage")
-		s3SecretAccessKey = flag.String("s3-secret-access-key", "", "Secret key for the object storage")
-		s3Region          = flag.String("s3-region", "", "Region of the object storage")
-		s3DisableSsl      = flag.Bool("s3-disable-ssl", false, "Whether to use HTTP for the object storage instead of HTTPS")
+		allowActionCacheUpdates = flag.Bool("allow-ac-updates", false, "Permit clients to store action results through the ActionCache service and Bazel's HTTP caching protocol. This is needed when workers or other frontends use this server through -remote-cas-endpoint, but also allows Bazel to store action results that were not computed by workers")
+		httpCacheListenAddress  = flag.String("http-cache-listen-address", "", "Address on which to serve the Content Addressable Storage and the Action Cache using Bazel's HTTP caching protocol (e.g., :8080), or empty to disable it. Objects and action results stored through this protocol are not shared with clients using gRPC")
+
+		digestFunction = flag.String("digest-function", "sha256", "Digest function used by clients, for instances that have no digest function configured explicitly")
+		traceFile      = flag.String("trace-file", "", "File to which OpenCensus spans are written as JSON, or empty to disable tracing")
+		defaultQuota   = flag.String("default-quota", "", "Limits on resource usage by clients, for instances that have no quota configured explicitly. Example: requests-per-second=1000,client-requests-per-second=100,concurrent-uploads=64,max-blob-size-bytes=1073741824")
 	)
 	flag.Var(&schedulersList, "scheduler", "Backend capable of executing build actions. Example: debian9|hostname-of-debian9-scheduler:8981")
+	flag.Var(&instanceDigestFunctionsList, "instance-digest-function", "Digest function used by clients of an instance. Example: my-instance|blake3")
+	flag.Var(&instanceQuotasList, "instance-quota", "Limits on resource usage by clients of an instance. Example: my-instance|requests-per-second=100,concurrent-uploads=10")
 	flag.Parse()
 
+	digestFunctionSelector, err := util.ParseDigestFunctionSelector(*digestFunction, instanceDigestFunctionsList)
+	if err != nil {
+		log.Fatal("Failed to parse digest functions: ", err)
+	}
+	quotaSelector, err := util.ParseQuotaSelector(*defaultQuota, instanceQuotasList, util.StorageQuotaKeys)
+	if err != nil {
+		log.Fatal("Failed to parse quotas: ", err)
+	}
+
+	if err := util.InitializeTracing("bbb_frontend", *traceFile); err != nil {
+		log.Fatal("Failed to initialize tracing: ", err)
+	}
+
 	// Web server for metrics and profiling.
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
 		log.Fatal(http.ListenAndServe(":80", nil))
 	}()
 
-	// Create an S3 client. Set the uploader concurrency to 1 to drastically reduce memory usage.
-	// TODO(edsch): Maybe the concurrency can be left alone for this process?
-	session := session.New(&aws.Config{
-		Credentials:      credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
-		Endpoint:         s3Endpoint,
-		Region:           s3Region,
-		DisableSSL:       s3DisableSsl,
-		S3ForcePathStyle: aws.Bool(true),
-	})
-	s3 := s3.New(session)
-	uploader := s3manager.NewUploader(session)
-	uploader.Concurrency = 1
-
 	// Storage of content and actions.
-	contentAddressableStorageBlobAccess := blobstore.NewMetricsBlobAccess(
-		blobstore.NewMerkleBlobAccess(
-			blobstore.NewSizeDistinguishingBlobAccess(
-				blobstore.NewMetricsBlobAccess(
-					blobstore.NewRedisBlobAccess(
-						redis.NewClient(
-							&redis.Options{
-								Addr: *redisEndpoint,
-								DB:   0,
-							}),
-						util.KeyDigestWithoutInstance),
-					"cas_redis"),
-				blobstore.NewMetricsBlobAccess(
-					blobstore.NewS3BlobAccess(
-						s3,
-						uploader,
-						aws.String("content-addressable-storage"),
-						util.KeyDigestWithoutInstance),
-					"cas_s3"),
-				1<<20)),
-		"cas_merkle")
-	actionCacheBlobAccess := blobstore.NewMetricsBlobAccess(
-		blobstore.NewRedisBlobAccess(
-			redis.NewClient(
-				&redis.Options{
-					Addr: *redisEndpoint,
-					DB:   1,
-				}),
-			util.KeyDigestWithInstance),
-		"ac_redis")
-	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
+	contentAddressableStorageBackend, actionCacheBlobAccess, err := storageFlags.NewBlobAccesses()
+	if err != nil {
+		log.Fatal("Failed to create storage: ", err)
+	}
+
+	// Storage as exposed to clients, subject to quotas.
+	quotaEnforcer := util.NewQuotaEnforcer(quotaSelector)
+	contentAddressableStorageBlobAccess := blobstore.NewQuotaEnforcingBlobAccess(
+		blobstore.NewTracingBlobAccess(
+			blobstore.NewMetricsBlobAccess(
+				blobstore.NewMerkleBlobAccess(
+					contentAddressableStorageBackend,
+					digestFunctionSelector,
+					true),
+				"cas_merkle"),
+			"cas_merkle"),
+		quotaEnforcer)
+	actionCacheClientBlobAccess := blobstore.NewQuotaEnforcingBlobAccess(
+		blobstore.NewTracingBlobAccess(actionCacheBlobAccess, "ac"),
+		quotaEnforcer)
+	actionCache := ac.NewBlobAccessActionCache(actionCacheClientBlobAccess)
+
+	// Optional web server for Bazel's HTTP caching protocol.
+	if *httpCacheListenAddress != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(
+				*httpCacheListenAddress,
+				blobstore.NewHTTPCacheServer(
+					contentAddressableStorageBlobAccess,
+					actionCacheClientBlobAccess,
+					digestFunctionSelector,
+					*allowActionCacheUpdates)))
+		}()
+	}
 
 	// Backends capable of compiling.
 	schedulers := map[string]builder.BuildQueue{}
@@ -114,8 +103,8 @@ func main() {
 		scheduler, err := grpc.Dial(
 			components[1],
 			grpc.WithInsecure(),
-			grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-			grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+			grpc.WithUnaryInterceptor(util.ChainUnaryClientInterceptors(util.TracingUnaryClientInterceptor, grpc_prometheus.UnaryClientInterceptor)),
+			grpc.WithStreamInterceptor(util.ChainStreamClientInterceptors(util.TracingStreamClientInterceptor, grpc_prometheus.StreamClientInterceptor)))
 		if err != nil {
 			log.Fatal("Failed to create scheduler RPC client: ", err)
 		}
@@ -125,10 +114,10 @@ func main() {
 
 	// RPC server.
 	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
+		grpc.StreamInterceptor(util.ChainStreamServerInterceptors(util.TracingStreamServerInterceptor, grpc_prometheus.StreamServerInterceptor)),
+		grpc.UnaryInterceptor(util.ChainUnaryServerInterceptors(util.TracingUnaryServerInterceptor, grpc_prometheus.UnaryServerInterceptor)),
 	)
-	remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache))
+	remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, *allowActionCacheUpdates))
 	remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess))
 	bytestream.RegisterByteStreamServer(s, blobstore.NewByteStreamServer(contentAddressableStorageBlobAccess))
 	remoteexecution.RegisterExecutionServer(s, buildQueue)
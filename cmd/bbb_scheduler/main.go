@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
 	"net/http"
@@ -18,18 +19,41 @@ import (
 )
 
 func main() {
+	var instanceDigestFunctionsList, instanceQuotasList util.StringList
+	var (
+		digestFunction = flag.String("digest-function", "sha256", "Digest function used by clients, for instances that have no digest function configured explicitly")
+		traceFile      = flag.String("trace-file", "", "File to which OpenCensus spans are written as JSON, or empty to disable tracing")
+		defaultQuota   = flag.String("default-quota", "", "Limits on resource usage by clients, for instances that have no quota configured explicitly. Example: max-queued-actions=1000")
+	)
+	flag.Var(&instanceDigestFunctionsList, "instance-digest-function", "Digest function used by clients of an instance. Example: my-instance|blake3")
+	flag.Var(&instanceQuotasList, "instance-quota", "Limits on resource usage by clients of an instance. Example: my-instance|max-queued-actions=10")
+	flag.Parse()
+
+	digestFunctionSelector, err := util.ParseDigestFunctionSelector(*digestFunction, instanceDigestFunctionsList)
+	if err != nil {
+		log.Fatal("Failed to parse digest functions: ", err)
+	}
+	quotaSelector, err := util.ParseQuotaSelector(*defaultQuota, instanceQuotasList, util.SchedulerQuotaKeys)
+	if err != nil {
+		log.Fatal("Failed to parse quotas: ", err)
+	}
+
+	if err := util.InitializeTracing("bbb_scheduler", *traceFile); err != nil {
+		log.Fatal("Failed to initialize tracing: ", err)
+	}
+
 	// Web server for metrics and profiling.
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
 		log.Fatal(http.ListenAndServe(":80", nil))
 	}()
 
-	buildQueue := builder.NewWorkerBuildQueue(util.KeyDigestWithInstance, 16)
+	buildQueue := builder.NewWorkerBuildQueue(util.KeyDigestWithInstance, digestFunctionSelector, 16, quotaSelector)
 
 	// RPC server.
 	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
+		grpc.StreamInterceptor(util.ChainStreamServerInterceptors(util.TracingStreamServerInterceptor, grpc_prometheus.StreamServerInterceptor)),
+		grpc.UnaryInterceptor(util.ChainUnaryServerInterceptors(util.TracingUnaryServerInterceptor, grpc_prometheus.UnaryServerInterceptor)),
 	)
 	remoteexecution.RegisterExecutionServer(s, buildQueue)
 	watcher.RegisterWatcherServer(s, buildQueue)
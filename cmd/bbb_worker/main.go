@@ -16,12 +16,6 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/go-redis/redis"
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
@@ -29,18 +23,26 @@ import (
 )
 
 func main() {
+	var instanceDigestFunctionsList util.StringList
+	storageFlags := blobstore.RegisterStorageFlags()
 	var (
-		redisEndpoint     = flag.String("redis-endpoint", "", "Redis endpoint for the Content Addressable Storage and the Action Cache")
-		s3Endpoint        = flag.String("s3-endpoint", "", "S3 compatible object storage endpoint for the Content Addressable Storage and the Action Cache")
-		s3AccessKeyId     = flag.String("s3-access-key-id", "", "Access key for the object storage")
-		s3SecretAccessKey = flag.String("s3-secret-access-key", "", "Secret key for the object storage")
-		s3Region          = flag.String("s3-region", "", "Region of the object storage")
-		s3DisableSsl      = flag.Bool("s3-disable-ssl", false, "Whether to use HTTP for the object storage instead of HTTPS")
+		digestFunction = flag.String("digest-function", "sha256", "Digest function used by clients, for instances that have no digest function configured explicitly")
+		traceFile      = flag.String("trace-file", "", "File to which OpenCensus spans are written as JSON, or empty to disable tracing")
 
 		schedulerAddress = flag.String("scheduler", "", "Address of the scheduler to which to connect")
 	)
+	flag.Var(&instanceDigestFunctionsList, "instance-digest-function", "Digest function used by clients of an instance. Example: my-instance|blake3")
 	flag.Parse()
 
+	digestFunctionSelector, err := util.ParseDigestFunctionSelector(*digestFunction, instanceDigestFunctionsList)
+	if err != nil {
+		log.Fatal("Failed to parse digest functions: ", err)
+	}
+
+	if err := util.InitializeTracing("bbb_worker", *traceFile); err != nil {
+		log.Fatal("Failed to initialize tracing: ", err)
+	}
+
 	// Respect file permissions that we pass to os.OpenFile(), os.Mkdir(), etc.
 	syscall.Umask(0)
 
@@ -50,50 +52,20 @@ func main() {
 		log.Fatal(http.ListenAndServe(":80", nil))
 	}()
 
-	// Create an S3 client. Set the uploader concurrency to 1 to drastically reduce memory usage.
-	// TODO(edsch): Maybe the concurrency can be left alone for this process?
-	session := session.New(&aws.Config{
-		Credentials:      credentials.NewStaticCredentials(*s3AccessKeyId, *s3SecretAccessKey, ""),
-		Endpoint:         s3Endpoint,
-		Region:           s3Region,
-		DisableSSL:       s3DisableSsl,
-		S3ForcePathStyle: aws.Bool(true),
-	})
-	s3 := s3.New(session)
-	uploader := s3manager.NewUploader(session)
-	uploader.Concurrency = 1
-
 	// Storage of content and actions.
-	contentAddressableStorageBlobAccess := blobstore.NewMetricsBlobAccess(
-		blobstore.NewMerkleBlobAccess(
-			blobstore.NewSizeDistinguishingBlobAccess(
-				blobstore.NewMetricsBlobAccess(
-					blobstore.NewRedisBlobAccess(
-						redis.NewClient(
-							&redis.Options{
-								Addr: *redisEndpoint,
-								DB:   0,
-							}),
-						util.KeyDigestWithoutInstance),
-					"cas_redis"),
-				blobstore.NewMetricsBlobAccess(
-					blobstore.NewS3BlobAccess(
-						s3,
-						uploader,
-						aws.String("content-addressable-storage"),
-						util.KeyDigestWithoutInstance),
-					"cas_s3"),
-				1<<20)),
+	contentAddressableStorageBackend, actionCacheBlobAccess, err := storageFlags.NewBlobAccesses()
+	if err != nil {
+		log.Fatal("Failed to create storage: ", err)
+	}
+
+	contentAddressableStorageBlobAccess := blobstore.NewTracingBlobAccess(
+		blobstore.NewMetricsBlobAccess(
+			blobstore.NewMerkleBlobAccess(
+				contentAddressableStorageBackend,
+				digestFunctionSelector,
+				true),
+			"cas_merkle"),
 		"cas_merkle")
-	actionCacheBlobAccess := blobstore.NewMetricsBlobAccess(
-		blobstore.NewRedisBlobAccess(
-			redis.NewClient(
-				&redis.Options{
-					Addr: *redisEndpoint,
-					DB:   1,
-				}),
-			util.KeyDigestWithInstance),
-		"ac_redis")
 
 	// On-disk caching of content for efficient linking into build environments.
 	if err := os.Mkdir("/cache", 0); err != nil {
@@ -105,18 +77,23 @@ func main() {
 			cas.NewDirectoryCachingContentAddressableStorage(
 				cas.NewHardlinkingContentAddressableStorage(
 					cas.NewBlobAccessContentAddressableStorage(
-						contentAddressableStorageBlobAccess),
+						contentAddressableStorageBlobAccess,
+						digestFunctionSelector),
 					util.KeyDigestWithoutInstance, "/cache", 10000, 1<<30),
-				util.KeyDigestWithoutInstance, 1000)),
+				util.KeyDigestWithoutInstance, 1000),
+			digestFunctionSelector),
 		ac.NewBlobAccessActionCache(
-			blobstore.NewMetricsBlobAccess(actionCacheBlobAccess, "ac_build_executor")))
+			blobstore.NewTracingBlobAccess(
+				blobstore.NewMetricsBlobAccess(actionCacheBlobAccess, "ac_build_executor"),
+				"ac_build_executor")),
+		digestFunctionSelector)
 
 	// Create connection with scheduler.
 	schedulerConnection, err := grpc.Dial(
 		*schedulerAddress,
 		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+		grpc.WithUnaryInterceptor(util.ChainUnaryClientInterceptors(util.TracingUnaryClientInterceptor, grpc_prometheus.UnaryClientInterceptor)),
+		grpc.WithStreamInterceptor(util.ChainStreamClientInterceptors(util.TracingStreamClientInterceptor, grpc_prometheus.StreamClientInterceptor)))
 	if err != nil {
 		log.Fatal("Failed to create scheduler RPC client: ", err)
 	}
@@ -142,8 +119,10 @@ func subscribeAndExecute(schedulerClient scheduler.SchedulerClient, buildExecuto
 		if err != nil {
 			return err
 		}
-		log.Print("Request: ", request)
-		response := buildExecutor.Execute(stream.Context(), request)
+		log.Print("Request: ", request.ExecuteRequest)
+		ctx, span := util.StartSpanWithTraceContext(stream.Context(), "Execute", request.TraceContext)
+		response := buildExecutor.Execute(ctx, request.ExecuteRequest)
+		span.End()
 		log.Print("Response: ", response)
 		if err := stream.Send(response); err != nil {
 			return err
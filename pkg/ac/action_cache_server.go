@@ -9,12 +9,17 @@ import (
 )
 
 type actionCacheServer struct {
-	actionCache ActionCache
+	actionCache  ActionCache
+	allowUpdates bool
 }
 
-func NewActionCacheServer(actionCache ActionCache) remoteexecution.ActionCacheServer {
+// NewActionCacheServer creates a gRPC service that exposes an Action
+// Cache. Clients may only store action results if allowUpdates is set,
+// which is needed when workers use this service as their Action Cache.
+func NewActionCacheServer(actionCache ActionCache, allowUpdates bool) remoteexecution.ActionCacheServer {
 	return &actionCacheServer{
-		actionCache: actionCache,
+		actionCache:  actionCache,
+		allowUpdates: allowUpdates,
 	}
 }
 
@@ -23,5 +28,11 @@ func (s *actionCacheServer) GetActionResult(ctx context.Context, in *remoteexecu
 }
 
 func (s *actionCacheServer) UpdateActionResult(ctx context.Context, in *remoteexecution.UpdateActionResultRequest) (*remoteexecution.ActionResult, error) {
+	if s.allowUpdates {
+		if err := s.actionCache.PutActionResult(ctx, in.InstanceName, in.ActionDigest, in.ActionResult); err != nil {
+			return nil, err
+		}
+		return in.ActionResult, nil
+	}
 	return nil, status.Error(codes.PermissionDenied, "This service can only be used to get action results")
 }
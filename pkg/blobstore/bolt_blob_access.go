@@ -0,0 +1,531 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"go.etcd.io/bbolt"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	boltBlobAccessDatabaseFile   = "blobs.db"
+	boltBlobAccessFilesDirectory = "files"
+	boltBlobAccessTempDirectory  = "tmp"
+
+	boltBlobKindInline = 0
+	boltBlobKindFile   = 1
+
+	// boltBlobRecordHeaderSize is the size of the fields of a blob
+	// record preceding the inline data: the kind, the size of the
+	// blob and its access sequence number.
+	boltBlobRecordHeaderSize = 1 + 8 + 8
+)
+
+var (
+	// boltBucketBlobs maps keys to blob records.
+	boltBucketBlobs = []byte("blobs")
+	// boltBucketLRU maps access sequence numbers to keys, so that
+	// the least recently used blobs can be found by iterating it.
+	boltBucketLRU = []byte("lru")
+	// boltBucketMeta holds the total size of all blobs.
+	boltBucketMeta        = []byte("meta")
+	boltKeyTotalSizeBytes = []byte("total_size_bytes")
+)
+
+// boltBlobRecord is the value stored in the database for every blob.
+// Small blobs are stored inline, while large blobs are stored as
+// separate files.
+type boltBlobRecord struct {
+	kind           byte
+	sizeBytes      int64
+	accessSequence uint64
+	data           []byte
+}
+
+func (r *boltBlobRecord) marshal() []byte {
+	b := make([]byte, boltBlobRecordHeaderSize+len(r.data))
+	b[0] = r.kind
+	binary.BigEndian.PutUint64(b[1:], uint64(r.sizeBytes))
+	binary.BigEndian.PutUint64(b[9:], r.accessSequence)
+	copy(b[boltBlobRecordHeaderSize:], r.data)
+	return b
+}
+
+// unmarshalBoltBlobRecord parses a blob record. The data of the record
+// refers to the value provided, meaning it is only valid for the
+// duration of the transaction.
+func unmarshalBoltBlobRecord(b []byte) (*boltBlobRecord, error) {
+	if len(b) < boltBlobRecordHeaderSize {
+		return nil, status.Errorf(codes.Internal, "Blob record has length %d, while at least %d bytes were expected", len(b), boltBlobRecordHeaderSize)
+	}
+	return &boltBlobRecord{
+		kind:           b[0],
+		sizeBytes:      int64(binary.BigEndian.Uint64(b[1:])),
+		accessSequence: binary.BigEndian.Uint64(b[9:]),
+		data:           b[boltBlobRecordHeaderSize:],
+	}, nil
+}
+
+func marshalBoltUint64(v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
+type boltBlobAccess struct {
+	db                 *bbolt.DB
+	path               string
+	blobKeyer          util.DigestKeyer
+	maxSizeBytes       int64
+	maxInlineSizeBytes int64
+}
+
+// NewBoltBlobAccess creates a BlobAccess that stores blobs in an
+// embedded bbolt database in a local directory. Blobs of at most
+// maxInlineSizeBytes are stored in the database itself, while larger
+// blobs are stored as separate files that are referenced by the
+// database. The total size of all blobs is bounded by maxSizeBytes, by
+// discarding the least recently used blobs.
+//
+// As every modification is performed in a single transaction, the
+// database remains consistent across crashes. Files of large blobs are
+// written before the transaction referencing them is committed, and
+// removed after the transaction dereferencing them is committed. Files
+// that are not referenced by the database are removed at startup.
+func NewBoltBlobAccess(directory string, blobKeyer util.DigestKeyer, maxSizeBytes int64, maxInlineSizeBytes int64) (BlobAccess, error) {
+	tempPath := path.Join(directory, boltBlobAccessTempDirectory)
+	if err := os.RemoveAll(tempPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tempPath, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Join(directory, boltBlobAccessFilesDirectory), 0700); err != nil {
+		return nil, err
+	}
+
+	// Fail instead of blocking indefinitely if another process
+	// has the database opened.
+	db, err := bbolt.Open(path.Join(directory, boltBlobAccessDatabaseFile), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	ba := &boltBlobAccess{
+		db:                 db,
+		path:               directory,
+		blobKeyer:          blobKeyer,
+		maxSizeBytes:       maxSizeBytes,
+		maxInlineSizeBytes: maxInlineSizeBytes,
+	}
+	var filesToRemove []string
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltBucketBlobs, boltBucketLRU, boltBucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		// The maximum size may have been reduced since the
+		// previous run.
+		return ba.makeSpace(tx, 0, &filesToRemove)
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	ba.removeFiles(filesToRemove)
+	if err := ba.removeOrphanedFiles(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ba, nil
+}
+
+// removeOrphanedFiles removes files of large blobs that are not
+// referenced by the database, due to crashes during Put() or Delete().
+func (ba *boltBlobAccess) removeOrphanedFiles() error {
+	referenced := map[string]bool{}
+	if err := ba.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucketBlobs).ForEach(func(key []byte, value []byte) error {
+			record, err := unmarshalBoltBlobRecord(value)
+			if err != nil {
+				return err
+			}
+			if record.kind == boltBlobKindFile {
+				referenced[ba.getFilePath(key)] = true
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	filesPath := path.Join(ba.path, boltBlobAccessFilesDirectory)
+	shards, err := ioutil.ReadDir(filesPath)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		shardPath := path.Join(filesPath, shard.Name())
+		if !shard.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(shardPath)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if filePath := path.Join(shardPath, file.Name()); !referenced[filePath] {
+				if err := os.Remove(filePath); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// getFilePath returns the path of the file in which a large blob is
+// stored. Keys are hashed, as they may contain characters that cannot
+// be used in file names.
+func (ba *boltBlobAccess) getFilePath(key []byte) string {
+	hash := sha256.Sum256(key)
+	fileName := hex.EncodeToString(hash[:])
+	return path.Join(ba.path, boltBlobAccessFilesDirectory, fileName[:2], fileName)
+}
+
+func (ba *boltBlobAccess) getKey(instance string, digest *remoteexecution.Digest) ([]byte, error) {
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(key), nil
+}
+
+func getBoltTotalSizeBytes(tx *bbolt.Tx) int64 {
+	value := tx.Bucket(boltBucketMeta).Get(boltKeyTotalSizeBytes)
+	if len(value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+func setBoltTotalSizeBytes(tx *bbolt.Tx, totalSizeBytes int64) error {
+	return tx.Bucket(boltBucketMeta).Put(boltKeyTotalSizeBytes, marshalBoltUint64(uint64(totalSizeBytes)))
+}
+
+// removeEntry removes a blob from the database. If the blob is stored
+// as a separate file, its path is appended to filesToRemove, so that
+// it may be removed after the transaction is committed.
+func (ba *boltBlobAccess) removeEntry(tx *bbolt.Tx, key []byte, record *boltBlobRecord, filesToRemove *[]string) error {
+	if err := tx.Bucket(boltBucketLRU).Delete(marshalBoltUint64(record.accessSequence)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltBucketBlobs).Delete(key); err != nil {
+		return err
+	}
+	if record.kind == boltBlobKindFile {
+		*filesToRemove = append(*filesToRemove, ba.getFilePath(key))
+	}
+	return setBoltTotalSizeBytes(tx, getBoltTotalSizeBytes(tx)-record.sizeBytes)
+}
+
+// makeSpace discards the least recently used blobs until a blob of a
+// given size fits.
+func (ba *boltBlobAccess) makeSpace(tx *bbolt.Tx, sizeBytes int64, filesToRemove *[]string) error {
+	lru := tx.Bucket(boltBucketLRU)
+	blobs := tx.Bucket(boltBucketBlobs)
+	for getBoltTotalSizeBytes(tx)+sizeBytes > ba.maxSizeBytes {
+		sequence, value := lru.Cursor().First()
+		if value == nil {
+			break
+		}
+		// Values are only valid until the bucket is modified.
+		key := append([]byte(nil), value...)
+		recordValue := blobs.Get(key)
+		if recordValue == nil {
+			// Stale entry without a corresponding blob.
+			if err := lru.Delete(sequence); err != nil {
+				return err
+			}
+			continue
+		}
+		record, err := unmarshalBoltBlobRecord(recordValue)
+		if err != nil {
+			return err
+		}
+		if err := ba.removeEntry(tx, key, record, filesToRemove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertEntry stores a blob record in the database, marking it as most
+// recently used.
+func (ba *boltBlobAccess) insertEntry(tx *bbolt.Tx, key []byte, record *boltBlobRecord) error {
+	lru := tx.Bucket(boltBucketLRU)
+	sequence, err := lru.NextSequence()
+	if err != nil {
+		return err
+	}
+	record.accessSequence = sequence
+	if err := lru.Put(marshalBoltUint64(sequence), key); err != nil {
+		return err
+	}
+	return tx.Bucket(boltBucketBlobs).Put(key, record.marshal())
+}
+
+func (ba *boltBlobAccess) removeFiles(filesToRemove []string) {
+	for _, filePath := range filesToRemove {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove blob file %s: %s", filePath, err)
+		}
+	}
+}
+
+// touch marks blobs as most recently used. Calls are batched, so that
+// concurrent requests share a single transaction.
+func (ba *boltBlobAccess) touch(keys [][]byte) error {
+	return ba.db.Batch(func(tx *bbolt.Tx) error {
+		lru := tx.Bucket(boltBucketLRU)
+		for _, key := range keys {
+			value := tx.Bucket(boltBucketBlobs).Get(key)
+			if value == nil {
+				// Blob got evicted in the meantime.
+				continue
+			}
+			record, err := unmarshalBoltBlobRecord(value)
+			if err != nil {
+				return err
+			}
+			record.data = append([]byte(nil), record.data...)
+			if err := lru.Delete(marshalBoltUint64(record.accessSequence)); err != nil {
+				return err
+			}
+			if err := ba.insertEntry(tx, key, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ba *boltBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	if err := ctx.Err(); err != nil {
+		return &errorReader{err: err}
+	}
+	key, err := ba.getKey(instance, digest)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+
+	var record *boltBlobRecord
+	if err := ba.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(boltBucketBlobs).Get(key)
+		if value == nil {
+			return status.Errorf(codes.NotFound, "Blob not found")
+		}
+		var err error
+		record, err = unmarshalBoltBlobRecord(value)
+		if err != nil {
+			return err
+		}
+		record.data = append([]byte(nil), record.data...)
+		return nil
+	}); err != nil {
+		return &errorReader{err: err}
+	}
+
+	// Updating the access time requires a write transaction, which
+	// need not complete before the blob is returned.
+	go func() {
+		if err := ba.touch([][]byte{key}); err != nil {
+			log.Print("Failed to update blob access time: ", err)
+		}
+	}()
+
+	if record.kind == boltBlobKindInline {
+		return ioutil.NopCloser(bytes.NewReader(record.data))
+	}
+	// The blob may be evicted at any point after the transaction.
+	// Files that are already opened remain readable when unlinked.
+	f, err := os.Open(ba.getFilePath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &errorReader{err: status.Errorf(codes.NotFound, "Blob not found")}
+		}
+		return &errorReader{err: err}
+	}
+	return f
+}
+
+func (ba *boltBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	defer r.Close()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if digest.SizeBytes > ba.maxSizeBytes {
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this storage backend can only hold %d bytes", digest.SizeBytes, ba.maxSizeBytes)
+	}
+	key, err := ba.getKey(instance, digest)
+	if err != nil {
+		return err
+	}
+
+	record := &boltBlobRecord{}
+	var tempPath string
+	if digest.SizeBytes <= ba.maxInlineSizeBytes {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		record.kind = boltBlobKindInline
+		record.sizeBytes = int64(len(data))
+		record.data = data
+	} else {
+		// Stream the blob into a temporary file, so that
+		// partially written blobs never become visible.
+		f, err := ioutil.TempFile(path.Join(ba.path, boltBlobAccessTempDirectory), "blob")
+		if err != nil {
+			return err
+		}
+		tempPath = f.Name()
+		defer os.Remove(tempPath)
+		sizeBytes, err := io.Copy(f, r)
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err != nil {
+			return err
+		}
+		record.kind = boltBlobKindFile
+		record.sizeBytes = sizeBytes
+	}
+
+	filePath := ba.getFilePath(key)
+	var filesToRemove []string
+	if err := ba.db.Update(func(tx *bbolt.Tx) error {
+		if value := tx.Bucket(boltBucketBlobs).Get(key); value != nil {
+			existing, err := unmarshalBoltBlobRecord(value)
+			if err != nil {
+				return err
+			}
+			if err := ba.removeEntry(tx, key, existing, &filesToRemove); err != nil {
+				return err
+			}
+		}
+		if err := ba.makeSpace(tx, record.sizeBytes, &filesToRemove); err != nil {
+			return err
+		}
+		if record.kind == boltBlobKindFile {
+			// The file is moved into place before the
+			// transaction commits. If the transaction fails,
+			// the file is removed at startup.
+			if err := os.MkdirAll(path.Dir(filePath), 0700); err != nil {
+				return err
+			}
+			if err := os.Rename(tempPath, filePath); err != nil {
+				return err
+			}
+		}
+		if err := ba.insertEntry(tx, key, record); err != nil {
+			return err
+		}
+		return setBoltTotalSizeBytes(tx, getBoltTotalSizeBytes(tx)+record.sizeBytes)
+	}); err != nil {
+		return err
+	}
+
+	// Don't remove the file of the blob that was just stored, in
+	// case it replaced an existing copy of the same blob.
+	for i, fileToRemove := range filesToRemove {
+		if record.kind == boltBlobKindFile && fileToRemove == filePath {
+			filesToRemove = append(filesToRemove[:i], filesToRemove[i+1:]...)
+			break
+		}
+	}
+	ba.removeFiles(filesToRemove)
+	return nil
+}
+
+func (ba *boltBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := ba.getKey(instance, digest)
+	if err != nil {
+		return err
+	}
+
+	var filesToRemove []string
+	if err := ba.db.Update(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(boltBucketBlobs).Get(key)
+		if value == nil {
+			return nil
+		}
+		record, err := unmarshalBoltBlobRecord(value)
+		if err != nil {
+			return err
+		}
+		return ba.removeEntry(tx, key, record, &filesToRemove)
+	}); err != nil {
+		return err
+	}
+	ba.removeFiles(filesToRemove)
+	return nil
+}
+
+func (ba *boltBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, digest := range digests {
+		key, err := ba.getKey(instance, digest)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	// Check for the existence of all blobs in a single transaction.
+	var missing []*remoteexecution.Digest
+	var presentKeys [][]byte
+	if err := ba.db.View(func(tx *bbolt.Tx) error {
+		blobs := tx.Bucket(boltBucketBlobs)
+		for i, key := range keys {
+			if blobs.Get(key) == nil {
+				missing = append(missing, digests[i])
+			} else {
+				presentKeys = append(presentKeys, key)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Blobs that are present are marked as recently used, as clients
+	// will most likely depend on them being present afterwards.
+	if len(presentKeys) > 0 {
+		if err := ba.touch(presentKeys); err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,219 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"go.etcd.io/bbolt"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestBoltBlobAccess(t *testing.T, directory string, maxSizeBytes int64) *boltBlobAccess {
+	ba, err := NewBoltBlobAccess(directory, util.KeyDigestWithoutInstance, maxSizeBytes, 50)
+	if err != nil {
+		t.Fatal("NewBoltBlobAccess failed: ", err)
+	}
+	return ba.(*boltBlobAccess)
+}
+
+func putRandomBlob(t *testing.T, ba BlobAccess, sizeBytes int) ([]byte, *remoteexecution.Digest) {
+	data := make([]byte, sizeBytes)
+	rand.Read(data)
+	digest := util.SHA256DigestFunction.DigestFromData(data)
+	if err := ba.Put(context.Background(), "default", digest, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	return data, digest
+}
+
+func getBoltTotalSizeBytesForTesting(t *testing.T, ba *boltBlobAccess) int64 {
+	var totalSizeBytes int64
+	if err := ba.db.View(func(tx *bbolt.Tx) error {
+		totalSizeBytes = getBoltTotalSizeBytes(tx)
+		return nil
+	}); err != nil {
+		t.Fatal("View failed: ", err)
+	}
+	return totalSizeBytes
+}
+
+func TestBoltBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name      string
+		sizeBytes int
+		kind      byte
+	}{
+		{"Empty", 0, boltBlobKindInline},
+		{"Inline", 50, boltBlobKindInline},
+		{"File", 51, boltBlobKindFile},
+		{"LargeFile", 100000, boltBlobKindFile},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "bolt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			ba := newTestBoltBlobAccess(t, directory, 1<<20)
+			defer ba.db.Close()
+
+			data, digest := putRandomBlob(t, ba, test.sizeBytes)
+			key, _ := ba.getKey("default", digest)
+			_, statErr := os.Stat(ba.getFilePath(key))
+			if hasFile := statErr == nil; hasFile != (test.kind == boltBlobKindFile) {
+				t.Fatalf("Expected blob kind %d, got file existence %v", test.kind, hasFile)
+			}
+			got, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+			if err != nil {
+				t.Fatal("Get failed: ", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Expected %d bytes of data, got %d different bytes", len(data), len(got))
+			}
+			if totalSizeBytes := getBoltTotalSizeBytesForTesting(t, ba); totalSizeBytes != int64(test.sizeBytes) {
+				t.Fatalf("Expected total size %d, got %d", test.sizeBytes, totalSizeBytes)
+			}
+
+			if err := ba.Delete(ctx, "default", digest); err != nil {
+				t.Fatal("Delete failed: ", err)
+			}
+			if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.NotFound {
+				t.Fatal("Expected Get to fail with NotFound, got ", err)
+			}
+			if _, err := os.Stat(ba.getFilePath(key)); !os.IsNotExist(err) {
+				t.Fatal("Expected file of blob to be removed, got ", err)
+			}
+			if totalSizeBytes := getBoltTotalSizeBytesForTesting(t, ba); totalSizeBytes != 0 {
+				t.Fatalf("Expected total size 0, got %d", totalSizeBytes)
+			}
+		})
+	}
+}
+
+func TestBoltBlobAccessEviction(t *testing.T) {
+	ctx := context.Background()
+	directory, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ba := newTestBoltBlobAccess(t, directory, 250)
+	defer ba.db.Close()
+
+	_, digestA := putRandomBlob(t, ba, 100)
+	_, digestB := putRandomBlob(t, ba, 40)
+	_, digestC := putRandomBlob(t, ba, 100)
+	keyC, _ := ba.getKey("default", digestC)
+
+	// Reporting A as present marks it as most recently used. Storing
+	// D thus requires evicting B and C, in that order.
+	if missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digestA}); err != nil || len(missing) != 0 {
+		t.Fatalf("Expected blob to be present, got %v: %v", missing, err)
+	}
+	_, digestD := putRandomBlob(t, ba, 60)
+
+	for _, test := range []struct {
+		name    string
+		digest  *remoteexecution.Digest
+		missing bool
+	}{
+		{"A", digestA, false},
+		{"B", digestB, true},
+		{"C", digestC, true},
+		{"D", digestD, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{test.digest})
+			if err != nil {
+				t.Fatal("FindMissing failed: ", err)
+			}
+			if isMissing := len(missing) == 1; isMissing != test.missing {
+				t.Fatalf("Expected missing %v, got %v", test.missing, isMissing)
+			}
+		})
+	}
+	if _, err := os.Stat(ba.getFilePath(keyC)); !os.IsNotExist(err) {
+		t.Fatal("Expected file of evicted blob to be removed, got ", err)
+	}
+	if totalSizeBytes := getBoltTotalSizeBytesForTesting(t, ba); totalSizeBytes != 160 {
+		t.Fatalf("Expected total size 160, got %d", totalSizeBytes)
+	}
+}
+
+func TestBoltBlobAccessReplaceFile(t *testing.T) {
+	ctx := context.Background()
+	directory, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ba := newTestBoltBlobAccess(t, directory, 1000)
+	defer ba.db.Close()
+
+	// Storing a blob that is stored as a file once more must not
+	// cause the new file to be removed, nor count it twice.
+	data, digest := putRandomBlob(t, ba, 300)
+	r := ba.Get(ctx, "default", digest)
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	for _, r := range []io.Reader{r, ba.Get(ctx, "default", digest)} {
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal("Get failed: ", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Expected %d bytes of data, got %d different bytes", len(data), len(got))
+		}
+	}
+	r.Close()
+	if totalSizeBytes := getBoltTotalSizeBytesForTesting(t, ba); totalSizeBytes != 300 {
+		t.Fatalf("Expected total size 300, got %d", totalSizeBytes)
+	}
+}
+
+func TestBoltBlobAccessReopen(t *testing.T) {
+	ctx := context.Background()
+	directory, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ba := newTestBoltBlobAccess(t, directory, 1000)
+	_, digestA := putRandomBlob(t, ba, 300)
+	_, digestB := putRandomBlob(t, ba, 300)
+	ba.db.Close()
+
+	// Files not referenced by the database are removed, while blobs
+	// that no longer fit are discarded.
+	orphanPath := path.Join(directory, boltBlobAccessFilesDirectory, "00", "orphan")
+	if err := os.MkdirAll(path.Dir(orphanPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(orphanPath, []byte("Hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ba = newTestBoltBlobAccess(t, directory, 500)
+	defer ba.db.Close()
+	if _, err := os.Stat(orphanPath); !os.IsNotExist(err) {
+		t.Fatal("Expected orphaned file to be removed, got ", err)
+	}
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digestA, digestB})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 || missing[0] != digestA {
+		t.Fatalf("Expected only %v to be missing, got %v", digestA, missing)
+	}
+}
@@ -154,10 +154,15 @@ func (s *byteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error
 	if digest == nil {
 		return errors.New("Unsupported resource naming scheme")
 	}
-	return s.blobAccess.Put(stream.Context(), instance, digest, &byteStreamWriteServerReader{
+	if err := s.blobAccess.Put(stream.Context(), instance, digest, &byteStreamWriteServerReader{
 		stream:      stream,
 		writeOffset: int64(len(request.Data)),
 		data:        request.Data,
+	}); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&bytestream.WriteResponse{
+		CommittedSize: digest.SizeBytes,
 	})
 }
 
@@ -0,0 +1,207 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	circuitBreakingBlobAccessState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "circuit_breaking_blob_access_state",
+			Help:      "State of the circuit breaker of a storage backend. Set to one for the current state and zero for all others.",
+		},
+		[]string{"name", "state"})
+	circuitBreakingBlobAccessRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "circuit_breaking_blob_access_rejected_total",
+			Help:      "Total number of operations rejected, as the circuit breaker of a storage backend was open.",
+		},
+		[]string{"name", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(circuitBreakingBlobAccessState)
+	prometheus.MustRegister(circuitBreakingBlobAccessRejectedTotal)
+}
+
+type circuitBreakingBlobAccess struct {
+	blobAccess       BlobAccess
+	name             string
+	failureThreshold int
+	openDuration     time.Duration
+
+	lock                sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time
+	probing             bool
+}
+
+// NewCircuitBreakingBlobAccess creates an adapter that stops forwarding
+// operations to a backend after failureThreshold consecutive
+// operations have failed. During openDuration, operations fail
+// immediately with UNAVAILABLE. Afterwards, a single operation is
+// forwarded to probe the backend, while others continue to fail. The
+// circuit breaker closes if the probe succeeds and opens again if it
+// fails. Operations that are cancelled by the caller are not taken
+// into account.
+func NewCircuitBreakingBlobAccess(blobAccess BlobAccess, name string, failureThreshold int, openDuration time.Duration) BlobAccess {
+	ba := &circuitBreakingBlobAccess{
+		blobAccess:       blobAccess,
+		name:             name,
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+	}
+	ba.setState("closed")
+	return ba
+}
+
+func (ba *circuitBreakingBlobAccess) setState(state string) {
+	for _, s := range []string{"closed", "open", "half_open"} {
+		value := 0.0
+		if s == state {
+			value = 1.0
+		}
+		circuitBreakingBlobAccessState.WithLabelValues(ba.name, s).Set(value)
+	}
+}
+
+// allow returns an error if an operation may not be forwarded to the
+// backend, as the circuit breaker is open. It also returns whether the
+// operation is the one that probes the backend while half open.
+func (ba *circuitBreakingBlobAccess) allow(operation string) (bool, error) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if ba.consecutiveFailures < ba.failureThreshold {
+		return false, nil
+	}
+	if ba.probing || time.Now().Before(ba.openUntil) {
+		circuitBreakingBlobAccessRejectedTotal.WithLabelValues(ba.name, operation).Inc()
+		return false, status.Errorf(codes.Unavailable, "Circuit breaker of storage backend %#v is open", ba.name)
+	}
+	ba.probing = true
+	ba.setState("half_open")
+	return true, nil
+}
+
+// record updates the state of the circuit breaker based on the outcome
+// of an operation.
+func (ba *circuitBreakingBlobAccess) record(ctx context.Context, probe bool, err error) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if probe {
+		ba.probing = false
+	}
+	if err != nil && isContextError(ctx, err) {
+		// The caller gave up, meaning nothing can be said
+		// about the health of the backend. Permit another
+		// operation to probe the backend.
+		return
+	}
+	if !isBackendFailure(ctx, err) {
+		if ba.consecutiveFailures >= ba.failureThreshold {
+			ba.setState("closed")
+		}
+		ba.consecutiveFailures = 0
+		return
+	}
+	ba.consecutiveFailures++
+	if ba.consecutiveFailures >= ba.failureThreshold && !time.Now().Before(ba.openUntil) {
+		ba.openUntil = time.Now().Add(ba.openDuration)
+		ba.setState("open")
+	}
+}
+
+// circuitBreakingReader records the outcome of a Get() operation upon
+// the first read, as errors are only returned at that point.
+type circuitBreakingReader struct {
+	io.ReadCloser
+
+	ba       *circuitBreakingBlobAccess
+	ctx      context.Context
+	probe    bool
+	recorded bool
+}
+
+func (r *circuitBreakingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.recorded {
+		r.recorded = true
+		if n != 0 || err == io.EOF {
+			r.ba.record(r.ctx, r.probe, nil)
+		} else {
+			r.ba.record(r.ctx, r.probe, err)
+		}
+	}
+	return n, err
+}
+
+func (r *circuitBreakingReader) Close() error {
+	if !r.recorded && r.probe {
+		// Closed without reading. Permit another operation to
+		// probe the backend.
+		r.recorded = true
+		r.ba.lock.Lock()
+		r.ba.probing = false
+		r.ba.lock.Unlock()
+	}
+	return r.ReadCloser.Close()
+}
+
+func (ba *circuitBreakingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	probe, err := ba.allow("Get")
+	if err != nil {
+		return &errorReader{err: err}
+	}
+	return &circuitBreakingReader{
+		ReadCloser: ba.blobAccess.Get(ctx, instance, digest),
+		ba:         ba,
+		ctx:        ctx,
+		probe:      probe,
+	}
+}
+
+func (ba *circuitBreakingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	probe, err := ba.allow("Put")
+	if err != nil {
+		r.Close()
+		return err
+	}
+	err = ba.blobAccess.Put(ctx, instance, digest, r)
+	ba.record(ctx, probe, err)
+	return err
+}
+
+func (ba *circuitBreakingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	probe, err := ba.allow("Delete")
+	if err != nil {
+		return err
+	}
+	err = ba.blobAccess.Delete(ctx, instance, digest)
+	ba.record(ctx, probe, err)
+	return err
+}
+
+func (ba *circuitBreakingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	probe, err := ba.allow("FindMissing")
+	if err != nil {
+		return nil, err
+	}
+	missing, err := ba.blobAccess.FindMissing(ctx, instance, digests)
+	ba.record(ctx, probe, err)
+	return missing, err
+}
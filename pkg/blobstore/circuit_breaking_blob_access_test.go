@@ -0,0 +1,122 @@
+package blobstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// expectCall calls an operation against a circuit breaker and checks
+// its outcome, and whether it was forwarded to the backend.
+func expectCall(t *testing.T, ba BlobAccess, backend *scriptedBlobAccess, operation string, code codes.Code, forwarded bool) {
+	callsBefore := backend.getCalls()
+	err := callBlobAccess(context.Background(), ba, operation)
+	if c := status.Code(err); c != code {
+		t.Fatalf("Expected %s to fail with code %s, got %s: %v", operation, code, c, err)
+	}
+	if f := backend.getCalls() != callsBefore; f != forwarded {
+		t.Fatalf("Expected forwarding of %s to be %v, got %v", operation, forwarded, f)
+	}
+}
+
+func TestCircuitBreakingBlobAccess(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "Server not reachable")
+	for _, operation := range []string{"Get", "Put", "Delete", "FindMissing"} {
+		t.Run(operation, func(t *testing.T) {
+			backend := &scriptedBlobAccess{}
+			ba := NewCircuitBreakingBlobAccess(backend, "test", 2, 50*time.Millisecond)
+
+			// Closed: failures below the threshold and
+			// failures that are not caused by the backend are
+			// forwarded.
+			backend.errs = []error{unavailable, status.Error(codes.NotFound, "Blob not found"), unavailable}
+			expectCall(t, ba, backend, operation, codes.Unavailable, true)
+			expectCall(t, ba, backend, operation, codes.NotFound, true)
+			expectCall(t, ba, backend, operation, codes.Unavailable, true)
+
+			// Open: the threshold is reached, meaning
+			// operations fail without being forwarded.
+			backend.errs = []error{unavailable}
+			expectCall(t, ba, backend, operation, codes.Unavailable, true)
+			expectCall(t, ba, backend, operation, codes.Unavailable, false)
+
+			// Half open: a failing probe opens the circuit
+			// breaker once more.
+			time.Sleep(60 * time.Millisecond)
+			backend.errs = []error{unavailable}
+			expectCall(t, ba, backend, operation, codes.Unavailable, true)
+			expectCall(t, ba, backend, operation, codes.Unavailable, false)
+
+			// Half open: a successful probe closes the circuit
+			// breaker.
+			time.Sleep(60 * time.Millisecond)
+			expectCall(t, ba, backend, operation, codes.OK, true)
+			expectCall(t, ba, backend, operation, codes.OK, true)
+		})
+	}
+}
+
+func TestCircuitBreakingBlobAccessSingleProbe(t *testing.T) {
+	backend := &scriptedBlobAccess{errs: []error{status.Error(codes.Unavailable, "Server not reachable")}}
+	ba := NewCircuitBreakingBlobAccess(backend, "test", 1, 10*time.Millisecond)
+	expectCall(t, ba, backend, "FindMissing", codes.Unavailable, true)
+	time.Sleep(20 * time.Millisecond)
+
+	// While a probe is in progress, other operations are rejected.
+	backend.release = make(chan struct{})
+	probeDone := make(chan error, 1)
+	go func() {
+		probeDone <- callBlobAccess(context.Background(), ba, "FindMissing")
+	}()
+	for {
+		ba.(*circuitBreakingBlobAccess).lock.Lock()
+		probing := ba.(*circuitBreakingBlobAccess).probing
+		ba.(*circuitBreakingBlobAccess).lock.Unlock()
+		if probing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := callBlobAccess(context.Background(), ba, "FindMissing"); status.Code(err) != codes.Unavailable {
+		t.Fatal("Expected operation during probe to fail with Unavailable, got ", err)
+	}
+	close(backend.release)
+	if err := <-probeDone; err != nil {
+		t.Fatal("Probe failed: ", err)
+	}
+	expectCall(t, ba, backend, "FindMissing", codes.OK, true)
+}
+
+func TestCircuitBreakingBlobAccessCancellation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+	}{
+		{"ContextCanceled", context.Canceled},
+		{"ContextDeadlineExceeded", context.DeadlineExceeded},
+		{"Canceled", status.Error(codes.Canceled, "Cancelled")},
+		{"DeadlineExceeded", status.Error(codes.DeadlineExceeded, "Timeout")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Operations that are cancelled don't count as
+			// failures, neither while closed nor while probing.
+			backend := &scriptedBlobAccess{errs: []error{test.err}}
+			ba := NewCircuitBreakingBlobAccess(backend, "test", 1, 10*time.Millisecond)
+			if err := callBlobAccess(context.Background(), ba, "FindMissing"); err == nil {
+				t.Fatal("FindMissing succeeded unexpectedly")
+			}
+			expectCall(t, ba, backend, "FindMissing", codes.OK, true)
+
+			backend.errs = []error{status.Error(codes.Unavailable, "Server not reachable"), test.err}
+			expectCall(t, ba, backend, "FindMissing", codes.Unavailable, true)
+			time.Sleep(20 * time.Millisecond)
+			if err := callBlobAccess(context.Background(), ba, "FindMissing"); err == nil {
+				t.Fatal("FindMissing succeeded unexpectedly")
+			}
+			expectCall(t, ba, backend, "FindMissing", codes.OK, true)
+		})
+	}
+}
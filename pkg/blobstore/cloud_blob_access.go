@@ -0,0 +1,249 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/google/go-cloud/blob"
+	"github.com/google/go-cloud/blob/fileblob"
+	"github.com/google/go-cloud/blob/gcsblob"
+	"github.com/google/go-cloud/blob/s3blob"
+	"github.com/google/go-cloud/gcp"
+	"github.com/satori/go.uuid"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// cloudBlobAccessTempPrefix is the prefix of the keys under
+	// which blobs in local directories are written, before being
+	// renamed to their final key.
+	cloudBlobAccessTempPrefix = "tmp/"
+)
+
+// OpenCloudBucket opens a bucket by URL. Google Cloud Storage (gs://),
+// S3 (s3://) and local directories (file://) are supported. Azure Blob
+// Storage is not supported, as the Go Cloud release used provides no
+// driver for it. Credentials are obtained from the environment. The
+// region of an S3 bucket may be provided using the "region" query
+// parameter.
+//
+// For local directories, the path of the directory is returned as
+// well. It needs to be provided to NewCloudBlobAccess.
+func OpenCloudBucket(ctx context.Context, bucketURL string) (*blob.Bucket, string, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "gs":
+		creds, err := gcp.DefaultCredentials(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		client, err := gcp.NewHTTPClient(gcp.DefaultTransport(), gcp.CredentialsTokenSource(creds))
+		if err != nil {
+			return nil, "", err
+		}
+		bucket, err := gcsblob.OpenBucket(ctx, u.Host, client)
+		return bucket, "", err
+	case "s3":
+		config := aws.NewConfig()
+		if region := u.Query().Get("region"); region != "" {
+			config.Region = aws.String(region)
+		}
+		sess, err := session.NewSessionWithOptions(session.Options{
+			Config:            *config,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		bucket, err := s3blob.OpenBucket(ctx, sess, u.Host)
+		return bucket, "", err
+	case "file":
+		bucket, err := fileblob.NewBucket(u.Path)
+		return bucket, u.Path, err
+	default:
+		return nil, "", fmt.Errorf("Unsupported bucket URL scheme %#v", u.Scheme)
+	}
+}
+
+// convertCloudError converts an error returned by a bucket to a gRPC
+// error. Buckets only report whether objects do not exist. All other
+// errors are assumed to be transient.
+func convertCloudError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if blob.IsNotExist(err) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+type cloudBlobAccess struct {
+	bucket         *blob.Bucket
+	localDirectory string
+	blobKeyer      util.DigestKeyer
+
+	findMissingConcurrency int
+}
+
+// NewCloudBlobAccess creates a BlobAccess that stores blobs in a bucket
+// provided by the Go Cloud project, such as Google Cloud Storage, S3 or
+// a local directory. FindMissing() checks for the existence of blobs by
+// issuing up to findMissingConcurrency requests in parallel.
+//
+// Objects in local directories are written in place by Go Cloud. If
+// localDirectory is set to the path of the bucket, blobs are thus
+// written under a temporary key and renamed afterwards, so that
+// partially written blobs never become visible. Temporary objects of
+// processes that crash are not removed.
+func NewCloudBlobAccess(bucket *blob.Bucket, localDirectory string, blobKeyer util.DigestKeyer, findMissingConcurrency int) BlobAccess {
+	return &cloudBlobAccess{
+		bucket:         bucket,
+		localDirectory: localDirectory,
+		blobKeyer:      blobKeyer,
+
+		findMissingConcurrency: findMissingConcurrency,
+	}
+}
+
+// key returns the name of the object of a blob. The separators emitted
+// by the digest keyer are replaced, as not all drivers permit them.
+func (ba *cloudBlobAccess) key(instance string, digest *remoteexecution.Digest) (string, error) {
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(key, "|", "-", -1), nil
+}
+
+func (ba *cloudBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	key, err := ba.key(instance, digest)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+	r, err := ba.bucket.NewReader(ctx, key)
+	if err != nil {
+		return &errorReader{err: convertCloudError(ctx, err)}
+	}
+	return r
+}
+
+func (ba *cloudBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	defer r.Close()
+	key, err := ba.key(instance, digest)
+	if err != nil {
+		return err
+	}
+
+	if ba.localDirectory == "" {
+		return ba.write(ctx, key, r)
+	}
+
+	// Local directories are written in place, meaning that blobs
+	// are written under a temporary key that is renamed. The
+	// attributes file is renamed first, so that blobs never become
+	// visible without it.
+	tempKey := cloudBlobAccessTempPrefix + uuid.NewV4().String()
+	if err := ba.write(ctx, tempKey, r); err != nil {
+		ba.bucket.Delete(ctx, tempKey)
+		return err
+	}
+	tempPath := filepath.Join(ba.localDirectory, filepath.FromSlash(tempKey))
+	path := filepath.Join(ba.localDirectory, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		ba.bucket.Delete(ctx, tempKey)
+		return err
+	}
+	for _, suffix := range []string{".attrs", ""} {
+		if err := os.Rename(tempPath+suffix, path+suffix); err != nil && (suffix == "" || !os.IsNotExist(err)) {
+			ba.bucket.Delete(ctx, tempKey)
+			return err
+		}
+	}
+	return nil
+}
+
+// write copies the contents of a blob into an object. Writes are
+// aborted by cancelling the context, so that remote buckets don't
+// store objects partially if reading the input fails. Remote objects
+// are thus never deleted on failure, as that would remove copies that
+// were stored previously.
+func (ba *cloudBlobAccess) write(ctx context.Context, key string, r io.Reader) error {
+	ctxWithCancel, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := ba.bucket.NewWriter(ctxWithCancel, key, &blob.WriterOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return convertCloudError(ctx, err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
+		return convertCloudError(ctx, err)
+	}
+	return convertCloudError(ctx, w.Close())
+}
+
+func (ba *cloudBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	key, err := ba.key(instance, digest)
+	if err != nil {
+		return err
+	}
+	// Deleting absent blobs succeeds, as is the case for S3.
+	if err := ba.bucket.Delete(ctx, key); err != nil && !blob.IsNotExist(err) {
+		return convertCloudError(ctx, err)
+	}
+	return nil
+}
+
+func (ba *cloudBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	var keys []string
+	for _, digest := range digests {
+		key, err := ba.key(instance, digest)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	present := make([]bool, len(keys))
+	if err := forEachConcurrently(ctx, ba.findMissingConcurrency, len(keys), func(ctx context.Context, i int) error {
+		// Reading zero bytes only obtains the object's metadata.
+		r, err := ba.bucket.NewRangeReader(ctx, keys[i], 0, 0)
+		if err == nil {
+			r.Close()
+			present[i] = true
+		} else if !blob.IsNotExist(err) {
+			return convertCloudError(ctx, err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var missing []*remoteexecution.Digest
+	for i, digest := range digests {
+		if !present[i] {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
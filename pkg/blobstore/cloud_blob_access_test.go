@@ -0,0 +1,179 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failingReader returns some data, followed by an error.
+type failingReader struct {
+	io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("Connection reset by peer")
+	}
+	return n, err
+}
+
+func (r *failingReader) Close() error {
+	return nil
+}
+
+func newFileCloudBlobAccess(t *testing.T) (BlobAccess, func()) {
+	dir, err := ioutil.TempDir("", "cloud_blob_access_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, localDirectory, err := OpenCloudBucket(context.Background(), "file://"+dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return NewCloudBlobAccess(bucket, localDirectory, util.KeyDigestWithInstance, 2), func() { os.RemoveAll(dir) }
+}
+
+func TestCloudBlobAccess(t *testing.T) {
+	ba, cleanup := newFileCloudBlobAccess(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	present := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	absent := &remoteexecution.Digest{Hash: "5d41402abc4b2a76b9719d911017c592", SizeBytes: 5}
+	if err := ba.Put(ctx, "default", present, ioutil.NopCloser(bytes.NewBufferString("Hello"))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		instance string
+		digest   *remoteexecution.Digest
+		data     string
+		code     codes.Code
+	}{
+		{"Present", "default", present, "Hello", codes.OK},
+		{"AbsentDigest", "default", absent, "", codes.NotFound},
+		{"OtherInstance", "other", present, "", codes.NotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := ioutil.ReadAll(ba.Get(ctx, test.instance, test.digest))
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("Expected code %s, got %s: %v", test.code, code, err)
+			}
+			if err == nil && string(data) != test.data {
+				t.Fatalf("Expected data %#v, got %#v", test.data, string(data))
+			}
+		})
+	}
+
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{present, absent})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 || missing[0] != absent {
+		t.Fatalf("Expected only %v to be missing, got %v", absent, missing)
+	}
+
+	if err := ba.Delete(ctx, "default", present); err != nil {
+		t.Fatal("Delete failed: ", err)
+	}
+	if err := ba.Delete(ctx, "default", absent); err != nil {
+		t.Fatal("Deleting an absent blob failed: ", err)
+	}
+	missing, err = ba.FindMissing(ctx, "default", []*remoteexecution.Digest{present, absent})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 2 {
+		t.Fatalf("Expected both blobs to be missing, got %v", missing)
+	}
+}
+
+func TestCloudBlobAccessPutFailure(t *testing.T) {
+	ba, cleanup := newFileCloudBlobAccess(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Blobs for which reading the input fails must not be stored
+	// partially.
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	if err := ba.Put(ctx, "default", digest, &failingReader{Reader: bytes.NewBufferString("Hel")}); err == nil {
+		t.Fatal("Put succeeded unexpectedly")
+	}
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 {
+		t.Fatal("Partially written blob is present")
+	}
+
+	// A failing Put must not remove a copy that was stored
+	// previously.
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewBufferString("Hello"))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := ba.Put(ctx, "default", digest, &failingReader{Reader: bytes.NewBufferString("Hel")}); err == nil {
+		t.Fatal("Put succeeded unexpectedly")
+	}
+	data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if string(data) != "Hello" {
+		t.Fatalf("Expected data %#v, got %#v", "Hello", string(data))
+	}
+}
+
+func TestCloudBlobAccessPutInProgress(t *testing.T) {
+	ba, cleanup := newFileCloudBlobAccess(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Blobs must not become visible before they are written
+	// entirely.
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- ba.Put(ctx, "default", digest, pr)
+	}()
+	if _, err := pw.Write([]byte("Hel")); err != nil {
+		t.Fatal("Write failed: ", err)
+	}
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 {
+		t.Fatal("Partially written blob is present")
+	}
+
+	if _, err := pw.Write([]byte("lo")); err != nil {
+		t.Fatal("Write failed: ", err)
+	}
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if string(data) != "Hello" {
+		t.Fatalf("Expected data %#v, got %#v", "Hello", string(data))
+	}
+}
@@ -0,0 +1,177 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CompressionAlgorithm identifies the algorithm that was used to
+// compress a blob. It is stored in the header of compressed blobs.
+type CompressionAlgorithm byte
+
+const (
+	CompressionAlgorithmZstd CompressionAlgorithm = 1
+	CompressionAlgorithmGzip CompressionAlgorithm = 2
+)
+
+var (
+	// compressedBlobMagic is prepended to all blobs written by
+	// compressingBlobAccess, followed by the compression algorithm.
+	compressedBlobMagic = []byte("\x89BBCMP\r\n")
+)
+
+type compressingBlobAccess struct {
+	blobAccess        BlobAccess
+	algorithm         CompressionAlgorithm
+	allowUncompressed bool
+}
+
+// NewCompressingBlobAccess creates an adapter that compresses blobs
+// before storing them in a backend. Digests passed on to the backend
+// are left intact, meaning that the sizes of blobs as stored by the
+// backend no longer match the sizes in their digests. The backend is
+// thus not able to validate blob sizes, and size limits and metrics of
+// the backend apply to compressed sizes.
+//
+// Blobs stored by the backend are expected to start with a header
+// identifying the compression algorithm. If allowUncompressed is set,
+// blobs without this header are returned as is, so that blobs written
+// before enabling compression remain readable during a migration. An
+// uncompressed blob that happens to start with the header is then
+// misinterpreted, meaning that this should only be enabled
+// temporarily.
+func NewCompressingBlobAccess(blobAccess BlobAccess, algorithm CompressionAlgorithm, allowUncompressed bool) BlobAccess {
+	return &compressingBlobAccess{
+		blobAccess:        blobAccess,
+		algorithm:         algorithm,
+		allowUncompressed: allowUncompressed,
+	}
+}
+
+// decompressingReader inspects the header of a blob upon first read,
+// and decompresses the remainder of the blob.
+type decompressingReader struct {
+	source            io.ReadCloser
+	allowUncompressed bool
+	r                 io.Reader
+	close             func()
+}
+
+func (r *decompressingReader) open() error {
+	br := bufio.NewReader(r.source)
+	header, err := br.Peek(len(compressedBlobMagic) + 1)
+	if len(header) <= len(compressedBlobMagic) || !bytes.Equal(header[:len(compressedBlobMagic)], compressedBlobMagic) {
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !r.allowUncompressed {
+			return status.Error(codes.DataLoss, "Blob does not start with a compression header")
+		}
+		// Uncompressed blob written before enabling compression.
+		r.r = br
+		return nil
+	}
+	br.Discard(len(header))
+
+	switch algorithm := CompressionAlgorithm(header[len(compressedBlobMagic)]); algorithm {
+	case CompressionAlgorithmZstd:
+		decoder, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		r.r = decoder
+		r.close = decoder.Close
+	case CompressionAlgorithmGzip:
+		decoder, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		r.r = decoder
+		r.close = func() { decoder.Close() }
+	default:
+		return fmt.Errorf("Blob is compressed using unknown algorithm %d", algorithm)
+	}
+	return nil
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		if err := r.open(); err != nil {
+			r.r = &errorReader{err: err}
+		}
+	}
+	return r.r.Read(p)
+}
+
+func (r *decompressingReader) Close() error {
+	if r.close != nil {
+		r.close()
+	}
+	return r.source.Close()
+}
+
+func (ba *compressingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	return &decompressingReader{
+		source:            ba.blobAccess.Get(ctx, instance, digest),
+		allowUncompressed: ba.allowUncompressed,
+	}
+}
+
+// compress writes the header and the compressed contents of a blob.
+func (ba *compressingBlobAccess) compress(w io.Writer, r io.Reader) error {
+	if _, err := w.Write(append(append([]byte(nil), compressedBlobMagic...), byte(ba.algorithm))); err != nil {
+		return err
+	}
+	var encoder io.WriteCloser
+	switch ba.algorithm {
+	case CompressionAlgorithmZstd:
+		zstdEncoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		encoder = zstdEncoder
+	case CompressionAlgorithmGzip:
+		encoder = gzip.NewWriter(w)
+	default:
+		return fmt.Errorf("Unknown compression algorithm %d", ba.algorithm)
+	}
+	if _, err := io.Copy(encoder, r); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+func (ba *compressingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		pw.CloseWithError(ba.compress(pw, r))
+		r.Close()
+		close(done)
+	}()
+	err := ba.blobAccess.Put(ctx, instance, digest, pr)
+	// Unblock the compressor in case the backend did not consume all
+	// of the data, and ensure it no longer accesses the input.
+	pr.Close()
+	<-done
+	return err
+}
+
+func (ba *compressingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return ba.blobAccess.Delete(ctx, instance, digest)
+}
+
+func (ba *compressingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	return ba.blobAccess.FindMissing(ctx, instance, digests)
+}
@@ -0,0 +1,106 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCompressingBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	random := make([]byte, 100000)
+	rand.Read(random)
+	for _, algorithm := range []struct {
+		name      string
+		algorithm CompressionAlgorithm
+	}{
+		{"Zstd", CompressionAlgorithmZstd},
+		{"Gzip", CompressionAlgorithmGzip},
+	} {
+		for _, test := range []struct {
+			name string
+			data []byte
+		}{
+			{"Empty", nil},
+			{"Small", []byte("Hello")},
+			{"Repetitive", bytes.Repeat([]byte("Hello world "), 10000)},
+			{"Random", random},
+			{"Magic", compressedBlobMagic},
+		} {
+			t.Run(algorithm.name+test.name, func(t *testing.T) {
+				backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<30)
+				ba := NewCompressingBlobAccess(backend, algorithm.algorithm, false)
+				digest := util.SHA256DigestFunction.DigestFromData(test.data)
+				if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(test.data))); err != nil {
+					t.Fatal("Put failed: ", err)
+				}
+				stored, err := ioutil.ReadAll(backend.Get(ctx, "default", digest))
+				if err != nil {
+					t.Fatal("Get from backend failed: ", err)
+				}
+				if !bytes.HasPrefix(stored, compressedBlobMagic) {
+					t.Fatal("Stored blob does not start with a compression header")
+				}
+				data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+				if err != nil {
+					t.Fatal("Get failed: ", err)
+				}
+				if !bytes.Equal(data, test.data) {
+					t.Fatalf("Expected %d bytes of data, got %d different bytes", len(test.data), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressingBlobAccessUncompressed(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name              string
+		data              []byte
+		allowUncompressed bool
+		code              codes.Code
+	}{
+		{"Empty", nil, false, codes.DataLoss},
+		{"Small", []byte("Hello"), false, codes.DataLoss},
+		{"PartialMagic", compressedBlobMagic[:4], false, codes.DataLoss},
+		{"EmptyAllowed", nil, true, codes.OK},
+		{"SmallAllowed", []byte("Hello"), true, codes.OK},
+		{"PartialMagicAllowed", compressedBlobMagic[:4], true, codes.OK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Blobs written before enabling compression are only
+			// returned as is if explicitly permitted.
+			backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<30)
+			digest := util.SHA256DigestFunction.DigestFromData(test.data)
+			if err := backend.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(test.data))); err != nil {
+				t.Fatal("Put failed: ", err)
+			}
+			ba := NewCompressingBlobAccess(backend, CompressionAlgorithmZstd, test.allowUncompressed)
+			data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("Expected code %s, got %s: %v", test.code, code, err)
+			}
+			if err == nil && !bytes.Equal(data, test.data) {
+				t.Fatalf("Expected data %#v, got %#v", test.data, data)
+			}
+		})
+	}
+}
+
+func TestCompressingBlobAccessNotFound(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<30)
+	ba := NewCompressingBlobAccess(backend, CompressionAlgorithmZstd, true)
+	digest := util.SHA256DigestFunction.DigestFromData([]byte("Hello"))
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.NotFound {
+		t.Fatal("Expected Get to fail with NotFound, got ", err)
+	}
+}
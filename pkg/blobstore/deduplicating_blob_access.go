@@ -0,0 +1,283 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"go.opencensus.io/trace"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+const (
+	// deduplicatingBlobAccessMaxBufferedChunks is the maximum
+	// number of chunks that may be read from the backend ahead of
+	// the slowest reader of a blob.
+	deduplicatingBlobAccessMaxBufferedChunks = 256
+)
+
+// deduplicatedGet is a single read of a blob from a backend, whose
+// data is shared by all readers of the blob. Chunks are discarded once
+// they have been consumed by all readers.
+//
+// Changes to the state of the read are announced by closing the wakeup
+// channel, so that goroutines waiting for them can also respond to
+// their context being cancelled.
+type deduplicatedGet struct {
+	lock         sync.Mutex
+	wakeup       chan struct{}
+	chunks       [][]byte
+	chunksOffset int64
+	err          error
+	readers      map[*deduplicatedReader]struct{}
+	joinable     bool
+	cancel       context.CancelFunc
+}
+
+// broadcast wakes up all goroutines waiting for the state of the read
+// to change.
+func (g *deduplicatedGet) broadcast() {
+	close(g.wakeup)
+	g.wakeup = make(chan struct{})
+}
+
+// wait releases the lock until the state of the read changes or the
+// context is done.
+func (g *deduplicatedGet) wait(ctx context.Context) error {
+	wakeup := g.wakeup
+	g.lock.Unlock()
+	var err error
+	select {
+	case <-wakeup:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	g.lock.Lock()
+	return err
+}
+
+func (g *deduplicatedGet) getEndOffset() int64 {
+	if len(g.chunks) == 0 {
+		return g.chunksOffset
+	}
+	return g.chunksOffset + int64(readChunkSize*(len(g.chunks)-1)+len(g.chunks[len(g.chunks)-1]))
+}
+
+// trim discards chunks that have been consumed by all readers. As
+// discarded data can no longer be provided to new readers, the read
+// can no longer be joined afterwards.
+func (g *deduplicatedGet) trim() {
+	minimumOffset := g.getEndOffset()
+	for reader := range g.readers {
+		if minimumOffset > reader.offset {
+			minimumOffset = reader.offset
+		}
+	}
+	trimmed := false
+	for len(g.chunks) > 0 && g.chunksOffset+int64(len(g.chunks[0])) <= minimumOffset {
+		g.chunksOffset += int64(len(g.chunks[0]))
+		g.chunks[0] = nil
+		g.chunks = g.chunks[1:]
+		trimmed = true
+	}
+	if trimmed {
+		g.joinable = false
+		g.broadcast()
+	}
+}
+
+// removeReader detaches a reader from the read. The read from the
+// backend is stopped if nobody is interested in the blob anymore.
+func (g *deduplicatedGet) removeReader(r *deduplicatedReader) {
+	if _, ok := g.readers[r]; !ok {
+		return
+	}
+	delete(g.readers, r)
+	if len(g.readers) == 0 {
+		g.joinable = false
+		g.cancel()
+		g.broadcast()
+	} else {
+		g.trim()
+	}
+}
+
+type deduplicatedReader struct {
+	ctx    context.Context
+	get    *deduplicatedGet
+	offset int64
+	err    error
+}
+
+func (r *deduplicatedReader) Read(p []byte) (int, error) {
+	g := r.get
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if r.err != nil {
+		return 0, r.err
+	}
+	for r.offset == g.getEndOffset() && g.err == nil {
+		if err := g.wait(r.ctx); err != nil {
+			// Stop waiting for data when the caller's
+			// context is done. The read is no longer held
+			// back by this reader.
+			r.err = err
+			g.removeReader(r)
+			return 0, err
+		}
+	}
+	if r.offset == g.getEndOffset() {
+		return 0, g.err
+	}
+	// All chunks apart from the last one are of equal size.
+	position := r.offset - g.chunksOffset
+	chunk := g.chunks[position/readChunkSize][position%readChunkSize:]
+	n := copy(p, chunk)
+	r.offset += int64(n)
+	g.trim()
+	return n, nil
+}
+
+func (r *deduplicatedReader) Close() error {
+	g := r.get
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.removeReader(r)
+	return nil
+}
+
+type deduplicatingBlobAccess struct {
+	blobAccess BlobAccess
+	blobKeyer  util.DigestKeyer
+
+	lock sync.Mutex
+	gets map[string]*deduplicatedGet
+	puts util.CallDeduplicator
+}
+
+// NewDeduplicatingBlobAccess creates an adapter that coalesces
+// concurrent requests for the same blob. Concurrent calls to Get()
+// share a single read from the backend, whose data is provided to all
+// callers. Calls to Put() for a blob that is already being written
+// wait for that write to complete, and only write the blob themselves
+// if it failed.
+func NewDeduplicatingBlobAccess(blobAccess BlobAccess, blobKeyer util.DigestKeyer) BlobAccess {
+	return &deduplicatingBlobAccess{
+		blobAccess: blobAccess,
+		blobKeyer:  blobKeyer,
+
+		gets: map[string]*deduplicatedGet{},
+	}
+}
+
+// fetch reads a blob from the backend, making its data available to
+// the readers of a deduplicatedGet.
+func (ba *deduplicatingBlobAccess) fetch(ctx context.Context, key string, g *deduplicatedGet, instance string, digest *remoteexecution.Digest) {
+	r := ba.blobAccess.Get(ctx, instance, digest)
+	for {
+		chunk := make([]byte, readChunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+
+		g.lock.Lock()
+		if n > 0 {
+			g.chunks = append(g.chunks, chunk[:n])
+		}
+		if err != nil {
+			g.err = err
+		}
+		g.broadcast()
+		// Don't read too far ahead of the slowest reader.
+		for g.err == nil && len(g.readers) > 0 && len(g.chunks) >= deduplicatingBlobAccessMaxBufferedChunks {
+			if g.wait(ctx) != nil {
+				break
+			}
+		}
+		done := g.err != nil || len(g.readers) == 0
+		g.lock.Unlock()
+		if done {
+			break
+		}
+	}
+	r.Close()
+	g.cancel()
+
+	ba.lock.Lock()
+	if ba.gets[key] == g {
+		delete(ba.gets, key)
+	}
+	ba.lock.Unlock()
+}
+
+func (ba *deduplicatingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if g, ok := ba.gets[key]; ok {
+		g.lock.Lock()
+		if g.joinable {
+			r := &deduplicatedReader{ctx: ctx, get: g}
+			g.readers[r] = struct{}{}
+			g.lock.Unlock()
+			return r
+		}
+		g.lock.Unlock()
+	}
+
+	// No read of this blob is in progress that can be joined.
+	// The read is not associated with the context of any of the
+	// callers, as it may outlive them. It is only cancelled once
+	// all callers are gone. The span of the first caller is
+	// retained, so that the read remains part of its trace.
+	ctxWithCancel, cancel := context.WithCancel(trace.NewContext(context.Background(), trace.FromContext(ctx)))
+	g := &deduplicatedGet{
+		wakeup:   make(chan struct{}),
+		readers:  map[*deduplicatedReader]struct{}{},
+		joinable: true,
+		cancel:   cancel,
+	}
+	r := &deduplicatedReader{ctx: ctx, get: g}
+	g.readers[r] = struct{}{}
+	ba.gets[key] = g
+	go ba.fetch(ctxWithCancel, key, g, instance, digest)
+	return r
+}
+
+func (ba *deduplicatingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	called, err := ba.puts.Call(key, func() error {
+		return ba.blobAccess.Put(ctx, instance, digest, r)
+	})
+	if called {
+		return err
+	}
+	if err != nil {
+		// The concurrent write failed. Write the blob ourselves.
+		return ba.blobAccess.Put(ctx, instance, digest, r)
+	}
+	r.Close()
+	return nil
+}
+
+func (ba *deduplicatingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return ba.blobAccess.Delete(ctx, instance, digest)
+}
+
+func (ba *deduplicatingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	return ba.blobAccess.FindMissing(ctx, instance, digests)
+}
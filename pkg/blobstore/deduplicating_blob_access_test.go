@@ -0,0 +1,176 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"go.opencensus.io/trace"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// blockingBlobAccess is a backend of which Get() returns data once it
+// is released. It sends the contexts of calls to Get() over a channel.
+type blockingBlobAccess struct {
+	BlobAccess
+	release  chan struct{}
+	contexts chan context.Context
+}
+
+type blockingReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	release <-chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.release:
+		return r.ReadCloser.Read(p)
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+func (ba *blockingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	ba.contexts <- ctx
+	return &blockingReader{
+		ReadCloser: ba.BlobAccess.Get(ctx, instance, digest),
+		ctx:        ctx,
+		release:    ba.release,
+	}
+}
+
+func newBlockingBlobAccess(t *testing.T, data []byte) (*blockingBlobAccess, *remoteexecution.Digest) {
+	digest := util.SHA256DigestFunction.DigestFromData(data)
+	backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<30)
+	if err := backend.Put(context.Background(), "default", digest, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	return &blockingBlobAccess{
+		BlobAccess: backend,
+		release:    make(chan struct{}),
+		contexts:   make(chan context.Context, 10),
+	}, digest
+}
+
+func TestDeduplicatingBlobAccessGet(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		size    int
+		readers int
+	}{
+		{"Empty", 0, 10},
+		{"SingleChunk", 1000, 10},
+		{"MultipleChunks", 10*readChunkSize + 123, 10},
+		{"ExceedingBuffer", (deduplicatingBlobAccessMaxBufferedChunks + 10) * readChunkSize, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			rand.Read(data)
+			backend, digest := newBlockingBlobAccess(t, data)
+			ba := NewDeduplicatingBlobAccess(backend, util.KeyDigestWithoutInstance)
+
+			// Readers that start before any data is returned
+			// share a single read from the backend.
+			var readers []io.ReadCloser
+			for i := 0; i < test.readers; i++ {
+				readers = append(readers, ba.Get(context.Background(), "default", digest))
+			}
+			close(backend.release)
+			var wg sync.WaitGroup
+			for _, r := range readers {
+				wg.Add(1)
+				go func(r io.ReadCloser) {
+					defer wg.Done()
+					defer r.Close()
+					got, err := ioutil.ReadAll(r)
+					if err != nil {
+						t.Error("Read failed: ", err)
+					} else if !bytes.Equal(got, data) {
+						t.Errorf("Expected %d bytes of data, got %d different bytes", len(data), len(got))
+					}
+				}(r)
+			}
+			wg.Wait()
+			if n := len(backend.contexts); n != 1 {
+				t.Fatalf("Expected a single read from the backend, got %d", n)
+			}
+		})
+	}
+}
+
+func TestDeduplicatingBlobAccessCancellation(t *testing.T) {
+	backend, digest := newBlockingBlobAccess(t, []byte("Hello"))
+	ba := NewDeduplicatingBlobAccess(backend, util.KeyDigestWithoutInstance)
+
+	// A reader whose context is cancelled stops waiting for data,
+	// while other readers continue to wait.
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	r1 := ba.Get(ctx1, "default", digest)
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	r2 := ba.Get(ctx2, "default", digest)
+	errs := make(chan error, 2)
+	go func() {
+		_, err := ioutil.ReadAll(r1)
+		errs <- err
+	}()
+	go func() {
+		_, err := ioutil.ReadAll(r2)
+		errs <- err
+	}()
+
+	cancel1()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatal("Expected the first reader to be cancelled, got ", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Reader did not observe cancellation of its context")
+	}
+	fetchCtx := <-backend.contexts
+	if fetchCtx.Err() != nil {
+		t.Fatal("Read from the backend was cancelled while a reader remains")
+	}
+
+	// The read from the backend is cancelled once all readers are
+	// gone, even if they have not been closed.
+	cancel2()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal("Expected the second reader to be cancelled, got ", err)
+	}
+	select {
+	case <-fetchCtx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Read from the backend was not cancelled")
+	}
+	r1.Close()
+	r2.Close()
+}
+
+func TestDeduplicatingBlobAccessTracing(t *testing.T) {
+	backend, digest := newBlockingBlobAccess(t, []byte("Hello"))
+	ba := NewDeduplicatingBlobAccess(backend, util.KeyDigestWithoutInstance)
+
+	// The read from the backend is part of the trace of the caller
+	// that started it.
+	ctx, span := trace.StartSpan(context.Background(), "Get")
+	defer span.End()
+	r := ba.Get(ctx, "default", digest)
+	close(backend.release)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal("Read failed: ", err)
+	}
+	r.Close()
+	if fetchSpan := trace.FromContext(<-backend.contexts); fetchSpan != span {
+		t.Fatal("Read from the backend does not carry the span of the caller")
+	}
+}
@@ -0,0 +1,164 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	diskCacheBlobAccessTempDirectory = "tmp"
+)
+
+type diskCacheBlobAccess struct {
+	path     string
+	tempPath string
+}
+
+// NewDiskCacheBlobAccess creates a BlobAccess that stores blobs in the
+// directory layout used by Bazel's --disk_cache flag. Blobs are stored
+// at ${directory}/${prefix}/${hash:0:2}/${hash}, where prefix is either
+// "cas" or "ac". As this layout has no notion of instance names, blobs
+// are shared by all instances.
+//
+// Blobs are first written to temporary files in ${directory}/tmp, after
+// which they are renamed into place. This ensures that partially
+// written blobs never become visible, even if the directory is shared
+// with other processes, e.g., over NFS. No attempt is made to bound the
+// size of the directory. Like Bazel, the modification times of blobs
+// are updated when they are reported present, so that external tools
+// may discard the least recently used blobs.
+func NewDiskCacheBlobAccess(directory string, prefix string) (BlobAccess, error) {
+	ba := &diskCacheBlobAccess{
+		path:     path.Join(directory, prefix),
+		tempPath: path.Join(directory, diskCacheBlobAccessTempDirectory),
+	}
+	if err := os.MkdirAll(ba.path, 0777); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ba.tempPath, 0777); err != nil {
+		return nil, err
+	}
+	return ba, nil
+}
+
+// getFilePath converts a digest to the path of the file in which the
+// blob is stored. Hashes are validated, as they are used as file names.
+func (ba *diskCacheBlobAccess) getFilePath(digest *remoteexecution.Digest) (string, error) {
+	if len(digest.Hash) < 2 {
+		return "", status.Errorf(codes.InvalidArgument, "Hash %#v is too short", digest.Hash)
+	}
+	if _, err := hex.DecodeString(digest.Hash); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Hash %#v is not hexadecimal", digest.Hash)
+	}
+	return path.Join(ba.path, digest.Hash[:2], digest.Hash), nil
+}
+
+func (ba *diskCacheBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	if err := ctx.Err(); err != nil {
+		return &errorReader{err: err}
+	}
+	filePath, err := ba.getFilePath(digest)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &errorReader{err: status.Errorf(codes.NotFound, "Blob not found")}
+		}
+		return &errorReader{err: err}
+	}
+	return f
+}
+
+func (ba *diskCacheBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	defer r.Close()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	filePath, err := ba.getFilePath(digest)
+	if err != nil {
+		return err
+	}
+
+	// Stream the blob into a temporary file, so that partially
+	// written blobs never become visible.
+	f, err := ioutil.TempFile(ba.tempPath, "blob")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// Temporary files are created with mode 0600. Make blobs
+	// readable by Bazel running as other users.
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(filePath), 0777); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filePath); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (ba *diskCacheBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	filePath, err := ba.getFilePath(digest)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ba *diskCacheBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	now := time.Now()
+	var missing []*remoteexecution.Digest
+	for _, digest := range digests {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		filePath, err := ba.getFilePath(digest)
+		if err != nil {
+			return nil, err
+		}
+		// Blobs that are present are marked as recently used, as
+		// clients will most likely depend on them being present
+		// afterwards.
+		if err := os.Chtimes(filePath, now, now); os.IsNotExist(err) {
+			missing = append(missing, digest)
+		} else if err != nil && !os.IsPermission(err) {
+			// Blobs written by other users cannot be
+			// touched, but are present nonetheless.
+			return nil, err
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,225 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestDiskCacheBlobAccess(t *testing.T, directory string, prefix string) BlobAccess {
+	ba, err := NewDiskCacheBlobAccess(directory, prefix)
+	if err != nil {
+		t.Fatal("Failed to create disk cache: ", err)
+	}
+	return ba
+}
+
+func readDiskCacheFile(t *testing.T, filePath string) string {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal("Failed to read blob from disk: ", err)
+	}
+	return string(data)
+}
+
+func expectDirectoryEmpty(t *testing.T, directory string) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal("Failed to read directory: ", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected directory %#v to be empty, got %d files", directory, len(files))
+	}
+}
+
+func TestDiskCacheBlobAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk_cache_blob_access_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cas := newTestDiskCacheBlobAccess(t, dir, "cas")
+	ac := newTestDiskCacheBlobAccess(t, dir, "ac")
+	ctx := context.Background()
+
+	// Blobs should be stored in the layout used by Bazel, shared by
+	// all instances. The Action Cache and the Content Addressable
+	// Storage are stored separately.
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	if err := cas.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewBufferString("Hello"))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := ac.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewBufferString("World"))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	casPath := path.Join(dir, "cas", "8b", "8b1a9953c4611296a827abf8c47804d7")
+	if data := readDiskCacheFile(t, casPath); data != "Hello" {
+		t.Fatalf("Expected data %#v, got %#v", "Hello", data)
+	}
+	if data := readDiskCacheFile(t, path.Join(dir, "ac", "8b", "8b1a9953c4611296a827abf8c47804d7")); data != "World" {
+		t.Fatalf("Expected data %#v, got %#v", "World", data)
+	}
+	if info, err := os.Stat(casPath); err != nil {
+		t.Fatal("Failed to stat blob: ", err)
+	} else if mode := info.Mode().Perm(); mode != 0644 {
+		t.Fatalf("Expected blob to have mode %o, got %o", 0644, mode)
+	}
+	expectDirectoryEmpty(t, path.Join(dir, "tmp"))
+
+	r := cas.Get(ctx, "other-instance", digest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if string(data) != "Hello" {
+		t.Fatalf("Expected data %#v, got %#v", "Hello", string(data))
+	}
+
+	// Deleting blobs is idempotent.
+	for i := 0; i < 2; i++ {
+		if err := cas.Delete(ctx, "default", digest); err != nil {
+			t.Fatal("Delete failed: ", err)
+		}
+	}
+	r = cas.Get(ctx, "default", digest)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if code := status.Code(err); code != codes.NotFound {
+		t.Fatalf("Expected code %s, got %s: %v", codes.NotFound, code, err)
+	}
+	if data := readDiskCacheFile(t, path.Join(dir, "ac", "8b", "8b1a9953c4611296a827abf8c47804d7")); data != "World" {
+		t.Fatalf("Expected data %#v, got %#v", "World", data)
+	}
+}
+
+func TestDiskCacheBlobAccessPutAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk_cache_blob_access_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ba := newTestDiskCacheBlobAccess(t, dir, "cas")
+	ctx := context.Background()
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	blobPath := path.Join(dir, "cas", "8b", "8b1a9953c4611296a827abf8c47804d7")
+
+	t.Run("InProgress", func(t *testing.T) {
+		// Blobs should not be visible while being written.
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- ba.Put(ctx, "default", digest, pr)
+		}()
+		if _, err := pw.Write([]byte("Hel")); err != nil {
+			t.Fatal("Failed to write data: ", err)
+		}
+		if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+			t.Fatal("Partially written blob is visible: ", err)
+		}
+		pw.Write([]byte("lo"))
+		pw.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Put failed: ", err)
+		}
+		if data := readDiskCacheFile(t, blobPath); data != "Hello" {
+			t.Fatalf("Expected data %#v, got %#v", "Hello", data)
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		// Failed uploads should leave existing blobs intact and
+		// not leave temporary files behind.
+		if err := ba.Put(ctx, "default", digest, &failingReader{Reader: bytes.NewBufferString("Hel")}); err == nil {
+			t.Fatal("Put succeeded unexpectedly")
+		}
+		if data := readDiskCacheFile(t, blobPath); data != "Hello" {
+			t.Fatalf("Expected data %#v, got %#v", "Hello", data)
+		}
+		expectDirectoryEmpty(t, path.Join(dir, "tmp"))
+	})
+}
+
+func TestDiskCacheBlobAccessFindMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk_cache_blob_access_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ba := newTestDiskCacheBlobAccess(t, dir, "cas")
+	ctx := context.Background()
+
+	present := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	absent := &remoteexecution.Digest{Hash: "5d41402abc4b2a76b9719d911017c592", SizeBytes: 5}
+	if err := ba.Put(ctx, "default", present, ioutil.NopCloser(bytes.NewBufferString("Hello"))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	presentPath := path.Join(dir, "cas", "8b", "8b1a9953c4611296a827abf8c47804d7")
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(presentPath, old, old); err != nil {
+		t.Fatal("Failed to change modification time: ", err)
+	}
+
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{present, absent})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 || missing[0] != absent {
+		t.Fatalf("Expected only %s to be missing, got %v", absent.Hash, missing)
+	}
+
+	// Blobs reported present should be marked as recently used.
+	info, err := os.Stat(presentPath)
+	if err != nil {
+		t.Fatal("Failed to stat blob: ", err)
+	}
+	if time.Since(info.ModTime()) > time.Hour {
+		t.Fatalf("Modification time %s of blob was not refreshed", info.ModTime())
+	}
+}
+
+func TestDiskCacheBlobAccessInvalidHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk_cache_blob_access_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ba := newTestDiskCacheBlobAccess(t, dir, "cas")
+	ctx := context.Background()
+
+	// Hashes are used as file names, meaning they must be validated
+	// to prevent access to files outside the cache.
+	for _, hash := range []string{"", "8", "../../etc/passwd", "8b/../../ac/8b1a", "not-hexadecimal"} {
+		t.Run(hash, func(t *testing.T) {
+			digest := &remoteexecution.Digest{Hash: hash, SizeBytes: 5}
+			r := ba.Get(ctx, "default", digest)
+			_, err := ioutil.ReadAll(r)
+			r.Close()
+			if code := status.Code(err); code != codes.InvalidArgument {
+				t.Fatalf("Expected code %s for Get, got %s: %v", codes.InvalidArgument, code, err)
+			}
+			err = ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewBufferString("Hello")))
+			if code := status.Code(err); code != codes.InvalidArgument {
+				t.Fatalf("Expected code %s for Put, got %s: %v", codes.InvalidArgument, code, err)
+			}
+			err = ba.Delete(ctx, "default", digest)
+			if code := status.Code(err); code != codes.InvalidArgument {
+				t.Fatalf("Expected code %s for Delete, got %s: %v", codes.InvalidArgument, code, err)
+			}
+			_, err = ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+			if code := status.Code(err); code != codes.InvalidArgument {
+				t.Fatalf("Expected code %s for FindMissing, got %s: %v", codes.InvalidArgument, code, err)
+			}
+		})
+	}
+	expectDirectoryEmpty(t, path.Join(dir, "tmp"))
+}
@@ -0,0 +1,326 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// encryptedBlobChunkSize is the amount of plaintext that is
+	// stored in every chunk of an encrypted blob.
+	encryptedBlobChunkSize = 1 << 16
+	encryptedBlobSaltSize  = 32
+)
+
+var (
+	// encryptedBlobMagic is prepended to all blobs written by
+	// encryptingBlobAccess. It is followed by the length of the key
+	// ID, the key ID and a salt from which the key for the blob is
+	// derived. Blobs not starting with it are only returned if
+	// reading unencrypted blobs is permitted explicitly.
+	encryptedBlobMagic = []byte("\x89BBENC\r\n")
+)
+
+// EncryptionKey is an AES key used to encrypt blobs. The ID of the key
+// is stored in the header of every blob encrypted with it, so that
+// keys may be rotated without making existing blobs unreadable.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// ReadEncryptionKeyFile reads a list of encryption keys from a file.
+// Every line of the file contains a key ID and a hexadecimal AES key,
+// separated by a pipe. Example: 2018-08|0123456789abcdef...
+func ReadEncryptionKeyFile(path string) ([]EncryptionKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []EncryptionKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		components := strings.SplitN(line, "|", 2)
+		if len(components) != 2 {
+			return nil, fmt.Errorf("Line %d of encryption key file does not contain a key ID and a key", i+1)
+		}
+		key, err := hex.DecodeString(components[1])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of encryption key file does not contain a hexadecimal key", i+1)
+		}
+		keys = append(keys, EncryptionKey{
+			ID:  components[0],
+			Key: key,
+		})
+	}
+	return keys, nil
+}
+
+type encryptingBlobAccess struct {
+	blobAccess       BlobAccess
+	keys             map[string][]byte
+	currentKey       EncryptionKey
+	allowUnencrypted bool
+}
+
+// NewEncryptingBlobAccess creates an adapter that encrypts blobs using
+// AES-GCM before storing them in a backend. Blobs are split up in
+// chunks that are encrypted individually, so that blobs can be
+// processed without buffering them entirely. The last key in the list
+// is used to encrypt blobs, while all keys may be used to decrypt them.
+//
+// If allowUnencrypted is set, blobs not starting with the header of
+// encrypted blobs are returned as is, so that blobs written before
+// enabling encryption remain readable during a migration. As this
+// permits anyone with access to the backend to provide data that is
+// not authenticated, this should only be enabled temporarily.
+func NewEncryptingBlobAccess(blobAccess BlobAccess, keys []EncryptionKey, allowUnencrypted bool) (BlobAccess, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No encryption keys provided")
+	}
+	keysMap := map[string][]byte{}
+	for _, key := range keys {
+		if len(key.ID) == 0 || len(key.ID) > 255 {
+			return nil, fmt.Errorf("Encryption key ID %#v should be between 1 and 255 bytes in size", key.ID)
+		}
+		if _, err := aes.NewCipher(key.Key); err != nil {
+			return nil, fmt.Errorf("Encryption key %#v is invalid: %s", key.ID, err)
+		}
+		if _, ok := keysMap[key.ID]; ok {
+			return nil, fmt.Errorf("Encryption key ID %#v is used multiple times", key.ID)
+		}
+		keysMap[key.ID] = key.Key
+	}
+	return &encryptingBlobAccess{
+		blobAccess:       blobAccess,
+		keys:             keysMap,
+		currentKey:       keys[len(keys)-1],
+		allowUnencrypted: allowUnencrypted,
+	}, nil
+}
+
+// newBlobAEAD derives a key for an individual blob from a salt. This
+// permits the use of sequential nonces for the chunks of a blob, as
+// keys are never reused across blobs.
+func newBlobAEAD(key []byte, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// getChunkNonceAndData returns the nonce and additional data of a
+// chunk. The additional data indicates whether the chunk is the final
+// one, so that truncation of the blob can be detected.
+func getChunkNonceAndData(aead cipher.AEAD, index uint64, final bool) ([]byte, []byte) {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	if final {
+		return nonce, []byte{1}
+	}
+	return nonce, []byte{0}
+}
+
+// decryptingReader parses the header of a blob upon first read, and
+// decrypts the remainder of the blob one chunk at a time.
+type decryptingReader struct {
+	ba     *encryptingBlobAccess
+	source io.ReadCloser
+
+	r          io.Reader
+	aead       cipher.AEAD
+	chunkIndex uint64
+	ciphertext []byte
+	plaintext  []byte
+	final      bool
+	err        error
+}
+
+func (r *decryptingReader) open() error {
+	br := bufio.NewReader(r.source)
+	header, err := br.Peek(len(encryptedBlobMagic))
+	if !bytes.Equal(header, encryptedBlobMagic) {
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !r.ba.allowUnencrypted {
+			return status.Error(codes.DataLoss, "Blob does not start with an encryption header")
+		}
+		// Unencrypted blob written before enabling encryption.
+		r.r = br
+		return nil
+	}
+	br.Discard(len(header))
+
+	var keyIDLength [1]byte
+	if _, err := io.ReadFull(br, keyIDLength[:]); err != nil {
+		return convertEncryptedBlobReadError(err)
+	}
+	keyID := make([]byte, keyIDLength[0])
+	if _, err := io.ReadFull(br, keyID); err != nil {
+		return convertEncryptedBlobReadError(err)
+	}
+	key, ok := r.ba.keys[string(keyID)]
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "Blob is encrypted using unknown key %#v", string(keyID))
+	}
+	salt := make([]byte, encryptedBlobSaltSize)
+	if _, err := io.ReadFull(br, salt); err != nil {
+		return convertEncryptedBlobReadError(err)
+	}
+	aead, err := newBlobAEAD(key, salt)
+	if err != nil {
+		return err
+	}
+	r.r = br
+	r.aead = aead
+	r.ciphertext = make([]byte, encryptedBlobChunkSize+aead.Overhead())
+	return nil
+}
+
+func convertEncryptedBlobReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return status.Errorf(codes.DataLoss, "Encrypted blob is truncated")
+	}
+	return err
+}
+
+// readChunk reads and decrypts the next chunk of the blob. Only the
+// final chunk is smaller than the maximum chunk size.
+func (r *decryptingReader) readChunk() error {
+	n, err := io.ReadFull(r.r, r.ciphertext)
+	if err == io.ErrUnexpectedEOF {
+		r.final = true
+	} else if err != nil {
+		return convertEncryptedBlobReadError(err)
+	}
+	nonce, additionalData := getChunkNonceAndData(r.aead, r.chunkIndex, r.final)
+	plaintext, err := r.aead.Open(r.ciphertext[:0], nonce, r.ciphertext[:n], additionalData)
+	if err != nil {
+		return status.Errorf(codes.DataLoss, "Failed to decrypt chunk %d of blob: %s", r.chunkIndex, err)
+	}
+	r.chunkIndex++
+	r.plaintext = plaintext
+	return nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.r == nil {
+		if err := r.open(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	if r.aead == nil {
+		return r.r.Read(p)
+	}
+	for len(r.plaintext) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.source.Close()
+}
+
+func (ba *encryptingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	return &decryptingReader{
+		ba:     ba,
+		source: ba.blobAccess.Get(ctx, instance, digest),
+	}
+}
+
+// encrypt writes the header and the encrypted chunks of a blob.
+func (ba *encryptingBlobAccess) encrypt(w io.Writer, r io.Reader) error {
+	salt := make([]byte, encryptedBlobSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	aead, err := newBlobAEAD(ba.currentKey.Key, salt)
+	if err != nil {
+		return err
+	}
+	header := append([]byte(nil), encryptedBlobMagic...)
+	header = append(header, byte(len(ba.currentKey.ID)))
+	header = append(header, ba.currentKey.ID...)
+	header = append(header, salt...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	plaintext := make([]byte, encryptedBlobChunkSize)
+	var ciphertext []byte
+	for chunkIndex := uint64(0); ; chunkIndex++ {
+		n, err := io.ReadFull(r, plaintext)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		nonce, additionalData := getChunkNonceAndData(aead, chunkIndex, final)
+		ciphertext = aead.Seal(ciphertext[:0], nonce, plaintext[:n], additionalData)
+		if _, err := w.Write(ciphertext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func (ba *encryptingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		pw.CloseWithError(ba.encrypt(pw, r))
+		r.Close()
+		close(done)
+	}()
+	err := ba.blobAccess.Put(ctx, instance, digest, pr)
+	// Unblock the encryptor in case the backend did not consume all
+	// of the data, and ensure it no longer accesses the input.
+	pr.Close()
+	<-done
+	return err
+}
+
+func (ba *encryptingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return ba.blobAccess.Delete(ctx, instance, digest)
+}
+
+func (ba *encryptingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	return ba.blobAccess.FindMissing(ctx, instance, digests)
+}
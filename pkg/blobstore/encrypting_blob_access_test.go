@@ -0,0 +1,175 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestEncryptionKey(id string) EncryptionKey {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return EncryptionKey{ID: id, Key: key}
+}
+
+func TestEncryptingBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	oldKey, newKey := newTestEncryptionKey("old"), newTestEncryptionKey("new")
+	for _, test := range []struct {
+		name string
+		size int
+	}{
+		{"Empty", 0},
+		{"Small", 5},
+		{"ChunkMinusOne", encryptedBlobChunkSize - 1},
+		{"Chunk", encryptedBlobChunkSize},
+		{"ChunkPlusOne", encryptedBlobChunkSize + 1},
+		{"MultipleChunks", 3 * encryptedBlobChunkSize},
+		{"MultipleChunksPartial", 3*encryptedBlobChunkSize + 123},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			rand.Read(data)
+			digest := util.SHA256DigestFunction.DigestFromData(data)
+			backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<30)
+			baOld, err := NewEncryptingBlobAccess(backend, []EncryptionKey{oldKey}, false)
+			if err != nil {
+				t.Fatal("NewEncryptingBlobAccess failed: ", err)
+			}
+			baNew, err := NewEncryptingBlobAccess(backend, []EncryptionKey{oldKey, newKey}, false)
+			if err != nil {
+				t.Fatal("NewEncryptingBlobAccess failed: ", err)
+			}
+
+			// Blobs written using a key that has been rotated
+			// remain readable.
+			for _, ba := range []BlobAccess{baOld, baNew} {
+				if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+					t.Fatal("Put failed: ", err)
+				}
+				stored, err := ioutil.ReadAll(backend.Get(ctx, "default", digest))
+				if err != nil {
+					t.Fatal("Get from backend failed: ", err)
+				}
+				if len(data) > 0 && bytes.Contains(stored, data) {
+					t.Fatal("Stored blob contains plaintext")
+				}
+				got, err := ioutil.ReadAll(baNew.Get(ctx, "default", digest))
+				if err != nil {
+					t.Fatal("Get failed: ", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("Expected %d bytes of data, got %d different bytes", len(data), len(got))
+				}
+			}
+
+			// Blobs written using a newer key cannot be read
+			// without it.
+			if _, err := ioutil.ReadAll(baOld.Get(ctx, "default", digest)); status.Code(err) != codes.FailedPrecondition {
+				t.Fatal("Expected Get to fail with FailedPrecondition, got ", err)
+			}
+		})
+	}
+}
+
+func TestEncryptingBlobAccessTampering(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<30)
+	ba, err := NewEncryptingBlobAccess(backend, []EncryptionKey{newTestEncryptionKey("key")}, false)
+	if err != nil {
+		t.Fatal("NewEncryptingBlobAccess failed: ", err)
+	}
+
+	// Store a blob consisting of three full chunks and a partial one.
+	data := make([]byte, 3*encryptedBlobChunkSize+123)
+	rand.Read(data)
+	digest := util.SHA256DigestFunction.DigestFromData(data)
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	stored, err := ioutil.ReadAll(backend.Get(ctx, "default", digest))
+	if err != nil {
+		t.Fatal("Get from backend failed: ", err)
+	}
+	headerSize := len(encryptedBlobMagic) + 1 + len("key") + encryptedBlobSaltSize
+	chunkSize := encryptedBlobChunkSize + 16
+	chunk := func(i int) []byte {
+		return stored[headerSize+i*chunkSize : headerSize+(i+1)*chunkSize]
+	}
+	concat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, part := range parts {
+			b = append(b, part...)
+		}
+		return b
+	}
+	corrupted := append([]byte(nil), stored...)
+	corrupted[headerSize+chunkSize+10] ^= 1
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"TruncatedHeader", stored[:headerSize-1]},
+		{"TruncatedAtChunkBoundary", stored[:headerSize+3*chunkSize]},
+		{"TruncatedWithinChunk", stored[:headerSize+2*chunkSize+100]},
+		{"TruncatedFinalChunk", stored[:len(stored)-1]},
+		{"ReorderedChunks", concat(stored[:headerSize], chunk(1), chunk(0), stored[headerSize+2*chunkSize:])},
+		{"DuplicatedChunk", concat(stored[:headerSize], chunk(0), chunk(0), stored[headerSize+2*chunkSize:])},
+		{"Corrupted", corrupted},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := backend.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(test.data))); err != nil {
+				t.Fatal("Put failed: ", err)
+			}
+			if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.DataLoss {
+				t.Fatal("Expected Get to fail with DataLoss, got ", err)
+			}
+		})
+	}
+}
+
+func TestEncryptingBlobAccessUnencrypted(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name             string
+		data             []byte
+		allowUnencrypted bool
+		code             codes.Code
+	}{
+		{"Empty", nil, false, codes.DataLoss},
+		{"Small", []byte("Hello"), false, codes.DataLoss},
+		{"PartialMagic", encryptedBlobMagic[:4], false, codes.DataLoss},
+		{"EmptyAllowed", nil, true, codes.OK},
+		{"SmallAllowed", []byte("Hello"), true, codes.OK},
+		{"PartialMagicAllowed", encryptedBlobMagic[:4], true, codes.OK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Blobs written before enabling encryption are only
+			// returned as is if explicitly permitted.
+			backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<30)
+			digest := util.SHA256DigestFunction.DigestFromData(test.data)
+			if err := backend.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(test.data))); err != nil {
+				t.Fatal("Put failed: ", err)
+			}
+			ba, err := NewEncryptingBlobAccess(backend, []EncryptionKey{newTestEncryptionKey("key")}, test.allowUnencrypted)
+			if err != nil {
+				t.Fatal("NewEncryptingBlobAccess failed: ", err)
+			}
+			data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("Expected code %s, got %s: %v", test.code, code, err)
+			}
+			if err == nil && !bytes.Equal(data, test.data) {
+				t.Fatalf("Expected data %#v, got %#v", test.data, data)
+			}
+		})
+	}
+}
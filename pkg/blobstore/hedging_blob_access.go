@@ -0,0 +1,265 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+const (
+	// hedgingBlobAccessLatencySamples is the number of recent
+	// first byte latencies from which the hedging delay is computed.
+	hedgingBlobAccessLatencySamples = 1024
+	// hedgingBlobAccessRecomputeInterval is the number of samples
+	// after which the hedging delay is recomputed.
+	hedgingBlobAccessRecomputeInterval = 64
+)
+
+var (
+	hedgingBlobAccessHedgesSentTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "hedging_blob_access_hedges_sent_total",
+			Help:      "Total number of additional Get() requests sent to a storage backend, as the first request did not return data in time.",
+		},
+		[]string{"name"})
+	hedgingBlobAccessHedgesWonTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "hedging_blob_access_hedges_won_total",
+			Help:      "Total number of additional Get() requests sent to a storage backend that returned data before the first request.",
+		},
+		[]string{"name"})
+	hedgingBlobAccessDelaySeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "hedging_blob_access_delay_seconds",
+			Help:      "Amount of time after which an additional Get() request is sent to a storage backend.",
+		},
+		[]string{"name"})
+)
+
+func init() {
+	prometheus.MustRegister(hedgingBlobAccessHedgesSentTotal)
+	prometheus.MustRegister(hedgingBlobAccessHedgesWonTotal)
+	prometheus.MustRegister(hedgingBlobAccessDelaySeconds)
+}
+
+type hedgingBlobAccess struct {
+	blobAccess BlobAccess
+	name       string
+	percentile float64
+
+	lock                  sync.Mutex
+	delay                 time.Duration
+	samples               []time.Duration
+	samplesSinceRecompute int
+}
+
+// NewHedgingBlobAccess creates an adapter that reduces the tail latency
+// of Get() by sending a second request to the backend if the first
+// request has not returned any data after a delay. Data is read from
+// whichever request returns data first, while the other request is
+// cancelled.
+//
+// If percentile is zero, the delay is fixed. Otherwise, it is set to
+// the given percentile (e.g., 0.95) of the time it took recent
+// successful requests to return data, using the provided delay until
+// enough requests have been observed.
+func NewHedgingBlobAccess(blobAccess BlobAccess, name string, delay time.Duration, percentile float64) BlobAccess {
+	hedgingBlobAccessDelaySeconds.WithLabelValues(name).Set(delay.Seconds())
+	return &hedgingBlobAccess{
+		blobAccess: blobAccess,
+		name:       name,
+		percentile: percentile,
+		delay:      delay,
+	}
+}
+
+func (ba *hedgingBlobAccess) getDelay() time.Duration {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	return ba.delay
+}
+
+// recordLatency adds an observed first byte latency to the set of
+// samples, recomputing the delay periodically.
+func (ba *hedgingBlobAccess) recordLatency(latency time.Duration) {
+	if ba.percentile <= 0 {
+		return
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if len(ba.samples) < hedgingBlobAccessLatencySamples {
+		ba.samples = append(ba.samples, latency)
+	} else {
+		copy(ba.samples, ba.samples[1:])
+		ba.samples[len(ba.samples)-1] = latency
+	}
+	ba.samplesSinceRecompute++
+	if ba.samplesSinceRecompute < hedgingBlobAccessRecomputeInterval {
+		return
+	}
+	ba.samplesSinceRecompute = 0
+
+	sorted := append([]time.Duration(nil), ba.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(ba.percentile * float64(len(sorted)))
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	ba.delay = sorted[index]
+	hedgingBlobAccessDelaySeconds.WithLabelValues(ba.name).Set(ba.delay.Seconds())
+}
+
+// hedgedAttempt is a single Get() request sent to the backend, together
+// with the result of the first read.
+type hedgedAttempt struct {
+	reader io.ReadCloser
+	cancel context.CancelFunc
+	hedge  bool
+	data   []byte
+	err    error
+}
+
+func (a *hedgedAttempt) succeeded() bool {
+	return len(a.data) > 0 || a.err == nil || a.err == io.EOF
+}
+
+// hedgingReader sends requests to the backend upon the first read, as
+// errors of Get() are only returned at that point.
+type hedgingReader struct {
+	ba       *hedgingBlobAccess
+	ctx      context.Context
+	instance string
+	digest   *remoteexecution.Digest
+
+	winner *hedgedAttempt
+}
+
+func (r *hedgingReader) startAttempt(hedge bool, size int, results chan<- *hedgedAttempt) *hedgedAttempt {
+	ctx, cancel := context.WithCancel(r.ctx)
+	a := &hedgedAttempt{
+		cancel: cancel,
+		hedge:  hedge,
+	}
+	go func() {
+		a.reader = r.ba.blobAccess.Get(ctx, r.instance, r.digest)
+		buf := make([]byte, size)
+		n, err := a.reader.Read(buf)
+		a.data, a.err = buf[:n], err
+		results <- a
+	}()
+	return a
+}
+
+func (r *hedgingReader) selectWinner(size int) *hedgedAttempt {
+	results := make(chan *hedgedAttempt, 2)
+	start := time.Now()
+	attempts := []*hedgedAttempt{r.startAttempt(false, size, results)}
+	outstanding := 1
+	timer := time.NewTimer(r.ba.getDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			hedgingBlobAccessHedgesSentTotal.WithLabelValues(r.ba.name).Inc()
+			attempts = append(attempts, r.startAttempt(true, size, results))
+			outstanding++
+		case a := <-results:
+			outstanding--
+			if !a.succeeded() && outstanding > 0 {
+				// Give the other request a chance to succeed.
+				a.reader.Close()
+				a.cancel()
+				continue
+			}
+
+			// The latency is measured from the start of the first
+			// request. If the second request won, it is a lower
+			// bound of the latency of the first request. Failures
+			// are not recorded, as they may be returned far more
+			// quickly than data (e.g., NOT_FOUND).
+			if a.succeeded() {
+				r.ba.recordLatency(time.Since(start))
+				if a.hedge {
+					hedgingBlobAccessHedgesWonTotal.WithLabelValues(r.ba.name).Inc()
+				}
+			}
+
+			// Cancel the request that lost.
+			if outstanding > 0 {
+				for _, l := range attempts {
+					if l != a {
+						l.cancel()
+					}
+				}
+				go func() {
+					(<-results).reader.Close()
+				}()
+			}
+			return a
+		}
+	}
+}
+
+func (r *hedgingReader) Read(p []byte) (int, error) {
+	if r.winner == nil {
+		size := len(p)
+		if size < readChunkSize {
+			size = readChunkSize
+		}
+		r.winner = r.selectWinner(size)
+	}
+	if len(r.winner.data) > 0 {
+		n := copy(p, r.winner.data)
+		r.winner.data = r.winner.data[n:]
+		return n, nil
+	}
+	if r.winner.err != nil {
+		return 0, r.winner.err
+	}
+	return r.winner.reader.Read(p)
+}
+
+func (r *hedgingReader) Close() error {
+	if r.winner == nil {
+		return nil
+	}
+	err := r.winner.reader.Close()
+	r.winner.cancel()
+	return err
+}
+
+func (ba *hedgingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	return &hedgingReader{
+		ba:       ba,
+		ctx:      ctx,
+		instance: instance,
+		digest:   digest,
+	}
+}
+
+func (ba *hedgingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	return ba.blobAccess.Put(ctx, instance, digest, r)
+}
+
+func (ba *hedgingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return ba.blobAccess.Delete(ctx, instance, digest)
+}
+
+func (ba *hedgingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	return ba.blobAccess.FindMissing(ctx, instance, digests)
+}
@@ -0,0 +1,266 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hedgedReader is returned by hedgedBlobAccess. Its first read blocks
+// until the test provides a result or the request is cancelled.
+type hedgedReader struct {
+	ctx     context.Context
+	data    []byte
+	started bool
+	result  chan error
+	closed  chan struct{}
+}
+
+func (r *hedgedReader) Read(p []byte) (int, error) {
+	if !r.started {
+		select {
+		case err := <-r.result:
+			if err != nil {
+				return 0, err
+			}
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+		r.started = true
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *hedgedReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+// hedgedBlobAccess is a backend that returns the provided data, one
+// entry for every call to Get(). Readers are handed to the test, so
+// that it can control when and how their first read completes.
+type hedgedBlobAccess struct {
+	BlobAccess
+
+	lock    sync.Mutex
+	data    []string
+	readers chan *hedgedReader
+}
+
+func newHedgedBlobAccess(data ...string) *hedgedBlobAccess {
+	return &hedgedBlobAccess{
+		data:    data,
+		readers: make(chan *hedgedReader, len(data)),
+	}
+}
+
+func (ba *hedgedBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	ba.lock.Lock()
+	data := ba.data[0]
+	ba.data = ba.data[1:]
+	ba.lock.Unlock()
+
+	r := &hedgedReader{
+		ctx:    ctx,
+		data:   []byte(data),
+		result: make(chan error, 1),
+		closed: make(chan struct{}),
+	}
+	ba.readers <- r
+	return r
+}
+
+func expectHedgedReaderClosed(t *testing.T, r *hedgedReader) {
+	select {
+	case <-r.closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Reader of the losing request was not closed")
+	}
+	if r.ctx.Err() != context.Canceled {
+		t.Fatalf("Expected losing request to be cancelled, got %v", r.ctx.Err())
+	}
+}
+
+func readHedgedBlob(ba BlobAccess, done chan<- struct{}, data *[]byte, err *error) {
+	go func() {
+		r := ba.Get(context.Background(), "", &remoteexecution.Digest{})
+		*data, *err = ioutil.ReadAll(r)
+		r.Close()
+		close(done)
+	}()
+}
+
+func TestHedgingBlobAccessFirstWins(t *testing.T) {
+	backend := newHedgedBlobAccess("first")
+	ba := NewHedgingBlobAccess(backend, "test", time.Hour, 0)
+
+	done := make(chan struct{})
+	var data []byte
+	var err error
+	readHedgedBlob(ba, done, &data, &err)
+	first := <-backend.readers
+	first.result <- nil
+	<-done
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if string(data) != "first" {
+		t.Fatalf("Expected data %#v, got %#v", "first", string(data))
+	}
+	if len(backend.readers) != 0 || len(backend.data) != 0 {
+		t.Fatal("Unexpected second request")
+	}
+}
+
+func TestHedgingBlobAccessHedgeWins(t *testing.T) {
+	backend := newHedgedBlobAccess("first", "hedge")
+	ba := NewHedgingBlobAccess(backend, "test", time.Millisecond, 0)
+
+	done := make(chan struct{})
+	var data []byte
+	var err error
+	readHedgedBlob(ba, done, &data, &err)
+	first := <-backend.readers
+	hedge := <-backend.readers
+	hedge.result <- nil
+	<-done
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if string(data) != "hedge" {
+		t.Fatalf("Expected data %#v, got %#v", "hedge", string(data))
+	}
+
+	// The first request lost, meaning it should be cancelled and
+	// its reader should be closed.
+	expectHedgedReaderClosed(t, first)
+}
+
+func TestHedgingBlobAccessFirstWinsAfterHedge(t *testing.T) {
+	backend := newHedgedBlobAccess("first", "hedge")
+	ba := NewHedgingBlobAccess(backend, "test", time.Millisecond, 0)
+
+	done := make(chan struct{})
+	var data []byte
+	var err error
+	readHedgedBlob(ba, done, &data, &err)
+	first := <-backend.readers
+	hedge := <-backend.readers
+	first.result <- nil
+	<-done
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if string(data) != "first" {
+		t.Fatalf("Expected data %#v, got %#v", "first", string(data))
+	}
+	expectHedgedReaderClosed(t, hedge)
+}
+
+func TestHedgingBlobAccessFirstFailsBeforeHedge(t *testing.T) {
+	backend := newHedgedBlobAccess("first")
+	ba := NewHedgingBlobAccess(backend, "test", time.Hour, 0)
+
+	// Failures returned before the delay are not hidden by sending
+	// a second request.
+	done := make(chan struct{})
+	var err error
+	readHedgedBlob(ba, done, new([]byte), &err)
+	first := <-backend.readers
+	first.result <- status.Error(codes.Unavailable, "Server offline")
+	<-done
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Fatalf("Expected code %s, got %s: %v", codes.Unavailable, code, err)
+	}
+	if len(backend.readers) != 0 || len(backend.data) != 0 {
+		t.Fatal("Unexpected second request")
+	}
+}
+
+func TestHedgingBlobAccessFirstFailsAfterHedge(t *testing.T) {
+	t.Run("HedgeSucceeds", func(t *testing.T) {
+		backend := newHedgedBlobAccess("first", "hedge")
+		ba := NewHedgingBlobAccess(backend, "test", time.Millisecond, 0)
+
+		// The failure of the first request should be ignored,
+		// as the second request may still succeed.
+		done := make(chan struct{})
+		var data []byte
+		var err error
+		readHedgedBlob(ba, done, &data, &err)
+		first := <-backend.readers
+		hedge := <-backend.readers
+		first.result <- status.Error(codes.Unavailable, "Server offline")
+		<-first.closed
+		hedge.result <- nil
+		<-done
+		if err != nil {
+			t.Fatal("Get failed: ", err)
+		}
+		if string(data) != "hedge" {
+			t.Fatalf("Expected data %#v, got %#v", "hedge", string(data))
+		}
+	})
+
+	t.Run("HedgeFails", func(t *testing.T) {
+		backend := newHedgedBlobAccess("first", "hedge")
+		ba := NewHedgingBlobAccess(backend, "test", time.Millisecond, 0)
+
+		// If both requests fail, the error of the last one
+		// should be returned.
+		done := make(chan struct{})
+		var err error
+		readHedgedBlob(ba, done, new([]byte), &err)
+		first := <-backend.readers
+		hedge := <-backend.readers
+		first.result <- status.Error(codes.Unavailable, "Server offline")
+		<-first.closed
+		hedge.result <- status.Error(codes.NotFound, "Blob not found")
+		<-done
+		if code := status.Code(err); code != codes.NotFound {
+			t.Fatalf("Expected code %s, got %s: %v", codes.NotFound, code, err)
+		}
+	})
+}
+
+func TestHedgingBlobAccessLatencySamples(t *testing.T) {
+	backend := newHedgedBlobAccess("", "first")
+	ba := NewHedgingBlobAccess(backend, "test", time.Hour, 0.5).(*hedgingBlobAccess)
+
+	// Failures may be returned far more quickly than data. They
+	// should not be used to compute the delay.
+	done := make(chan struct{})
+	var err error
+	readHedgedBlob(ba, done, new([]byte), &err)
+	(<-backend.readers).result <- status.Error(codes.NotFound, "Blob not found")
+	<-done
+	if code := status.Code(err); code != codes.NotFound {
+		t.Fatalf("Expected code %s, got %s: %v", codes.NotFound, code, err)
+	}
+	if len(ba.samples) != 0 {
+		t.Fatalf("Expected no latency samples, got %d", len(ba.samples))
+	}
+
+	done = make(chan struct{})
+	readHedgedBlob(ba, done, new([]byte), &err)
+	(<-backend.readers).result <- nil
+	<-done
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if len(ba.samples) != 1 {
+		t.Fatalf("Expected 1 latency sample, got %d", len(ba.samples))
+	}
+}
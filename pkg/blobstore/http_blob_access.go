@@ -0,0 +1,177 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// convertHTTPStatus converts the status code of an HTTP response to a
+// gRPC error.
+func convertHTTPStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	var code codes.Code
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		code = codes.Unimplemented
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		code = codes.ResourceExhausted
+	case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		code = codes.Unavailable
+	default:
+		if resp.StatusCode >= 500 {
+			code = codes.Internal
+		} else {
+			code = codes.Unknown
+		}
+	}
+	return status.Errorf(code, "HTTP server returned status %#v", resp.Status)
+}
+
+// convertHTTPError converts an error returned by the HTTP client to a
+// gRPC error. Errors caused by the context being cancelled are
+// returned as is, so that they are not mistaken for failures of the
+// server.
+func convertHTTPError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return status.Errorf(codes.Unavailable, "HTTP request failed: %s", err)
+}
+
+type httpBlobAccess struct {
+	client                 *http.Client
+	address                string
+	prefix                 string
+	authorization          string
+	findMissingConcurrency int
+}
+
+// NewHTTPBlobAccess creates a BlobAccess that uses the HTTP caching
+// protocol that is supported by Bazel, e.g., as implemented by nginx or
+// bazel-remote. Blobs are stored at ${address}/${prefix}/${hash}, where
+// prefix is either "cas" or "ac". As the protocol has no notion of
+// instance names, blobs are shared by all instances.
+//
+// The authorization string is provided to the server in the
+// Authorization header of every request, if not empty. FindMissing()
+// issues up to findMissingConcurrency HEAD requests concurrently.
+func NewHTTPBlobAccess(client *http.Client, address string, prefix string, authorization string, findMissingConcurrency int) BlobAccess {
+	return &httpBlobAccess{
+		client:                 client,
+		address:                address,
+		prefix:                 prefix,
+		authorization:          authorization,
+		findMissingConcurrency: findMissingConcurrency,
+	}
+}
+
+func (ba *httpBlobAccess) newRequest(ctx context.Context, method string, digest *remoteexecution.Digest, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, ba.address+"/"+ba.prefix+"/"+digest.Hash, body)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Failed to create HTTP request: %s", err)
+	}
+	if ba.authorization != "" {
+		req.Header.Set("Authorization", ba.authorization)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// do performs an HTTP request for which no response body is expected.
+func (ba *httpBlobAccess) do(req *http.Request) error {
+	resp, err := ba.client.Do(req)
+	if err != nil {
+		return convertHTTPError(req.Context(), err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return convertHTTPStatus(resp)
+}
+
+func (ba *httpBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	req, err := ba.newRequest(ctx, http.MethodGet, digest, nil)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+	resp, err := ba.client.Do(req)
+	if err != nil {
+		return &errorReader{err: convertHTTPError(ctx, err)}
+	}
+	if err := convertHTTPStatus(resp); err != nil {
+		resp.Body.Close()
+		return &errorReader{err: err}
+	}
+	return resp.Body
+}
+
+func (ba *httpBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	req, err := ba.newRequest(ctx, http.MethodPut, digest, r)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	// Many caches reject uploads using chunked encoding. The sizes
+	// of objects in the Content Addressable Storage are known up
+	// front, as they are not compressed or encrypted. Action
+	// results are sent using chunked encoding.
+	if ba.prefix == "cas" {
+		req.ContentLength = digest.SizeBytes
+		if digest.SizeBytes == 0 {
+			// Empty bodies are only sent without chunked
+			// encoding if they are http.NoBody.
+			r.Close()
+			req.Body = http.NoBody
+		}
+	}
+	return ba.do(req)
+}
+
+func (ba *httpBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	req, err := ba.newRequest(ctx, http.MethodDelete, digest, nil)
+	if err != nil {
+		return err
+	}
+	return ba.do(req)
+}
+
+func (ba *httpBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	present := make([]bool, len(digests))
+	if err := forEachConcurrently(ctx, ba.findMissingConcurrency, len(digests), func(ctx context.Context, i int) error {
+		req, err := ba.newRequest(ctx, http.MethodHead, digests[i], nil)
+		if err != nil {
+			return err
+		}
+		err = ba.do(req)
+		if err == nil {
+			present[i] = true
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var missing []*remoteexecution.Digest
+	for i, digest := range digests {
+		if !present[i] {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,192 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newFakeHTTPCache creates an HTTP server that stores objects in
+// memory, only permitting requests that carry the provided
+// Authorization header. Like many WebDAV servers, it rejects uploads
+// of objects in the Content Addressable Storage that do not provide a
+// Content-Length.
+func newFakeHTTPCache(authorization string) *httptest.Server {
+	var lock sync.Mutex
+	objects := map[string][]byte{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case http.MethodPut:
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil || (strings.HasPrefix(r.URL.Path, "/cas/") && r.ContentLength != int64(len(data))) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = data
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func TestHTTPBlobAccess(t *testing.T) {
+	server := newFakeHTTPCache("Bearer secret")
+	defer server.Close()
+	ba := NewHTTPBlobAccess(http.DefaultClient, server.URL, "cas", "Bearer secret", 2)
+	ctx := context.Background()
+
+	present := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	absent := &remoteexecution.Digest{Hash: "5d41402abc4b2a76b9719d911017c592", SizeBytes: 5}
+	empty := &remoteexecution.Digest{Hash: "d41d8cd98f00b204e9800998ecf8427e", SizeBytes: 0}
+	if err := ba.Put(ctx, "default", present, ioutil.NopCloser(bytes.NewBufferString("Hello"))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := ba.Put(ctx, "default", empty, ioutil.NopCloser(bytes.NewBuffer(nil))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	// The size of the data must match the size in the digest, as
+	// it is provided to the server as the Content-Length.
+	if err := ba.Put(ctx, "default", absent, ioutil.NopCloser(bytes.NewBufferString("Hello world"))); err == nil {
+		t.Fatal("Put of blob with mismatching size succeeded")
+	}
+
+	for _, test := range []struct {
+		name   string
+		digest *remoteexecution.Digest
+		data   string
+		code   codes.Code
+	}{
+		{"Present", present, "Hello", codes.OK},
+		{"Empty", empty, "", codes.OK},
+		{"Absent", absent, "", codes.NotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := ioutil.ReadAll(ba.Get(ctx, "default", test.digest))
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("Expected code %s, got %s: %v", test.code, code, err)
+			}
+			if err == nil && string(data) != test.data {
+				t.Fatalf("Expected data %#v, got %#v", test.data, string(data))
+			}
+		})
+	}
+
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{present, absent, empty})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 || missing[0] != absent {
+		t.Fatalf("Expected only %v to be missing, got %v", absent, missing)
+	}
+
+	if err := ba.Delete(ctx, "default", present); err != nil {
+		t.Fatal("Delete failed: ", err)
+	}
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "default", present)); status.Code(err) != codes.NotFound {
+		t.Fatal("Expected deleted blob to be absent, got ", err)
+	}
+}
+
+func TestHTTPBlobAccessUnauthenticated(t *testing.T) {
+	server := newFakeHTTPCache("Bearer secret")
+	defer server.Close()
+	ctx := context.Background()
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+
+	for _, test := range []struct {
+		name          string
+		authorization string
+	}{
+		{"Missing", ""},
+		{"Incorrect", "Bearer wrong"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ba := NewHTTPBlobAccess(http.DefaultClient, server.URL, "cas", test.authorization, 2)
+			if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.Unauthenticated {
+				t.Fatal("Expected Get to fail with Unauthenticated, got ", err)
+			}
+			if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewBufferString("Hello"))); status.Code(err) != codes.Unauthenticated {
+				t.Fatal("Expected Put to fail with Unauthenticated, got ", err)
+			}
+			if _, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest}); status.Code(err) != codes.Unauthenticated {
+				t.Fatal("Expected FindMissing to fail with Unauthenticated, got ", err)
+			}
+		})
+	}
+}
+
+func TestHTTPBlobAccessHTTPCacheServer(t *testing.T) {
+	// HTTPBlobAccess must be able to use bbb_frontend's own
+	// implementation of the HTTP caching protocol as storage.
+	server := newTestHTTPCacheServer(true)
+	defer server.Close()
+	ctx := context.Background()
+
+	contentAddressableStorage := NewHTTPBlobAccess(http.DefaultClient, server.URL, "cas", "", 2)
+	for _, test := range []struct {
+		name string
+		data string
+	}{
+		{"Empty", ""},
+		{"Small", "Hello"},
+		{"Large", strings.Repeat("Hello", 100000)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			digest := util.SHA256DigestFunction.DigestFromData([]byte(test.data))
+			if err := contentAddressableStorage.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewBufferString(test.data))); err != nil {
+				t.Fatal("Put failed: ", err)
+			}
+			data, err := ioutil.ReadAll(contentAddressableStorage.Get(ctx, "default", digest))
+			if err != nil {
+				t.Fatal("Get failed: ", err)
+			}
+			if string(data) != test.data {
+				t.Fatalf("Expected %d bytes of data, got %d different bytes", len(test.data), len(data))
+			}
+		})
+	}
+
+	actionCache := NewHTTPBlobAccess(http.DefaultClient, server.URL, "ac", "", 2)
+	actionResult, err := proto.Marshal(&remoteexecution.ActionResult{ExitCode: 42})
+	if err != nil {
+		t.Fatal("Marshal failed: ", err)
+	}
+	actionDigest := util.SHA256DigestFunction.DigestFromData([]byte("action"))
+	if err := actionCache.Put(ctx, "default", actionDigest, ioutil.NopCloser(bytes.NewReader(actionResult))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	data, err := ioutil.ReadAll(actionCache.Get(ctx, "default", actionDigest))
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if !bytes.Equal(data, actionResult) {
+		t.Fatalf("Expected action result %#v, got %#v", actionResult, data)
+	}
+}
@@ -0,0 +1,272 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// httpCacheServerMaxActionResultSizeBytes is the maximum size
+	// of action results that may be uploaded.
+	httpCacheServerMaxActionResultSizeBytes = 16 << 20
+)
+
+// parseHTTPCachePath parses URL paths in one of the following two
+// forms:
+//
+// - /${type}/${hash}
+// - /${instance}/${type}/${hash}
+//
+// In the process, the instance, type (either "ac" or "cas") and hash
+// are extracted.
+func parseHTTPCachePath(path string) (string, string, string, bool) {
+	fields := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	l := len(fields)
+	if l < 2 || (fields[l-2] != "ac" && fields[l-2] != "cas") {
+		return "", "", "", false
+	}
+	return strings.Join(fields[:l-2], "/"), fields[l-2], fields[l-1], true
+}
+
+// convertErrorToHTTPStatus converts a gRPC error to the status code of
+// an HTTP response.
+func convertErrorToHTTPStatus(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type httpCacheServer struct {
+	contentAddressableStorage BlobAccess
+	actionCache               BlobAccess
+	digestFunctionSelector    util.DigestFunctionSelector
+	allowActionCacheUpdates   bool
+}
+
+// NewHTTPCacheServer creates an HTTP handler that implements Bazel's
+// HTTP caching protocol on top of the Content Addressable Storage and
+// the Action Cache. Action results are stored as serialized
+// ActionResult messages.
+//
+// As the protocol only identifies objects by hash, while storage
+// backends identify them by hash and size, the sizes of objects in the
+// Content Addressable Storage that are uploaded through this handler
+// are recorded in the Action Cache, so that they may be downloaded
+// later on. Objects uploaded by workers or clients using gRPC can thus
+// not be downloaded through this handler. Similarly, action results are
+// stored with their size set to zero, meaning they are not shared with
+// clients using gRPC.
+//
+// Like the ActionCache service, action results may only be stored if
+// allowActionCacheUpdates is set.
+func NewHTTPCacheServer(contentAddressableStorage BlobAccess, actionCache BlobAccess, digestFunctionSelector util.DigestFunctionSelector, allowActionCacheUpdates bool) http.Handler {
+	return &httpCacheServer{
+		contentAddressableStorage: contentAddressableStorage,
+		actionCache:               actionCache,
+		digestFunctionSelector:    digestFunctionSelector,
+		allowActionCacheUpdates:   allowActionCacheUpdates,
+	}
+}
+
+// getSizeIndexDigest returns the digest of the Action Cache entry that
+// stores the size of an object in the Content Addressable Storage. Its
+// hash is derived from the object's hash, so that it cannot collide
+// with any actual action.
+func (s *httpCacheServer) getSizeIndexDigest(digestFunction *util.DigestFunction, hash string) *remoteexecution.Digest {
+	return &remoteexecution.Digest{
+		Hash:      digestFunction.DigestFromData([]byte("http-cache-size-index|" + hash)).Hash,
+		SizeBytes: 8,
+	}
+}
+
+// getContentAddressableStorageDigest looks up the size of an object in
+// the Content Addressable Storage, returning its full digest.
+func (s *httpCacheServer) getContentAddressableStorageDigest(r *http.Request, instance string, digestFunction *util.DigestFunction, hash string) (*remoteexecution.Digest, error) {
+	reader := s.actionCache.Get(r.Context(), instance, s.getSizeIndexDigest(digestFunction, hash))
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 8 {
+		return nil, status.Errorf(codes.Internal, "Size index entry for object %s has length %d, while 8 was expected", hash, len(data))
+	}
+	return &remoteexecution.Digest{
+		Hash:      hash,
+		SizeBytes: int64(binary.LittleEndian.Uint64(data)),
+	}, nil
+}
+
+func (s *httpCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	instance, objectType, hash, ok := parseHTTPCachePath(r.URL.Path)
+	if !ok {
+		http.Error(w, "Unsupported path naming scheme", http.StatusNotFound)
+		return
+	}
+	digestFunction := s.digestFunctionSelector(instance)
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != digestFunction.Size() {
+		http.Error(w, "Invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	// Expose the address of the client in the same way as gRPC
+	// does, so that per-client quotas apply.
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		r = r.WithContext(peer.NewContext(r.Context(), &peer.Peer{Addr: addr}))
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if objectType == "ac" {
+			err = s.getActionResult(w, r, instance, hash)
+		} else {
+			err = s.getObject(w, r, instance, digestFunction, hash)
+		}
+	case http.MethodPut:
+		if objectType == "ac" {
+			err = s.putActionResult(r, instance, hash)
+		} else {
+			err = s.putObject(r, instance, digestFunction, hash)
+		}
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		if status.Code(err) != codes.NotFound {
+			log.Printf("Failed to process HTTP cache request %s %s: %s", r.Method, r.URL.Path, err)
+		}
+		http.Error(w, status.Convert(err).Message(), convertErrorToHTTPStatus(err))
+	}
+}
+
+func (s *httpCacheServer) getActionResult(w http.ResponseWriter, r *http.Request, instance string, hash string) error {
+	reader := s.actionCache.Get(r.Context(), instance, &remoteexecution.Digest{Hash: hash})
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+	return nil
+}
+
+func (s *httpCacheServer) getObject(w http.ResponseWriter, r *http.Request, instance string, digestFunction *util.DigestFunction, hash string) error {
+	digest, err := s.getContentAddressableStorageDigest(r, instance, digestFunction, hash)
+	if err != nil {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		missing, err := s.contentAddressableStorage.FindMissing(r.Context(), instance, []*remoteexecution.Digest{digest})
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return status.Errorf(codes.NotFound, "Object not found")
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(digest.SizeBytes, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	reader := s.contentAddressableStorage.Get(r.Context(), instance, digest)
+	defer reader.Close()
+
+	// Read the first chunk before sending the response header, so
+	// that absent objects yield a proper status code.
+	var readBuf [readChunkSize]byte
+	n, err := io.ReadFull(reader, readBuf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(digest.SizeBytes, 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(readBuf[:n]); err != nil {
+		return nil
+	}
+	if n == len(readBuf) {
+		if _, err := io.Copy(w, reader); err != nil {
+			// The response header has already been sent, so
+			// the only option is to abort the response.
+			log.Printf("Failed to send object %s: %s", hash, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return nil
+}
+
+func (s *httpCacheServer) putActionResult(r *http.Request, instance string, hash string) error {
+	if !s.allowActionCacheUpdates {
+		return status.Error(codes.PermissionDenied, "This server does not permit storing action results")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, httpCacheServerMaxActionResultSizeBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > httpCacheServerMaxActionResultSizeBytes {
+		return status.Errorf(codes.InvalidArgument, "Action result exceeds %d bytes in size", httpCacheServerMaxActionResultSizeBytes)
+	}
+	var actionResult remoteexecution.ActionResult
+	if err := proto.Unmarshal(data, &actionResult); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Failed to unmarshal action result: %s", err)
+	}
+	return s.actionCache.Put(r.Context(), instance, &remoteexecution.Digest{Hash: hash}, ioutil.NopCloser(bytes.NewReader(data)))
+}
+
+func (s *httpCacheServer) putObject(r *http.Request, instance string, digestFunction *util.DigestFunction, hash string) error {
+	if r.ContentLength < 0 {
+		return status.Errorf(codes.InvalidArgument, "Uploads of objects must provide a Content-Length")
+	}
+	digest := &remoteexecution.Digest{
+		Hash:      hash,
+		SizeBytes: r.ContentLength,
+	}
+	if err := s.contentAddressableStorage.Put(r.Context(), instance, digest, r.Body); err != nil {
+		if status.Code(err) == codes.DataLoss {
+			// The data provided by the client does not
+			// match the hash in the URL.
+			return status.Error(codes.InvalidArgument, status.Convert(err).Message())
+		}
+		return err
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(digest.SizeBytes))
+	return s.actionCache.Put(r.Context(), instance, s.getSizeIndexDigest(digestFunction, hash), ioutil.NopCloser(bytes.NewReader(size[:])))
+}
@@ -0,0 +1,152 @@
+package blobstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+func newTestHTTPCacheServer(allowActionCacheUpdates bool) *httptest.Server {
+	digestFunctionSelector := util.NewDigestFunctionSelector(
+		util.SHA256DigestFunction,
+		map[string]*util.DigestFunction{"legacy": util.SHA1DigestFunction})
+	return httptest.NewServer(NewHTTPCacheServer(
+		NewMerkleBlobAccess(
+			NewMemoryBlobAccess(util.KeyDigestWithInstance, 1<<20),
+			digestFunctionSelector,
+			true),
+		NewMemoryBlobAccess(util.KeyDigestWithInstance, 1<<20),
+		digestFunctionSelector,
+		allowActionCacheUpdates))
+}
+
+// doHTTPCacheRequest performs a request against an HTTP cache,
+// returning the status code and the body of the response.
+func doHTTPCacheRequest(t *testing.T, method string, url string, body io.Reader, contentLength int64) (int, string) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal("NewRequest failed: ", err)
+	}
+	req.ContentLength = contentLength
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Request failed: ", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("Failed to read response body: ", err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestHTTPCacheServer(t *testing.T) {
+	server := newTestHTTPCacheServer(true)
+	defer server.Close()
+
+	object := "Hello world"
+	objectHash := util.SHA256DigestFunction.DigestFromData([]byte(object)).Hash
+	legacyObjectHash := util.SHA1DigestFunction.DigestFromData([]byte(object)).Hash
+	actionResult, err := proto.Marshal(&remoteexecution.ActionResult{ExitCode: 42})
+	if err != nil {
+		t.Fatal("Marshal failed: ", err)
+	}
+	actionResultHash := util.SHA256DigestFunction.DigestFromData([]byte("action")).Hash
+
+	// Store objects and action results, both without an instance
+	// name and with one that uses a different digest function.
+	for _, test := range []struct {
+		name string
+		path string
+		body string
+		code int
+	}{
+		{"CAS", "/cas/" + objectHash, object, http.StatusOK},
+		{"CASInstance", "/legacy/cas/" + legacyObjectHash, object, http.StatusOK},
+		{"AC", "/ac/" + actionResultHash, string(actionResult), http.StatusOK},
+		{"ACInstance", "/some/instance/ac/" + actionResultHash, string(actionResult), http.StatusOK},
+		{"HashMismatch", "/cas/" + actionResultHash, object, http.StatusBadRequest},
+		{"InvalidHash", "/cas/" + legacyObjectHash, object, http.StatusBadRequest},
+		{"MalformedActionResult", "/ac/" + actionResultHash, "\xff", http.StatusBadRequest},
+		{"UnknownType", "/foo/" + objectHash, object, http.StatusNotFound},
+	} {
+		t.Run("Put"+test.name, func(t *testing.T) {
+			if code, body := doHTTPCacheRequest(t, http.MethodPut, server.URL+test.path, strings.NewReader(test.body), int64(len(test.body))); code != test.code {
+				t.Fatalf("Expected status %d, got %d: %s", test.code, code, body)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name string
+		path string
+		code int
+		body string
+	}{
+		{"CAS", "/cas/" + objectHash, http.StatusOK, object},
+		{"CASInstance", "/legacy/cas/" + legacyObjectHash, http.StatusOK, object},
+		{"CASOtherInstance", "/other/cas/" + objectHash, http.StatusNotFound, ""},
+		{"CASMissing", "/cas/" + actionResultHash, http.StatusNotFound, ""},
+		{"AC", "/ac/" + actionResultHash, http.StatusOK, string(actionResult)},
+		{"ACInstance", "/some/instance/ac/" + actionResultHash, http.StatusOK, string(actionResult)},
+		{"ACOtherInstance", "/other/ac/" + actionResultHash, http.StatusNotFound, ""},
+		{"ACMissing", "/ac/" + objectHash, http.StatusNotFound, ""},
+	} {
+		t.Run("Get"+test.name, func(t *testing.T) {
+			code, body := doHTTPCacheRequest(t, http.MethodGet, server.URL+test.path, nil, 0)
+			if code != test.code {
+				t.Fatalf("Expected status %d, got %d: %s", test.code, code, body)
+			}
+			if code == http.StatusOK && body != test.body {
+				t.Fatalf("Expected body %#v, got %#v", test.body, body)
+			}
+		})
+		t.Run("Head"+test.name, func(t *testing.T) {
+			if code, body := doHTTPCacheRequest(t, http.MethodHead, server.URL+test.path, nil, 0); code != test.code {
+				t.Fatalf("Expected status %d, got %d: %s", test.code, code, body)
+			}
+		})
+	}
+}
+
+func TestHTTPCacheServerMissingContentLength(t *testing.T) {
+	server := newTestHTTPCacheServer(true)
+	defer server.Close()
+
+	// Objects uploaded using chunked transfer encoding cannot be
+	// stored, as their size is needed to compute their digest.
+	object := "Hello world"
+	url := server.URL + "/cas/" + util.SHA256DigestFunction.DigestFromData([]byte(object)).Hash
+	if code, body := doHTTPCacheRequest(t, http.MethodPut, url, ioutil.NopCloser(strings.NewReader(object)), -1); code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusBadRequest, code, body)
+	}
+	if code, body := doHTTPCacheRequest(t, http.MethodGet, url, nil, 0); code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNotFound, code, body)
+	}
+}
+
+func TestHTTPCacheServerActionCacheUpdatesDisallowed(t *testing.T) {
+	server := newTestHTTPCacheServer(false)
+	defer server.Close()
+
+	actionResult, err := proto.Marshal(&remoteexecution.ActionResult{ExitCode: 42})
+	if err != nil {
+		t.Fatal("Marshal failed: ", err)
+	}
+	url := server.URL + "/ac/" + util.SHA256DigestFunction.DigestFromData([]byte("action")).Hash
+	if code, body := doHTTPCacheRequest(t, http.MethodPut, url, bytes.NewReader(actionResult), int64(len(actionResult))); code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusForbidden, code, body)
+	}
+	if code, body := doHTTPCacheRequest(t, http.MethodGet, url, nil, 0); code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNotFound, code, body)
+	}
+}
@@ -0,0 +1,281 @@
+package blobstore
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	localBlobAccessTempDirectory = "tmp"
+)
+
+type localBlobEntry struct {
+	fileName  string
+	sizeBytes int64
+}
+
+type localBlobAccess struct {
+	path         string
+	blobKeyer    util.DigestKeyer
+	maxSizeBytes int64
+
+	lock           sync.Mutex
+	blobs          map[string]*list.Element
+	blobsLRU       *list.List
+	totalSizeBytes int64
+}
+
+// NewLocalBlobAccess creates a BlobAccess that stores blobs as files
+// in a local directory. Files are placed in subdirectories based on a
+// prefix of their name, to keep directories small. The total size of
+// all blobs is bounded by maxSizeBytes, by discarding the least
+// recently used blobs.
+//
+// Existing contents of the directory are retained. As access times are
+// not persisted, blobs are initially ordered by modification time.
+func NewLocalBlobAccess(path string, blobKeyer util.DigestKeyer, maxSizeBytes int64) (BlobAccess, error) {
+	ba := &localBlobAccess{
+		path:         path,
+		blobKeyer:    blobKeyer,
+		maxSizeBytes: maxSizeBytes,
+
+		blobs:    map[string]*list.Element{},
+		blobsLRU: list.New(),
+	}
+	if err := ba.scan(); err != nil {
+		return nil, err
+	}
+	return ba, nil
+}
+
+// scan populates the bookkeeping with blobs stored during previous
+// runs. Partially written files are discarded.
+func (ba *localBlobAccess) scan() error {
+	tempPath := path.Join(ba.path, localBlobAccessTempDirectory)
+	if err := os.RemoveAll(tempPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tempPath, 0700); err != nil {
+		return err
+	}
+
+	shards, err := ioutil.ReadDir(ba.path)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	for _, shard := range shards {
+		if !shard.IsDir() || shard.Name() == localBlobAccessTempDirectory {
+			continue
+		}
+		shardFiles, err := ioutil.ReadDir(path.Join(ba.path, shard.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range shardFiles {
+			if file.Mode().IsRegular() && len(file.Name()) == 2*sha256.Size && ba.getFilePath(file.Name()) == path.Join(ba.path, shard.Name(), file.Name()) {
+				files = append(files, file)
+			}
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for _, file := range files {
+		ba.blobs[file.Name()] = ba.blobsLRU.PushBack(&localBlobEntry{
+			fileName:  file.Name(),
+			sizeBytes: file.Size(),
+		})
+		ba.totalSizeBytes += file.Size()
+	}
+	return ba.makeSpace(0)
+}
+
+// getFileName converts a key to a file name. Keys are hashed, as they
+// may contain characters that cannot be used in file names.
+func (ba *localBlobAccess) getFileName(instance string, digest *remoteexecution.Digest) (string, error) {
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (ba *localBlobAccess) getFilePath(fileName string) string {
+	return path.Join(ba.path, fileName[:2], fileName)
+}
+
+func (ba *localBlobAccess) removeEntry(element *list.Element) error {
+	entry := ba.blobsLRU.Remove(element).(*localBlobEntry)
+	delete(ba.blobs, entry.fileName)
+	ba.totalSizeBytes -= entry.sizeBytes
+	if err := os.Remove(ba.getFilePath(entry.fileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// makeSpace discards the least recently used blobs until a blob of a
+// given size fits. It must be called with the lock held.
+func (ba *localBlobAccess) makeSpace(sizeBytes int64) error {
+	for ba.blobsLRU.Len() > 0 && ba.totalSizeBytes+sizeBytes > ba.maxSizeBytes {
+		if err := ba.removeEntry(ba.blobsLRU.Back()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ba *localBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	if err := ctx.Err(); err != nil {
+		return &errorReader{err: err}
+	}
+	fileName, err := ba.getFileName(instance, digest)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+
+	ba.lock.Lock()
+	element, ok := ba.blobs[fileName]
+	if ok {
+		ba.blobsLRU.MoveToFront(element)
+	}
+	ba.lock.Unlock()
+	if !ok {
+		return &errorReader{err: status.Errorf(codes.NotFound, "Blob not found")}
+	}
+
+	// The blob may be evicted at any point after releasing the lock.
+	// Files that are already opened remain readable when unlinked.
+	f, err := os.Open(ba.getFilePath(fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &errorReader{err: status.Errorf(codes.NotFound, "Blob not found")}
+		}
+		return &errorReader{err: err}
+	}
+	return f
+}
+
+func (ba *localBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	defer r.Close()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if digest.SizeBytes > ba.maxSizeBytes {
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this storage backend can only hold %d bytes", digest.SizeBytes, ba.maxSizeBytes)
+	}
+	fileName, err := ba.getFileName(instance, digest)
+	if err != nil {
+		return err
+	}
+
+	// Stream the blob into a temporary file, so that partially
+	// written blobs never become visible.
+	f, err := ioutil.TempFile(path.Join(ba.path, localBlobAccessTempDirectory), "blob")
+	if err != nil {
+		return err
+	}
+	sizeBytes, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if element, ok := ba.blobs[fileName]; ok {
+		if err := ba.removeEntry(element); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	if err := ba.makeSpace(sizeBytes); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	filePath := ba.getFilePath(fileName)
+	if err := os.MkdirAll(path.Dir(filePath), 0700); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filePath); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	ba.blobs[fileName] = ba.blobsLRU.PushFront(&localBlobEntry{
+		fileName:  fileName,
+		sizeBytes: sizeBytes,
+	})
+	ba.totalSizeBytes += sizeBytes
+	return nil
+}
+
+func (ba *localBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fileName, err := ba.getFileName(instance, digest)
+	if err != nil {
+		return err
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if element, ok := ba.blobs[fileName]; ok {
+		return ba.removeEntry(element)
+	}
+	return nil
+}
+
+func (ba *localBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var fileNames []string
+	for _, digest := range digests {
+		fileName, err := ba.getFileName(instance, digest)
+		if err != nil {
+			return nil, err
+		}
+		fileNames = append(fileNames, fileName)
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	// Blobs that are present are marked as recently used, as clients
+	// will most likely depend on them being present afterwards.
+	var missing []*remoteexecution.Digest
+	for i, fileName := range fileNames {
+		if element, ok := ba.blobs[fileName]; ok {
+			ba.blobsLRU.MoveToFront(element)
+		} else {
+			missing = append(missing, digests[i])
+		}
+	}
+	return missing, nil
+}
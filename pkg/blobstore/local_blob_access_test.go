@@ -0,0 +1,182 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestLocalBlobAccess(t *testing.T, directory string, maxSizeBytes int64) *localBlobAccess {
+	ba, err := NewLocalBlobAccess(directory, util.KeyDigestWithInstance, maxSizeBytes)
+	if err != nil {
+		t.Fatal("NewLocalBlobAccess failed: ", err)
+	}
+	return ba.(*localBlobAccess)
+}
+
+func getLocalFilePathForTesting(t *testing.T, ba *localBlobAccess, digest *remoteexecution.Digest) string {
+	fileName, err := ba.getFileName("default", digest)
+	if err != nil {
+		t.Fatal("getFileName failed: ", err)
+	}
+	return ba.getFilePath(fileName)
+}
+
+func expectBlobsPresent(t *testing.T, ba BlobAccess, digests []*remoteexecution.Digest, expected []bool) {
+	for i, digest := range digests {
+		_, err := ioutil.ReadAll(ba.Get(context.Background(), "default", digest))
+		if present := err == nil; present != expected[i] {
+			t.Fatalf("Expected presence of blob %d to be %t, got %v", i, expected[i], err)
+		}
+	}
+}
+
+func TestLocalBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	directory, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ba := newTestLocalBlobAccess(t, directory, 1<<20)
+
+	data, digest := putRandomBlob(t, ba, 1000)
+	filePath := getLocalFilePathForTesting(t, ba, digest)
+	if stored, err := ioutil.ReadFile(filePath); err != nil || !bytes.Equal(stored, data) {
+		t.Fatal("Blob was not stored in its file: ", err)
+	}
+	got, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Expected %d bytes of data, got %d different bytes", len(data), len(got))
+	}
+	if ba.totalSizeBytes != 1000 {
+		t.Fatalf("Expected total size 1000, got %d", ba.totalSizeBytes)
+	}
+
+	// Blobs are keyed by instance name.
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "other", digest)); status.Code(err) != codes.NotFound {
+		t.Fatal("Expected Get to fail with NotFound, got ", err)
+	}
+
+	if err := ba.Delete(ctx, "default", digest); err != nil {
+		t.Fatal("Delete failed: ", err)
+	}
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.NotFound {
+		t.Fatal("Expected Get to fail with NotFound, got ", err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatal("Expected file of blob to be removed, got ", err)
+	}
+	if ba.totalSizeBytes != 0 {
+		t.Fatalf("Expected total size 0, got %d", ba.totalSizeBytes)
+	}
+
+	// Blobs that can never fit should be rejected up front.
+	digest = &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 2 << 20}
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(nil))); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("Expected Put to fail with InvalidArgument, got ", err)
+	}
+}
+
+func TestLocalBlobAccessEviction(t *testing.T) {
+	ctx := context.Background()
+	directory, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ba := newTestLocalBlobAccess(t, directory, 300)
+
+	var digests []*remoteexecution.Digest
+	for i := 0; i < 3; i++ {
+		_, digest := putRandomBlob(t, ba, 100)
+		digests = append(digests, digest)
+	}
+
+	// Accessing blobs through Get() and FindMissing() should mark
+	// them as recently used, causing the second blob to be the
+	// least recently used one.
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digests[0])); err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if missing, err := ba.FindMissing(ctx, "default", digests[2:]); err != nil || len(missing) != 0 {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	evictedPath := getLocalFilePathForTesting(t, ba, digests[1])
+	_, digest := putRandomBlob(t, ba, 100)
+	digests = append(digests, digest)
+	expectBlobsPresent(t, ba, digests, []bool{true, false, true, true})
+	if _, err := os.Stat(evictedPath); !os.IsNotExist(err) {
+		t.Fatal("Expected file of evicted blob to be removed, got ", err)
+	}
+
+	// Storing a large blob may evict multiple blobs at once.
+	_, digest = putRandomBlob(t, ba, 250)
+	digests = append(digests, digest)
+	expectBlobsPresent(t, ba, digests, []bool{false, false, false, false, true})
+	if ba.totalSizeBytes != 250 {
+		t.Fatalf("Expected total size 250, got %d", ba.totalSizeBytes)
+	}
+}
+
+func TestLocalBlobAccessRestart(t *testing.T) {
+	directory, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ba := newTestLocalBlobAccess(t, directory, 1000)
+
+	var digests []*remoteexecution.Digest
+	for i := 0; i < 3; i++ {
+		_, digest := putRandomBlob(t, ba, 100)
+		digests = append(digests, digest)
+		// Access times are not persisted. Blobs are initially
+		// ordered by modification time after restarting.
+		modTime := time.Now().Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(getLocalFilePathForTesting(t, ba, digest), modTime, modTime); err != nil {
+			t.Fatal("Chtimes failed: ", err)
+		}
+	}
+
+	// Leftover temporary files and files that are not blobs should
+	// not be picked up.
+	tempFile := path.Join(directory, localBlobAccessTempDirectory, "blob123")
+	if err := ioutil.WriteFile(tempFile, []byte("Partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	strayFile := path.Join(directory, "ab", "README")
+	if err := os.MkdirAll(path.Dir(strayFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(strayFile, []byte("Hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening the directory with a smaller size limit should
+	// discard the oldest blob.
+	ba = newTestLocalBlobAccess(t, directory, 250)
+	expectBlobsPresent(t, ba, digests, []bool{false, true, true})
+	if ba.totalSizeBytes != 200 {
+		t.Fatalf("Expected total size 200, got %d", ba.totalSizeBytes)
+	}
+	if _, err := os.Stat(tempFile); !os.IsNotExist(err) {
+		t.Fatal("Expected temporary file to be removed, got ", err)
+	}
+	if _, err := os.Stat(strayFile); err != nil {
+		t.Fatal("Expected unrelated file to be left alone, got ", err)
+	}
+}
@@ -0,0 +1,156 @@
+package blobstore
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type memoryBlobEntry struct {
+	key  string
+	data []byte
+}
+
+type memoryBlobAccess struct {
+	blobKeyer    util.DigestKeyer
+	maxSizeBytes int64
+
+	lock           sync.Mutex
+	blobs          map[string]*list.Element
+	blobsLRU       *list.List
+	totalSizeBytes int64
+}
+
+// NewMemoryBlobAccess creates a BlobAccess that stores blobs in
+// memory. The total size of all blobs is bounded by maxSizeBytes, by
+// discarding the least recently used blobs.
+func NewMemoryBlobAccess(blobKeyer util.DigestKeyer, maxSizeBytes int64) BlobAccess {
+	return &memoryBlobAccess{
+		blobKeyer:    blobKeyer,
+		maxSizeBytes: maxSizeBytes,
+
+		blobs:    map[string]*list.Element{},
+		blobsLRU: list.New(),
+	}
+}
+
+func (ba *memoryBlobAccess) removeEntry(element *list.Element) {
+	entry := ba.blobsLRU.Remove(element).(*memoryBlobEntry)
+	delete(ba.blobs, entry.key)
+	ba.totalSizeBytes -= int64(len(entry.data))
+}
+
+func (ba *memoryBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	if err := ctx.Err(); err != nil {
+		return &errorReader{err: err}
+	}
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	element, ok := ba.blobs[key]
+	if !ok {
+		return &errorReader{err: status.Errorf(codes.NotFound, "Blob not found")}
+	}
+	ba.blobsLRU.MoveToFront(element)
+	// Stored data is never modified, meaning it can be returned
+	// without making a copy.
+	return ioutil.NopCloser(bytes.NewReader(element.Value.(*memoryBlobEntry).data))
+}
+
+func (ba *memoryBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	if err := ctx.Err(); err != nil {
+		r.Close()
+		return err
+	}
+	if digest.SizeBytes > ba.maxSizeBytes {
+		r.Close()
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this storage backend can only hold %d bytes", digest.SizeBytes, ba.maxSizeBytes)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > ba.maxSizeBytes {
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this storage backend can only hold %d bytes", len(data), ba.maxSizeBytes)
+	}
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return err
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if element, ok := ba.blobs[key]; ok {
+		ba.removeEntry(element)
+	}
+	for ba.blobsLRU.Len() > 0 && ba.totalSizeBytes+int64(len(data)) > ba.maxSizeBytes {
+		ba.removeEntry(ba.blobsLRU.Back())
+	}
+	ba.blobs[key] = ba.blobsLRU.PushFront(&memoryBlobEntry{
+		key:  key,
+		data: data,
+	})
+	ba.totalSizeBytes += int64(len(data))
+	return nil
+}
+
+func (ba *memoryBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return err
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if element, ok := ba.blobs[key]; ok {
+		ba.removeEntry(element)
+	}
+	return nil
+}
+
+func (ba *memoryBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, digest := range digests {
+		key, err := ba.blobKeyer(instance, digest)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	var missing []*remoteexecution.Digest
+	for i, key := range keys {
+		if element, ok := ba.blobs[key]; ok {
+			ba.blobsLRU.MoveToFront(element)
+		} else {
+			missing = append(missing, digests[i])
+		}
+	}
+	return missing, nil
+}
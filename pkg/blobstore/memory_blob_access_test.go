@@ -0,0 +1,118 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMemoryBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	ba := NewMemoryBlobAccess(util.KeyDigestWithInstance, 1<<20)
+
+	data, digest := putRandomBlob(t, ba, 1000)
+	got, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Expected %d bytes of data, got %d different bytes", len(data), len(got))
+	}
+
+	// Blobs are keyed by instance name.
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "other", digest)); status.Code(err) != codes.NotFound {
+		t.Fatal("Expected Get to fail with NotFound, got ", err)
+	}
+
+	if err := ba.Delete(ctx, "default", digest); err != nil {
+		t.Fatal("Delete failed: ", err)
+	}
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.NotFound {
+		t.Fatal("Expected Get to fail with NotFound, got ", err)
+	}
+	if totalSizeBytes := ba.(*memoryBlobAccess).totalSizeBytes; totalSizeBytes != 0 {
+		t.Fatalf("Expected total size 0, got %d", totalSizeBytes)
+	}
+}
+
+func TestMemoryBlobAccessTooLarge(t *testing.T) {
+	ctx := context.Background()
+	ba := NewMemoryBlobAccess(util.KeyDigestWithInstance, 100)
+
+	// Blobs that can never fit should be rejected, both based on
+	// their digest and on the amount of data provided.
+	for _, test := range []struct {
+		name      string
+		sizeBytes int64
+		data      []byte
+	}{
+		{"Digest", 101, make([]byte, 100)},
+		{"Data", 100, make([]byte, 101)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: test.sizeBytes}
+			if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(test.data))); status.Code(err) != codes.InvalidArgument {
+				t.Fatal("Expected Put to fail with InvalidArgument, got ", err)
+			}
+		})
+	}
+}
+
+func TestMemoryBlobAccessEviction(t *testing.T) {
+	ctx := context.Background()
+	ba := NewMemoryBlobAccess(util.KeyDigestWithInstance, 300)
+
+	var digests []*remoteexecution.Digest
+	for i := 0; i < 3; i++ {
+		_, digest := putRandomBlob(t, ba, 100)
+		digests = append(digests, digest)
+	}
+
+	// Accessing blobs through Get() and FindMissing() should mark
+	// them as recently used, causing the second blob to be the
+	// least recently used one.
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digests[0])); err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if missing, err := ba.FindMissing(ctx, "default", digests[2:]); err != nil || len(missing) != 0 {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	_, digest := putRandomBlob(t, ba, 100)
+	digests = append(digests, digest)
+	missing, err := ba.FindMissing(ctx, "default", digests)
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 || missing[0] != digests[1] {
+		t.Fatalf("Expected only blob 1 to be evicted, got %v", missing)
+	}
+
+	// Replacing a blob should not count its old size.
+	data := make([]byte, 100)
+	if err := ba.Put(ctx, "default", digests[0], ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if missing, err := ba.FindMissing(ctx, "default", digests); err != nil || len(missing) != 1 {
+		t.Fatalf("Expected only blob 1 to be evicted, got %v: %v", missing, err)
+	}
+
+	// Storing a large blob may evict multiple blobs at once.
+	_, digest = putRandomBlob(t, ba, 250)
+	missing, err = ba.FindMissing(ctx, "default", append(digests, digest))
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != len(digests) {
+		t.Fatalf("Expected all %d small blobs to be evicted, got %d", len(digests), len(missing))
+	}
+	if totalSizeBytes := ba.(*memoryBlobAccess).totalSizeBytes; totalSizeBytes != 250 {
+		t.Fatalf("Expected total size 250, got %d", totalSizeBytes)
+	}
+}
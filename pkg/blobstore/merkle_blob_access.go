@@ -1,70 +1,123 @@
 package blobstore
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"log"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
 
 	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	merkleBlobAccessCorruptedBlobsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "merkle_blob_access_corrupted_blobs_total",
+			Help:      "Total number of blobs whose contents did not match their digest.",
+		},
+		[]string{"operation"})
 )
 
+func init() {
+	prometheus.MustRegister(merkleBlobAccessCorruptedBlobsTotal)
+}
+
 // extractDigest validates the format of fields in a Digest object and returns them.
-func extractDigest(digest *remoteexecution.Digest) ([sha256.Size]byte, uint64, error) {
-	var checksumBytes [sha256.Size]byte
+func extractDigest(digestFunction *util.DigestFunction, digest *remoteexecution.Digest) ([]byte, uint64, error) {
 	checksum, err := hex.DecodeString(digest.Hash)
 	if err != nil {
-		return checksumBytes, 0, err
+		return nil, 0, err
 	}
-	if len(checksum) != sha256.Size {
-		return checksumBytes, 0, fmt.Errorf("Expected checksum to be %d bytes; not %d", sha256.Size, len(checksum))
+	if len(checksum) != digestFunction.Size() {
+		return nil, 0, fmt.Errorf("Expected %s checksum to be %d bytes; not %d", digestFunction.Name(), digestFunction.Size(), len(checksum))
 	}
 	if digest.SizeBytes < 0 {
-		return checksumBytes, 0, fmt.Errorf("Invalid negative size: %d", digest.SizeBytes)
+		return nil, 0, fmt.Errorf("Invalid negative size: %d", digest.SizeBytes)
 	}
-	copy(checksumBytes[:], checksum)
-	return checksumBytes, uint64(digest.SizeBytes), nil
+	return checksum, uint64(digest.SizeBytes), nil
 }
 
 type merkleBlobAccess struct {
-	blobAccess BlobAccess
+	blobAccess             BlobAccess
+	digestFunctionSelector util.DigestFunctionSelector
+	deleteCorruptedBlobs   bool
 }
 
-func NewMerkleBlobAccess(blobAccess BlobAccess) BlobAccess {
+// NewMerkleBlobAccess creates an adapter that validates that blobs read
+// from and written to storage correspond with the digest that is used
+// for identification. The digest function that is used is selected
+// based on the instance name. When deleteCorruptedBlobs is set, blobs that
+// fail validation while being read are removed from the backend, so
+// that clients will upload them once again.
+func NewMerkleBlobAccess(blobAccess BlobAccess, digestFunctionSelector util.DigestFunctionSelector, deleteCorruptedBlobs bool) BlobAccess {
 	return &merkleBlobAccess{
-		blobAccess: blobAccess,
+		blobAccess:             blobAccess,
+		digestFunctionSelector: digestFunctionSelector,
+		deleteCorruptedBlobs:   deleteCorruptedBlobs,
 	}
 }
 
 func (ba *merkleBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
-	checksum, size, err := extractDigest(digest)
+	digestFunction := ba.digestFunctionSelector(instance)
+	checksum, size, err := extractDigest(digestFunction, digest)
 	if err != nil {
 		return &errorReader{err: err}
 	}
 	return &checksumValidatingReader{
-		ReadCloser: ba.blobAccess.Get(ctx, instance, digest),
-		checksum:   checksum,
-		sizeLeft:   size,
+		ReadCloser:       ba.blobAccess.Get(ctx, instance, digest),
+		expectedChecksum: checksum,
+		partialChecksum:  digestFunction.NewHasher(),
+		sizeLeft:         size,
+		invalidator: func() {
+			merkleBlobAccessCorruptedBlobsTotal.WithLabelValues("Get").Inc()
+			if ba.deleteCorruptedBlobs {
+				if err := ba.blobAccess.Delete(ctx, instance, digest); err != nil {
+					log.Printf("Failed to delete corrupted blob %s: %s", digest.Hash, err)
+				}
+			}
+		},
 	}
 }
 
 func (ba *merkleBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
-	checksum, size, err := extractDigest(digest)
+	digestFunction := ba.digestFunctionSelector(instance)
+	checksum, size, err := extractDigest(digestFunction, digest)
 	if err != nil {
 		r.Close()
 		return err
 	}
 	return ba.blobAccess.Put(ctx, instance, digest, &checksumValidatingReader{
-		ReadCloser: r,
-		checksum:   checksum,
-		sizeLeft:   size,
+		ReadCloser:       r,
+		expectedChecksum: checksum,
+		partialChecksum:  digestFunction.NewHasher(),
+		sizeLeft:         size,
+		invalidator: func() {
+			merkleBlobAccessCorruptedBlobsTotal.WithLabelValues("Put").Inc()
+		},
 	})
 }
 
+func (ba *merkleBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	if _, _, err := extractDigest(ba.digestFunctionSelector(instance), digest); err != nil {
+		return err
+	}
+	return ba.blobAccess.Delete(ctx, instance, digest)
+}
+
 func (ba *merkleBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	digestFunction := ba.digestFunctionSelector(instance)
 	for _, digest := range digests {
-		_, _, err := extractDigest(digest)
+		_, _, err := extractDigest(digestFunction, digest)
 		if err != nil {
 			return nil, err
 		}
@@ -75,24 +128,46 @@ func (ba *merkleBlobAccess) FindMissing(ctx context.Context, instance string, di
 type checksumValidatingReader struct {
 	io.ReadCloser
 
-	checksum [sha256.Size]byte
-	sizeLeft uint64
+	expectedChecksum []byte
+	partialChecksum  hash.Hash
+	sizeLeft         uint64
+
+	// Called when the data turns out to be corrupted. The error is
+	// retained, so that subsequent reads fail consistently.
+	invalidator func()
+	err         error
+}
+
+func (r *checksumValidatingReader) fail(err error) (int, error) {
+	r.invalidator()
+	r.err = err
+	return 0, err
 }
 
 func (r *checksumValidatingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
 	n, err := r.ReadCloser.Read(p)
 	nLen := uint64(n)
 	if nLen > r.sizeLeft {
-		return 0, fmt.Errorf("Blob is %d bytes longer than expected", nLen-r.sizeLeft)
+		return r.fail(status.Errorf(codes.DataLoss, "Blob is %d bytes longer than expected", nLen-r.sizeLeft))
 	}
+	r.partialChecksum.Write(p[:n])
 	r.sizeLeft -= nLen
 
 	if err == io.EOF {
 		if r.sizeLeft != 0 {
-			err := fmt.Errorf("Blob is %d bytes shorter than expected", r.sizeLeft)
-			return 0, err
+			return r.fail(status.Errorf(codes.DataLoss, "Blob is %d bytes shorter than expected", r.sizeLeft))
+		}
+		actualChecksum := r.partialChecksum.Sum(nil)
+		if !bytes.Equal(actualChecksum, r.expectedChecksum) {
+			return r.fail(status.Errorf(
+				codes.DataLoss,
+				"Checksum of blob is %s, while %s was expected",
+				hex.EncodeToString(actualChecksum),
+				hex.EncodeToString(r.expectedChecksum)))
 		}
-		// TODO(edsch): Validate checksum.
 	}
 	return n, err
 }
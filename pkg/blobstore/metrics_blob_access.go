@@ -9,6 +9,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -25,15 +27,34 @@ var (
 			Namespace: "buildbarn",
 			Subsystem: "blobstore",
 			Name:      "blob_access_operations_duration_seconds",
-			Help:      "Amount of time spent per operation on blob access objects, in seconds.",
+			Help:      "Amount of time spent per operation on blob access objects, in seconds. For Get(), this includes the time spent reading the blob.",
 			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 6*3+1),
 		},
+		[]string{"name", "operation", "code"})
+	blobAccessOperationsBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "blob_access_operations_bytes_total",
+			Help:      "Total number of bytes of blob data transferred by operations on blob access objects.",
+		},
+		[]string{"name", "operation"})
+	blobAccessOperationsBlobSizeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "blob_access_operations_blob_size_bytes",
+			Help:      "Size of blobs processed by operations on blob access objects, in bytes.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 2.0, 33),
+		},
 		[]string{"name", "operation"})
 )
 
 func init() {
 	prometheus.MustRegister(blobAccessOperationsStartedTotal)
 	prometheus.MustRegister(blobAccessOperationsDurationSeconds)
+	prometheus.MustRegister(blobAccessOperationsBytesTotal)
+	prometheus.MustRegister(blobAccessOperationsBlobSizeBytes)
 }
 
 type metricsBlobAccess struct {
@@ -41,6 +62,9 @@ type metricsBlobAccess struct {
 	name       string
 }
 
+// NewMetricsBlobAccess creates an adapter that exposes Prometheus
+// metrics for the operations performed against a backend, such as
+// their duration, outcome and the amount of data transferred.
 func NewMetricsBlobAccess(blobAccess BlobAccess, name string) BlobAccess {
 	return &metricsBlobAccess{
 		blobAccess: blobAccess,
@@ -48,19 +72,91 @@ func NewMetricsBlobAccess(blobAccess BlobAccess, name string) BlobAccess {
 	}
 }
 
+func (ba *metricsBlobAccess) observeDuration(operation string, timeStart time.Time, err error) {
+	blobAccessOperationsDurationSeconds.WithLabelValues(ba.name, operation, status.Code(err).String()).Observe(time.Now().Sub(timeStart).Seconds())
+}
+
+// metricsReader keeps track of the number of bytes read from a blob.
+// The duration of Get() is observed once the blob has been read
+// entirely, reading fails or the reader is closed.
+type metricsReader struct {
+	io.ReadCloser
+
+	ba        *metricsBlobAccess
+	timeStart time.Time
+	bytesRead int64
+	observed  bool
+}
+
+func (r *metricsReader) observe(err error) {
+	if !r.observed {
+		r.observed = true
+		r.ba.observeDuration("Get", r.timeStart, err)
+		blobAccessOperationsBytesTotal.WithLabelValues(r.ba.name, "Get").Add(float64(r.bytesRead))
+	}
+}
+
+func (r *metricsReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytesRead += int64(n)
+	if err == io.EOF {
+		r.observe(nil)
+	} else if err != nil {
+		r.observe(err)
+	}
+	return n, err
+}
+
+func (r *metricsReader) Close() error {
+	// Readers that are closed before reaching the end of the blob
+	// are abandoned by the caller.
+	r.observe(status.Error(codes.Canceled, "Reader closed before reaching the end of the blob"))
+	return r.ReadCloser.Close()
+}
+
+// metricsPutReader keeps track of the number of bytes written to a
+// blob.
+type metricsPutReader struct {
+	io.ReadCloser
+
+	bytesRead int64
+}
+
+func (r *metricsPutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytesRead += int64(n)
+	return n, err
+}
+
 func (ba *metricsBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
 	blobAccessOperationsStartedTotal.WithLabelValues(ba.name, "Get").Inc()
+	blobAccessOperationsBlobSizeBytes.WithLabelValues(ba.name, "Get").Observe(float64(digest.SizeBytes))
+	// Take the start time before calling into the backend, as
+	// backends may already perform work before returning a reader.
 	timeStart := time.Now()
-	r := ba.blobAccess.Get(ctx, instance, digest)
-	blobAccessOperationsDurationSeconds.WithLabelValues(ba.name, "Get").Observe(time.Now().Sub(timeStart).Seconds())
-	return r
+	return &metricsReader{
+		ReadCloser: ba.blobAccess.Get(ctx, instance, digest),
+		ba:         ba,
+		timeStart:  timeStart,
+	}
 }
 
 func (ba *metricsBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
 	blobAccessOperationsStartedTotal.WithLabelValues(ba.name, "Put").Inc()
+	blobAccessOperationsBlobSizeBytes.WithLabelValues(ba.name, "Put").Observe(float64(digest.SizeBytes))
+	timeStart := time.Now()
+	mr := &metricsPutReader{ReadCloser: r}
+	err := ba.blobAccess.Put(ctx, instance, digest, mr)
+	ba.observeDuration("Put", timeStart, err)
+	blobAccessOperationsBytesTotal.WithLabelValues(ba.name, "Put").Add(float64(mr.bytesRead))
+	return err
+}
+
+func (ba *metricsBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	blobAccessOperationsStartedTotal.WithLabelValues(ba.name, "Delete").Inc()
 	timeStart := time.Now()
-	err := ba.blobAccess.Put(ctx, instance, digest, r)
-	blobAccessOperationsDurationSeconds.WithLabelValues(ba.name, "Put").Observe(time.Now().Sub(timeStart).Seconds())
+	err := ba.blobAccess.Delete(ctx, instance, digest)
+	ba.observeDuration("Delete", timeStart, err)
 	return err
 }
 
@@ -68,6 +164,6 @@ func (ba *metricsBlobAccess) FindMissing(ctx context.Context, instance string, d
 	blobAccessOperationsStartedTotal.WithLabelValues(ba.name, "FindMissing").Inc()
 	timeStart := time.Now()
 	digests, err := ba.blobAccess.FindMissing(ctx, instance, digests)
-	blobAccessOperationsDurationSeconds.WithLabelValues(ba.name, "FindMissing").Observe(time.Now().Sub(timeStart).Seconds())
+	ba.observeDuration("FindMissing", timeStart, err)
 	return digests, err
 }
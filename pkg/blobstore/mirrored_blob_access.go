@@ -0,0 +1,213 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	mirroredBlobAccessMaxConcurrentRepairs = 16
+)
+
+var (
+	mirroredBlobAccessRepairsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "mirrored_blob_access_repairs_total",
+			Help:      "Total number of blobs copied between mirrored backends, as they were absent in one of them.",
+		},
+		[]string{"destination", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(mirroredBlobAccessRepairsTotal)
+}
+
+type mirroredBlobAccess struct {
+	backendA BlobAccess
+	backendB BlobAccess
+
+	getCounter      uint32
+	repairSemaphore chan struct{}
+}
+
+// NewMirroredBlobAccess creates an adapter that stores all blobs in two
+// backends, so that the loss of one of them can be tolerated. Blobs
+// that are found to be present in only one of the backends are copied
+// to the other one.
+func NewMirroredBlobAccess(backendA BlobAccess, backendB BlobAccess) BlobAccess {
+	return &mirroredBlobAccess{
+		backendA: backendA,
+		backendB: backendB,
+
+		repairSemaphore: make(chan struct{}, mirroredBlobAccessMaxConcurrentRepairs),
+	}
+}
+
+// repair copies a blob between backends in the background. Repairs are
+// dropped when too many of them are in flight, as they will be
+// scheduled once again the next time the blob is accessed.
+func (ba *mirroredBlobAccess) repair(source BlobAccess, destination BlobAccess, destinationName string, instance string, digest *remoteexecution.Digest) {
+	select {
+	case ba.repairSemaphore <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		ctx := context.Background()
+		if err := destination.Put(ctx, instance, digest, source.Get(ctx, instance, digest)); err == nil {
+			mirroredBlobAccessRepairsTotal.WithLabelValues(destinationName, "Success").Inc()
+		} else {
+			mirroredBlobAccessRepairsTotal.WithLabelValues(destinationName, "Failure").Inc()
+		}
+		<-ba.repairSemaphore
+	}()
+}
+
+func (ba *mirroredBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	// Alternate between backends to spread the load.
+	primary, secondary := ba.backendA, ba.backendB
+	if atomic.AddUint32(&ba.getCounter, 1)%2 == 0 {
+		primary, secondary = secondary, primary
+	}
+	return &fallbackReader{
+		ReadCloser: primary.Get(ctx, instance, digest),
+		fallback: func(err error) io.ReadCloser {
+			if status.Code(err) != codes.NotFound {
+				// The primary backend is unavailable.
+				return secondary.Get(ctx, instance, digest)
+			}
+			// The blob is absent in the primary backend. Restore
+			// it while reading it from the secondary backend.
+			return &teeReader{
+				ReadCloser: secondary.Get(ctx, instance, digest),
+				replica:    replicate(primary, instance, digest),
+			}
+		},
+	}
+}
+
+func (ba *mirroredBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	rA, wA := io.Pipe()
+	rB, wB := io.Pipe()
+	errA := make(chan error, 1)
+	go func() {
+		errA <- ba.backendA.Put(ctx, instance, digest, rA)
+		rA.Close()
+	}()
+	errB := make(chan error, 1)
+	go func() {
+		errB <- ba.backendB.Put(ctx, instance, digest, rB)
+		rB.Close()
+	}()
+
+	// Copy data into both backends. Backends that fail are skipped,
+	// so that the other backend may still store the blob.
+	aliveA, aliveB := true, true
+	for aliveA || aliveB {
+		var readBuf [readChunkSize]byte
+		n, err := r.Read(readBuf[:])
+		if n > 0 {
+			if aliveA {
+				if _, err := wA.Write(readBuf[:n]); err != nil {
+					aliveA = false
+				}
+			}
+			if aliveB {
+				if _, err := wB.Write(readBuf[:n]); err != nil {
+					aliveB = false
+				}
+			}
+		}
+		if err == io.EOF {
+			wA.Close()
+			wB.Close()
+			break
+		} else if err != nil {
+			wA.CloseWithError(err)
+			wB.CloseWithError(err)
+			break
+		}
+	}
+	r.Close()
+
+	// Succeed if at least one of the backends stored the blob. The
+	// other backend gets repaired when the blob is accessed.
+	resultA, resultB := <-errA, <-errB
+	if resultA != nil && resultB != nil {
+		return resultA
+	}
+	if resultA != nil {
+		log.Print("Failed to store blob in mirror A: ", resultA)
+	}
+	if resultB != nil {
+		log.Print("Failed to store blob in mirror B: ", resultB)
+	}
+	return nil
+}
+
+func (ba *mirroredBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	errA := make(chan error, 1)
+	go func() {
+		errA <- ba.backendA.Delete(ctx, instance, digest)
+	}()
+	errB := ba.backendB.Delete(ctx, instance, digest)
+	if err := <-errA; err != nil {
+		return err
+	}
+	return errB
+}
+
+func (ba *mirroredBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	resultsAChan := make(chan findMissingResults, 1)
+	go func() {
+		resultsAChan <- callFindMissing(ba.backendA, ctx, instance, digests)
+	}()
+	resultsB := callFindMissing(ba.backendB, ctx, instance, digests)
+	resultsA := <-resultsAChan
+
+	// Tolerate the failure of one of the backends.
+	if resultsA.err != nil && resultsB.err != nil {
+		return nil, resultsA.err
+	}
+	if resultsA.err != nil {
+		return resultsB.missing, nil
+	}
+	if resultsB.err != nil {
+		return resultsA.missing, nil
+	}
+
+	// Only report blobs absent in both backends as missing. Repair
+	// blobs that are only present in one of them.
+	type digestKey struct {
+		hash      string
+		sizeBytes int64
+	}
+	missingA := map[digestKey]*remoteexecution.Digest{}
+	for _, digest := range resultsA.missing {
+		missingA[digestKey{hash: digest.Hash, sizeBytes: digest.SizeBytes}] = digest
+	}
+	var missing []*remoteexecution.Digest
+	for _, digest := range resultsB.missing {
+		key := digestKey{hash: digest.Hash, sizeBytes: digest.SizeBytes}
+		if _, ok := missingA[key]; ok {
+			missing = append(missing, digest)
+			delete(missingA, key)
+		} else {
+			ba.repair(ba.backendA, ba.backendB, "B", instance, digest)
+		}
+	}
+	for _, digest := range missingA {
+		ba.repair(ba.backendB, ba.backendA, "A", instance, digest)
+	}
+	return missing, nil
+}
@@ -0,0 +1,138 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestMirroredBlobAccess() (BlobAccess, BlobAccess, BlobAccess) {
+	backendA := NewMemoryBlobAccess(util.KeyDigestWithInstance, 1<<20)
+	backendB := NewMemoryBlobAccess(util.KeyDigestWithInstance, 1<<20)
+	return NewMirroredBlobAccess(backendA, backendB), backendA, backendB
+}
+
+// waitForBlob waits for a blob to be repaired in the background.
+func waitForBlob(t *testing.T, ba BlobAccess, digest *remoteexecution.Digest) {
+	for i := 0; !isBlobPresent(t, ba, digest); i++ {
+		if i == 1000 {
+			t.Fatal("Blob was not repaired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMirroredBlobAccessPut(t *testing.T) {
+	ba, backendA, backendB := newTestMirroredBlobAccess()
+	digest := putBlob(t, ba, "Hello")
+	if !isBlobPresent(t, backendA, digest) || !isBlobPresent(t, backendB, digest) {
+		t.Fatal("Blob was not stored in both backends")
+	}
+
+	// Failures of a single backend should be tolerated.
+	unavailable := status.Error(codes.Unavailable, "Server offline")
+	backendA = NewMemoryBlobAccess(util.KeyDigestWithInstance, 1<<20)
+	ba = NewMirroredBlobAccess(backendA, &scriptedBlobAccess{errs: []error{unavailable}})
+	digest = putBlob(t, ba, "Hello")
+	if !isBlobPresent(t, backendA, digest) {
+		t.Fatal("Blob was not stored in the available backend")
+	}
+
+	ba = NewMirroredBlobAccess(&scriptedBlobAccess{errs: []error{unavailable}}, &scriptedBlobAccess{errs: []error{unavailable}})
+	err := ba.Put(context.Background(), "default", digest, ioutil.NopCloser(bytes.NewBufferString("Hello")))
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Fatalf("Expected code %s, got %s: %v", codes.Unavailable, code, err)
+	}
+}
+
+func TestMirroredBlobAccessGet(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ReadRepair", func(t *testing.T) {
+		// Blobs present in only one backend should be returned,
+		// regardless of which backend is tried first. Reading
+		// them should restore them in the other backend.
+		ba, backendA, backendB := newTestMirroredBlobAccess()
+		digest := putBlob(t, backendB, "Hello")
+		for i := 0; i < 2; i++ {
+			data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+			if err != nil {
+				t.Fatal("Get failed: ", err)
+			}
+			if string(data) != "Hello" {
+				t.Fatalf("Expected data %#v, got %#v", "Hello", string(data))
+			}
+		}
+		if !isBlobPresent(t, backendA, digest) {
+			t.Fatal("Blob was not repaired")
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		ba, _, _ := newTestMirroredBlobAccess()
+		digest := util.SHA256DigestFunction.DigestFromData([]byte("Hello"))
+		for i := 0; i < 2; i++ {
+			if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.NotFound {
+				t.Fatal("Expected Get to fail with NotFound, got ", err)
+			}
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		// Blobs should be read from the other backend if one of
+		// them is unavailable, without attempting to repair.
+		backendA := &scriptedBlobAccess{errs: []error{status.Error(codes.Unavailable, "Server offline")}}
+		backendB := &scriptedBlobAccess{}
+		ba := NewMirroredBlobAccess(backendA, backendB)
+		data, err := ioutil.ReadAll(ba.Get(ctx, "default", &remoteexecution.Digest{}))
+		if err != nil {
+			t.Fatal("Get failed: ", err)
+		}
+		if string(data) != "Hello" {
+			t.Fatalf("Expected data %#v, got %#v", "Hello", string(data))
+		}
+		if backendA.getCalls()+backendB.getCalls() != 2 {
+			t.Fatalf("Expected 2 calls, got %d", backendA.getCalls()+backendB.getCalls())
+		}
+	})
+}
+
+func TestMirroredBlobAccessFindMissing(t *testing.T) {
+	ctx := context.Background()
+	ba, backendA, backendB := newTestMirroredBlobAccess()
+	onlyA := putBlob(t, backendA, "A")
+	onlyB := putBlob(t, backendB, "B")
+	both := putBlob(t, ba, "Both")
+	neither := util.SHA256DigestFunction.DigestFromData([]byte("Neither"))
+
+	// Only blobs absent in both backends should be reported
+	// missing. Blobs present in a single backend should be copied
+	// to the other one in the background.
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{onlyA, onlyB, both, neither})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 || missing[0] != neither {
+		t.Fatalf("Expected only %s to be missing, got %v", neither.Hash, missing)
+	}
+	waitForBlob(t, backendB, onlyA)
+	waitForBlob(t, backendA, onlyB)
+
+	// Failures of a single backend should be tolerated.
+	ba = NewMirroredBlobAccess(backendA, &scriptedBlobAccess{errs: []error{status.Error(codes.Unavailable, "Server offline")}})
+	missing, err = ba.FindMissing(ctx, "default", []*remoteexecution.Digest{onlyA, neither})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 || missing[0] != neither {
+		t.Fatalf("Expected only %s to be missing, got %v", neither.Hash, missing)
+	}
+}
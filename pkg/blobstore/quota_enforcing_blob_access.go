@@ -0,0 +1,62 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+type quotaEnforcingBlobAccess struct {
+	blobAccess    BlobAccess
+	quotaEnforcer *util.QuotaEnforcer
+}
+
+// NewQuotaEnforcingBlobAccess creates an adapter that rejects
+// operations with RESOURCE_EXHAUSTED if they would cause clients to
+// exceed the quota of an instance. Every operation counts as a single
+// request. Put() is additionally subject to the maximum blob size and
+// the maximum number of concurrent uploads.
+func NewQuotaEnforcingBlobAccess(blobAccess BlobAccess, quotaEnforcer *util.QuotaEnforcer) BlobAccess {
+	return &quotaEnforcingBlobAccess{
+		blobAccess:    blobAccess,
+		quotaEnforcer: quotaEnforcer,
+	}
+}
+
+func (ba *quotaEnforcingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	if err := ba.quotaEnforcer.AllowRequest(ctx, instance); err != nil {
+		return &errorReader{err: err}
+	}
+	return ba.blobAccess.Get(ctx, instance, digest)
+}
+
+func (ba *quotaEnforcingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	if err := ba.quotaEnforcer.AllowRequest(ctx, instance); err != nil {
+		r.Close()
+		return err
+	}
+	release, err := ba.quotaEnforcer.AcquireUpload(instance, digest.SizeBytes)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	defer release()
+	return ba.blobAccess.Put(ctx, instance, digest, r)
+}
+
+func (ba *quotaEnforcingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	if err := ba.quotaEnforcer.AllowRequest(ctx, instance); err != nil {
+		return err
+	}
+	return ba.blobAccess.Delete(ctx, instance, digest)
+}
+
+func (ba *quotaEnforcingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	if err := ba.quotaEnforcer.AllowRequest(ctx, instance); err != nil {
+		return nil, err
+	}
+	return ba.blobAccess.FindMissing(ctx, instance, digests)
+}
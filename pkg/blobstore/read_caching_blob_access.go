@@ -0,0 +1,163 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type readCachingBlobAccess struct {
+	fastBlobAccess BlobAccess
+	slowBlobAccess BlobAccess
+	writeToFast    bool
+}
+
+// NewReadCachingBlobAccess creates an adapter that composes a fast and
+// a slow storage backend. Blobs that are absent in the fast backend
+// are read from the slow backend, while simultaneously being copied
+// into the fast backend. Blobs are always written into the slow
+// backend. When writeToFast is set, they are written into the fast
+// backend as well.
+func NewReadCachingBlobAccess(fastBlobAccess BlobAccess, slowBlobAccess BlobAccess, writeToFast bool) BlobAccess {
+	return &readCachingBlobAccess{
+		fastBlobAccess: fastBlobAccess,
+		slowBlobAccess: slowBlobAccess,
+		writeToFast:    writeToFast,
+	}
+}
+
+// replica is a writer whose data is stored in a BlobAccess
+// asynchronously. Failures to store the data are ignored, as they
+// should not affect the operation that provides the data.
+type replica struct {
+	*io.PipeWriter
+
+	done chan struct{}
+}
+
+func replicate(blobAccess BlobAccess, instance string, digest *remoteexecution.Digest) *replica {
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		// The context of the originating operation may already be
+		// cancelled by the time the data is fully written.
+		blobAccess.Put(context.Background(), instance, digest, r)
+		r.Close()
+		close(done)
+	}()
+	return &replica{
+		PipeWriter: w,
+		done:       done,
+	}
+}
+
+// teeReader forwards data that is read to a replica. When the end of
+// the blob is reached, it waits for the replica to be stored, so that
+// the blob is present in both places once the caller observes EOF.
+type teeReader struct {
+	io.ReadCloser
+
+	replica *replica
+}
+
+func (r *teeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.replica.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.replica.Close()
+		<-r.replica.done
+	} else if err != nil {
+		r.replica.CloseWithError(err)
+	}
+	return n, err
+}
+
+func (r *teeReader) Close() error {
+	r.replica.CloseWithError(io.ErrUnexpectedEOF)
+	return r.ReadCloser.Close()
+}
+
+// fallbackReader reads a blob from a primary source. If the first
+// read fails, it calls a function that may provide an alternative
+// source. This allows for switching between backends without
+// obtaining the first bytes of a blob up front.
+type fallbackReader struct {
+	io.ReadCloser
+
+	fallback func(err error) io.ReadCloser
+	decided  bool
+}
+
+func (r *fallbackReader) Read(p []byte) (int, error) {
+	if r.decided {
+		return r.ReadCloser.Read(p)
+	}
+	r.decided = true
+	n, err := r.ReadCloser.Read(p)
+	if n != 0 || err == nil || err == io.EOF {
+		return n, err
+	}
+	alternative := r.fallback(err)
+	if alternative == nil {
+		return n, err
+	}
+	r.ReadCloser.Close()
+	r.ReadCloser = alternative
+	return r.ReadCloser.Read(p)
+}
+
+func (ba *readCachingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	return &fallbackReader{
+		ReadCloser: ba.fastBlobAccess.Get(ctx, instance, digest),
+		fallback: func(err error) io.ReadCloser {
+			if status.Code(err) != codes.NotFound {
+				return nil
+			}
+			return &teeReader{
+				ReadCloser: ba.slowBlobAccess.Get(ctx, instance, digest),
+				replica:    replicate(ba.fastBlobAccess, instance, digest),
+			}
+		},
+	}
+}
+
+func (ba *readCachingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	if !ba.writeToFast {
+		return ba.slowBlobAccess.Put(ctx, instance, digest, r)
+	}
+	return ba.slowBlobAccess.Put(ctx, instance, digest, &teeReader{
+		ReadCloser: r,
+		replica:    replicate(ba.fastBlobAccess, instance, digest),
+	})
+}
+
+func (ba *readCachingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	// Delete the blob from both backends. Removing the blob from
+	// the fast backend only would cause it to reappear.
+	var wg sync.WaitGroup
+	var fastErr error
+	wg.Add(1)
+	go func() {
+		fastErr = ba.fastBlobAccess.Delete(ctx, instance, digest)
+		wg.Done()
+	}()
+	slowErr := ba.slowBlobAccess.Delete(ctx, instance, digest)
+	wg.Wait()
+	if slowErr != nil {
+		return slowErr
+	}
+	return fastErr
+}
+
+func (ba *readCachingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	// The slow backend is authoritative, as blobs in the fast
+	// backend may have expired in the slow backend. Calling into the
+	// slow backend for all blobs also extends their lifetime there.
+	return ba.slowBlobAccess.FindMissing(ctx, instance, digests)
+}
@@ -0,0 +1,157 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// findMissingRecordingBlobAccess records the digests provided to calls
+// to FindMissing().
+type findMissingRecordingBlobAccess struct {
+	BlobAccess
+	digests []*remoteexecution.Digest
+}
+
+func (ba *findMissingRecordingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	ba.digests = append(ba.digests, digests...)
+	return ba.BlobAccess.FindMissing(ctx, instance, digests)
+}
+
+func putBlob(t *testing.T, ba BlobAccess, data string) *remoteexecution.Digest {
+	digest := util.SHA256DigestFunction.DigestFromData([]byte(data))
+	if err := ba.Put(context.Background(), "default", digest, ioutil.NopCloser(bytes.NewBufferString(data))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	return digest
+}
+
+func isBlobPresent(t *testing.T, ba BlobAccess, digest *remoteexecution.Digest) bool {
+	missing, err := ba.FindMissing(context.Background(), "default", []*remoteexecution.Digest{digest})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	return len(missing) == 0
+}
+
+func TestReadCachingBlobAccessGet(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name        string
+		inFast      bool
+		inSlow      bool
+		code        codes.Code
+		cachedAfter bool
+	}{
+		{"Fast", true, false, codes.OK, true},
+		{"Both", true, true, codes.OK, true},
+		{"SlowOnly", false, true, codes.OK, true},
+		{"Absent", false, false, codes.NotFound, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fast := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+			slow := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+			ba := NewReadCachingBlobAccess(fast, slow, false)
+			digest := util.SHA256DigestFunction.DigestFromData([]byte("Hello"))
+			if test.inFast {
+				putBlob(t, fast, "Hello")
+			}
+			if test.inSlow {
+				putBlob(t, slow, "Hello")
+			}
+
+			// Blobs absent in the fast backend are read from
+			// the slow backend and copied into the fast backend.
+			r := ba.Get(ctx, "default", digest)
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("Expected code %s, got %s: %v", test.code, code, err)
+			}
+			if err == nil && string(data) != "Hello" {
+				t.Fatalf("Expected data %#v, got %#v", "Hello", string(data))
+			}
+			if cached := isBlobPresent(t, fast, digest); cached != test.cachedAfter {
+				t.Fatalf("Expected presence in the fast backend to be %v, got %v", test.cachedAfter, cached)
+			}
+		})
+	}
+}
+
+func TestReadCachingBlobAccessGetPartialRead(t *testing.T) {
+	fast := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+	slow := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+	ba := NewReadCachingBlobAccess(fast, slow, false)
+	digest := putBlob(t, slow, "Hello")
+
+	// Blobs that are not read entirely must not be copied into the
+	// fast backend partially.
+	r := ba.Get(context.Background(), "default", digest)
+	var buf [2]byte
+	if _, err := r.Read(buf[:]); err != nil {
+		t.Fatal("Read failed: ", err)
+	}
+	r.Close()
+	if isBlobPresent(t, fast, digest) {
+		t.Fatal("Partially read blob was copied into the fast backend")
+	}
+}
+
+func TestReadCachingBlobAccessPut(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		writeToFast bool
+	}{
+		{"SlowOnly", false},
+		{"Both", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fast := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+			slow := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+			ba := NewReadCachingBlobAccess(fast, slow, test.writeToFast)
+			digest := putBlob(t, ba, "Hello")
+			if !isBlobPresent(t, slow, digest) {
+				t.Fatal("Blob was not written into the slow backend")
+			}
+			if inFast := isBlobPresent(t, fast, digest); inFast != test.writeToFast {
+				t.Fatalf("Expected presence in the fast backend to be %v, got %v", test.writeToFast, inFast)
+			}
+		})
+	}
+}
+
+func TestReadCachingBlobAccessFindMissing(t *testing.T) {
+	fast := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+	slow := &findMissingRecordingBlobAccess{
+		BlobAccess: NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20),
+	}
+	ba := NewReadCachingBlobAccess(fast, slow, false)
+	both := putBlob(t, fast, "Both")
+	putBlob(t, slow, "Both")
+	fastOnly := putBlob(t, fast, "Fast")
+	slowOnly := putBlob(t, slow, "Slow")
+	absent := util.SHA256DigestFunction.DigestFromData([]byte("Absent"))
+
+	// The slow backend is authoritative. Blobs that only remain in
+	// the fast backend are reported as missing, while all blobs are
+	// passed on to the slow backend, so that their lifetime is
+	// extended.
+	digests := []*remoteexecution.Digest{both, fastOnly, slowOnly, absent}
+	missing, err := ba.FindMissing(context.Background(), "default", digests)
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 2 || missing[0] != fastOnly || missing[1] != absent {
+		t.Fatalf("Expected %v and %v to be missing, got %v", fastOnly, absent, missing)
+	}
+	if len(slow.digests) != len(digests) {
+		t.Fatalf("Expected %d blobs to be checked in the slow backend, got %d", len(digests), len(slow.digests))
+	}
+}
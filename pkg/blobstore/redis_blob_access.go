@@ -3,8 +3,16 @@ package blobstore
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/go-redis/redis"
@@ -14,16 +22,210 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// redisBlobAccessPipelinedChunks is the number of chunks that
+	// is transferred in a single pipeline, bounding the amount of
+	// memory needed to stream a large blob.
+	redisBlobAccessPipelinedChunks = 4
+
+	// redisBlobManifestMaxSize is an upper bound on the size of a
+	// manifest, used to obtain manifests without fetching the
+	// contents of small blobs entirely.
+	redisBlobManifestMaxSize = 128
+)
+
+var (
+	// redisBlobManifestMagic is the prefix of values that contain
+	// a manifest instead of the contents of a blob. A manifest is
+	// followed by the size of the blob, the size of its chunks and
+	// an upload ID that is part of the keys of the chunks.
+	redisBlobManifestMagic = []byte("\x89BBCHK\r\n")
+)
+
+// convertRedisError converts an error returned by the Redis client to
+// a gRPC error. Connection failures and errors returned by the server
+// while it is temporarily unable to process requests are converted to
+// UNAVAILABLE, so that they may be retried.
+func convertRedisError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return status.Errorf(codes.Unavailable, "Failed to communicate with Redis: %s", err)
+	}
+	message := err.Error()
+	switch {
+	case strings.HasPrefix(message, "OOM "):
+		return status.Error(codes.ResourceExhausted, message)
+	case strings.HasPrefix(message, "redis: "):
+		// Errors generated by the client itself, such as
+		// "redis: connection pool timeout".
+		return status.Error(codes.Unavailable, message)
+	case strings.HasPrefix(message, "LOADING "),
+		strings.HasPrefix(message, "READONLY "),
+		strings.HasPrefix(message, "CLUSTERDOWN "),
+		strings.HasPrefix(message, "MASTERDOWN "),
+		strings.HasPrefix(message, "TRYAGAIN "),
+		strings.HasPrefix(message, "BUSY "),
+		message == "ERR max number of clients reached":
+		return status.Error(codes.Unavailable, message)
+	default:
+		return status.Error(codes.Internal, message)
+	}
+}
+
+// redisBlobManifest describes how a large blob is split up in chunks
+// that are stored under separate keys.
+type redisBlobManifest struct {
+	sizeBytes      int64
+	chunkSizeBytes int64
+	uploadID       string
+}
+
+func parseRedisBlobManifest(value []byte) (*redisBlobManifest, bool, error) {
+	if !bytes.HasPrefix(value, redisBlobManifestMagic) {
+		return nil, false, nil
+	}
+	value = value[len(redisBlobManifestMagic):]
+	if len(value) < 12 {
+		return nil, true, status.Errorf(codes.DataLoss, "Blob manifest is truncated")
+	}
+	manifest := &redisBlobManifest{
+		sizeBytes:      int64(binary.BigEndian.Uint64(value)),
+		chunkSizeBytes: int64(binary.BigEndian.Uint32(value[8:])),
+		uploadID:       string(value[12:]),
+	}
+	if manifest.sizeBytes < 0 || manifest.chunkSizeBytes == 0 {
+		return nil, true, status.Errorf(codes.DataLoss, "Blob manifest is invalid")
+	}
+	return manifest, true, nil
+}
+
+func (m *redisBlobManifest) marshal() []byte {
+	value := append([]byte(nil), redisBlobManifestMagic...)
+	var sizes [12]byte
+	binary.BigEndian.PutUint64(sizes[:], uint64(m.sizeBytes))
+	binary.BigEndian.PutUint32(sizes[8:], uint32(m.chunkSizeBytes))
+	value = append(value, sizes[:]...)
+	return append(value, m.uploadID...)
+}
+
+func (m *redisBlobManifest) getChunkCount() int64 {
+	return (m.sizeBytes + m.chunkSizeBytes - 1) / m.chunkSizeBytes
+}
+
+// getChunkKey returns the key of a chunk. The key of the blob is used
+// as a hash tag, so that a Redis Cluster stores the chunks in the same
+// slot as the manifest. This allows pipelines that access all chunks
+// of a blob to be processed by a single node.
+func (m *redisBlobManifest) getChunkKey(key string, chunk int64) string {
+	return fmt.Sprintf("{%s}:%s:%d", key, m.uploadID, chunk)
+}
+
 type redisBlobAccess struct {
-	redisClient *redis.Client
-	blobKeyer   util.DigestKeyer
+	redisClient    redis.Cmdable
+	blobKeyer      util.DigestKeyer
+	chunkSizeBytes int
+	keyTTL         time.Duration
 }
 
-func NewRedisBlobAccess(redisClient *redis.Client, blobKeyer util.DigestKeyer) BlobAccess {
+// NewRedisBlobAccess creates a BlobAccess that stores blobs in Redis.
+// Blobs larger than chunkSizeBytes are split up in chunks that are
+// stored under separate keys, so that they can be streamed without
+// holding them in memory entirely.
+//
+// Any go-redis client may be provided, including the clients returned
+// by redis.NewUniversalClient() for Redis Cluster and Redis Sentinel,
+// and redis.Ring. Pipelines executed against a Redis Cluster are split
+// up by slot by the client, meaning that FindMissing() only needs a
+// single round trip to every node.
+//
+// When keyTTL is non-zero, blobs are stored with an expiration time.
+// The expiration time of blobs reported present by FindMissing() is
+// extended, so that blobs remain present while builds use them.
+func NewRedisBlobAccess(redisClient redis.Cmdable, blobKeyer util.DigestKeyer, chunkSizeBytes int, keyTTL time.Duration) BlobAccess {
 	return &redisBlobAccess{
-		redisClient: redisClient,
-		blobKeyer:   blobKeyer,
+		redisClient:    redisClient,
+		blobKeyer:      blobKeyer,
+		chunkSizeBytes: chunkSizeBytes,
+		keyTTL:         keyTTL,
+	}
+}
+
+// touchKey adds a command to a pipeline that checks for the existence
+// of a key. If keys have an expiration time, it is extended as well.
+// The function that is returned reports whether the key exists.
+func (ba *redisBlobAccess) touchKey(pipeline redis.Pipeliner, key string) func() bool {
+	if ba.keyTTL > 0 {
+		return pipeline.Expire(key, ba.keyTTL).Val
 	}
+	cmd := pipeline.Exists(key)
+	return func() bool { return cmd.Val() != 0 }
+}
+
+// redisChunkReader streams the chunks of a large blob out of Redis,
+// fetching a small number of chunks at a time.
+type redisChunkReader struct {
+	redisClient redis.Cmdable
+	key         string
+	manifest    *redisBlobManifest
+
+	nextChunk int64
+	chunks    [][]byte
+	err       error
+}
+
+func (r *redisChunkReader) fetchChunks() error {
+	pipeline := r.redisClient.Pipeline()
+	var cmds []*redis.StringCmd
+	for i := 0; i < redisBlobAccessPipelinedChunks && r.nextChunk+int64(i) < r.manifest.getChunkCount(); i++ {
+		cmds = append(cmds, pipeline.Get(r.manifest.getChunkKey(r.key, r.nextChunk+int64(i))))
+	}
+	if _, err := pipeline.Exec(); err != nil && err != redis.Nil {
+		return convertRedisError(err)
+	}
+	for _, cmd := range cmds {
+		chunk, err := cmd.Bytes()
+		if err == redis.Nil {
+			return status.Errorf(codes.NotFound, "Chunk %d of blob not found", r.nextChunk)
+		} else if err != nil {
+			return convertRedisError(err)
+		}
+		expectedSize := r.manifest.chunkSizeBytes
+		if r.nextChunk == r.manifest.getChunkCount()-1 {
+			expectedSize = r.manifest.sizeBytes - r.nextChunk*r.manifest.chunkSizeBytes
+		}
+		if int64(len(chunk)) != expectedSize {
+			return status.Errorf(codes.DataLoss, "Chunk %d of blob is %d bytes in size, while %d bytes were expected", r.nextChunk, len(chunk), expectedSize)
+		}
+		r.chunks = append(r.chunks, chunk)
+		r.nextChunk++
+	}
+	return nil
+}
+
+func (r *redisChunkReader) Read(p []byte) (int, error) {
+	for {
+		if len(r.chunks) > 0 {
+			n := copy(p, r.chunks[0])
+			r.chunks[0] = r.chunks[0][n:]
+			if len(r.chunks[0]) == 0 {
+				r.chunks = r.chunks[1:]
+			}
+			return n, nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.nextChunk >= r.manifest.getChunkCount() {
+			return 0, io.EOF
+		}
+		r.err = r.fetchChunks()
+	}
+}
+
+func (r *redisChunkReader) Close() error {
+	return nil
 }
 
 func (ba *redisBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
@@ -39,25 +241,174 @@ func (ba *redisBlobAccess) Get(ctx context.Context, instance string, digest *rem
 		if err == redis.Nil {
 			return &errorReader{err: status.Errorf(codes.NotFound, err.Error())}
 		}
+		return &errorReader{err: convertRedisError(err)}
+	}
+	manifest, isManifest, err := parseRedisBlobManifest(value)
+	if err != nil {
 		return &errorReader{err: err}
 	}
-	return ioutil.NopCloser(bytes.NewBuffer(value))
+	if !isManifest {
+		return ioutil.NopCloser(bytes.NewBuffer(value))
+	}
+	return &redisChunkReader{
+		redisClient: ba.redisClient,
+		key:         key,
+		manifest:    manifest,
+	}
+}
+
+// deleteChunks removes the chunks of a large blob.
+func (ba *redisBlobAccess) deleteChunks(key string, manifest *redisBlobManifest, chunkCount int64) error {
+	pipeline := ba.redisClient.Pipeline()
+	for i := int64(0); i < chunkCount; i++ {
+		pipeline.Del(manifest.getChunkKey(key, i))
+	}
+	_, err := pipeline.Exec()
+	return convertRedisError(err)
+}
+
+// readChunk reads up to chunkSizeBytes of data. The buffer that is
+// allocated is initially sizeHint bytes in size and is only grown when
+// more data is available, so that small blobs do not cause full chunks
+// to be allocated. An io.EOF or io.ErrUnexpectedEOF error is returned
+// if the end of the data has been reached.
+func (ba *redisBlobAccess) readChunk(r io.Reader, sizeHint int64) ([]byte, error) {
+	size := int64(ba.chunkSizeBytes)
+	if sizeHint > 0 && sizeHint < size {
+		size = sizeHint
+	}
+	chunk := make([]byte, size)
+	n, err := io.ReadFull(r, chunk)
+	for err == nil && n < ba.chunkSizeBytes {
+		newSize := 2 * len(chunk)
+		if newSize > ba.chunkSizeBytes {
+			newSize = ba.chunkSizeBytes
+		}
+		newChunk := make([]byte, newSize)
+		copy(newChunk, chunk)
+		chunk = newChunk
+		var nRead int
+		nRead, err = io.ReadFull(r, chunk[n:])
+		n += nRead
+	}
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return chunk[:n], err
+}
+
+// putChunks stores the chunks of a large blob, followed by its
+// manifest. The manifest is written last, so that the blob does not
+// become visible before all of its chunks are stored. The expected
+// size of the blob is used to size the buffers of the chunks.
+func (ba *redisBlobAccess) putChunks(key string, firstChunk []byte, r io.Reader, expectedSizeBytes int64) error {
+	var uploadID [16]byte
+	if _, err := io.ReadFull(rand.Reader, uploadID[:]); err != nil {
+		return err
+	}
+	manifest := &redisBlobManifest{
+		chunkSizeBytes: int64(ba.chunkSizeBytes),
+		uploadID:       hex.EncodeToString(uploadID[:]),
+	}
+
+	chunk := firstChunk
+	chunkCount := int64(0)
+	for done := false; !done; {
+		// Store a batch of chunks in a single pipeline.
+		pipeline := ba.redisClient.Pipeline()
+		for i := 0; i < redisBlobAccessPipelinedChunks && !done; i++ {
+			if chunk == nil {
+				var err error
+				chunk, err = ba.readChunk(r, expectedSizeBytes-manifest.sizeBytes+1)
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					done = true
+				} else if err != nil {
+					ba.deleteChunks(key, manifest, chunkCount)
+					return err
+				}
+			}
+			if len(chunk) > 0 {
+				pipeline.Set(manifest.getChunkKey(key, chunkCount), chunk, ba.keyTTL)
+				manifest.sizeBytes += int64(len(chunk))
+				chunkCount++
+			}
+			chunk = nil
+		}
+		if _, err := pipeline.Exec(); err != nil {
+			ba.deleteChunks(key, manifest, chunkCount)
+			return convertRedisError(err)
+		}
+	}
+
+	// Store the manifest. Remove the chunks of the blob that was
+	// previously stored under the same key, if any.
+	pipeline := ba.redisClient.TxPipeline()
+	getSetCmd := pipeline.GetSet(key, manifest.marshal())
+	if ba.keyTTL > 0 {
+		pipeline.Expire(key, ba.keyTTL)
+	}
+	if _, err := pipeline.Exec(); err != nil && err != redis.Nil {
+		return convertRedisError(err)
+	}
+	oldValue, err := getSetCmd.Bytes()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return convertRedisError(err)
+	}
+	if oldManifest, _, err := parseRedisBlobManifest(oldValue); err == nil && oldManifest != nil {
+		if err := ba.deleteChunks(key, oldManifest, oldManifest.getChunkCount()); err != nil {
+			log.Print("Failed to delete chunks of overwritten blob: ", err)
+		}
+	}
+	return nil
 }
 
 func (ba *redisBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	defer r.Close()
 	if err := ctx.Err(); err != nil {
 		return err
 	}
-	value, err := ioutil.ReadAll(r)
-	r.Close()
+	key, err := ba.blobKeyer(instance, digest)
 	if err != nil {
 		return err
 	}
+
+	// Store blobs that fit in a single chunk directly. Blobs that
+	// could be mistaken for a manifest are stored as chunks as well.
+	// One more byte than the size of the blob is read, so that the
+	// end of the data is detected without growing the buffer.
+	firstChunk, err := ba.readChunk(r, digest.SizeBytes+1)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if !bytes.HasPrefix(firstChunk, redisBlobManifestMagic) {
+			return convertRedisError(ba.redisClient.Set(key, firstChunk, ba.keyTTL).Err())
+		}
+		return ba.putChunks(key, firstChunk, bytes.NewReader(nil), digest.SizeBytes)
+	} else if err != nil {
+		return err
+	}
+	return ba.putChunks(key, firstChunk, r, digest.SizeBytes)
+}
+
+func (ba *redisBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	key, err := ba.blobKeyer(instance, digest)
 	if err != nil {
 		return err
 	}
-	return ba.redisClient.Set(key, value, 0).Err()
+	value, err := ba.redisClient.GetRange(key, 0, redisBlobManifestMaxSize-1).Bytes()
+	if err != nil {
+		return convertRedisError(err)
+	}
+	if err := ba.redisClient.Del(key).Err(); err != nil {
+		return convertRedisError(err)
+	}
+	if manifest, _, err := parseRedisBlobManifest(value); err == nil && manifest != nil {
+		return ba.deleteChunks(key, manifest, manifest.getChunkCount())
+	}
+	return nil
 }
 
 func (ba *redisBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
@@ -68,25 +419,58 @@ func (ba *redisBlobAccess) FindMissing(ctx context.Context, instance string, dig
 		return nil, nil
 	}
 
-	// Execute "EXISTS" requests all in a single pipeline.
+	// Execute "EXISTS" or "EXPIRE" requests all in a single
+	// pipeline. Also obtain the start of every value, so that
+	// manifests of large blobs can be inspected.
 	pipeline := ba.redisClient.Pipeline()
-	var cmds []*redis.IntCmd
+	var keys []string
+	var keysExist []func() bool
+	var getRangeCmds []*redis.StringCmd
 	for _, digest := range digests {
 		key, err := ba.blobKeyer(instance, digest)
 		if err != nil {
 			return nil, err
 		}
-		cmds = append(cmds, pipeline.Exists(key))
+		keys = append(keys, key)
+		keysExist = append(keysExist, ba.touchKey(pipeline, key))
+		getRangeCmds = append(getRangeCmds, pipeline.GetRange(key, 0, redisBlobManifestMaxSize-1))
 	}
 	_, err := pipeline.Exec()
 	if err != nil {
-		return nil, err
+		return nil, convertRedisError(err)
 	}
 
+	// Large blobs are only present if all of their chunks are.
+	// Chunks may have been evicted by Redis independently.
+	pipeline = ba.redisClient.Pipeline()
 	var missing []*remoteexecution.Digest
-	for i, cmd := range cmds {
-		if cmd.Val() == 0 {
+	chunksExist := map[int][]func() bool{}
+	for i, exists := range keysExist {
+		if !exists() {
+			missing = append(missing, digests[i])
+			continue
+		}
+		manifest, _, err := parseRedisBlobManifest([]byte(getRangeCmds[i].Val()))
+		if err != nil {
 			missing = append(missing, digests[i])
+		} else if manifest != nil {
+			for chunk := int64(0); chunk < manifest.getChunkCount(); chunk++ {
+				chunksExist[i] = append(chunksExist[i], ba.touchKey(pipeline, manifest.getChunkKey(keys[i], chunk)))
+			}
+		}
+	}
+	if len(chunksExist) == 0 {
+		return missing, nil
+	}
+	if _, err := pipeline.Exec(); err != nil {
+		return nil, convertRedisError(err)
+	}
+	for i, chunkExists := range chunksExist {
+		for _, exists := range chunkExists {
+			if !exists() {
+				missing = append(missing, digests[i])
+				break
+			}
 		}
 	}
 	return missing, nil
@@ -0,0 +1,189 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newMiniredisBlobAccess(t *testing.T, keyTTL time.Duration) (BlobAccess, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	return NewRedisBlobAccess(client, util.KeyDigestWithoutInstance, 1000, keyTTL), s
+}
+
+// getChunkKeys returns the keys under which chunks of blobs are stored.
+func getChunkKeys(s *miniredis.Miniredis) []string {
+	var chunkKeys []string
+	for _, key := range s.Keys() {
+		if strings.HasPrefix(key, "{") {
+			chunkKeys = append(chunkKeys, key)
+		}
+	}
+	return chunkKeys
+}
+
+func TestRedisBlobAccess(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		chunks int
+	}{
+		{"Empty", nil, 0},
+		{"Small", []byte("Hello"), 0},
+		{"SingleChunk", make([]byte, 999), 0},
+		{"FullChunk", make([]byte, 1000), 1},
+		{"SingleChunkPlusOne", make([]byte, 1001), 2},
+		{"MultipleChunks", make([]byte, 4000), 4},
+		{"MultiplePipelines", make([]byte, 12345), 13},
+		{"ManifestMagic", redisBlobManifestMagic, 1},
+		{"ManifestMagicWithData", append(append([]byte(nil), redisBlobManifestMagic...), make([]byte, 1500)...), 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ba, s := newMiniredisBlobAccess(t, 0)
+			defer s.Close()
+			if !bytes.HasPrefix(test.data, redisBlobManifestMagic) {
+				rand.Read(test.data)
+			}
+			digest := util.SHA256DigestFunction.DigestFromData(test.data)
+
+			// Storing a blob twice must remove the chunks of the
+			// blob that was stored previously.
+			for i := 0; i < 2; i++ {
+				if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(test.data))); err != nil {
+					t.Fatal("Put failed: ", err)
+				}
+			}
+			if chunkKeys := getChunkKeys(s); len(chunkKeys) != test.chunks {
+				t.Fatalf("Expected %d chunks, got %d", test.chunks, len(chunkKeys))
+			}
+
+			data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+			if err != nil {
+				t.Fatal("Get failed: ", err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Fatalf("Expected %d bytes of data, got %d different bytes", len(test.data), len(data))
+			}
+			missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+			if err != nil {
+				t.Fatal("FindMissing failed: ", err)
+			}
+			if len(missing) != 0 {
+				t.Fatal("Expected blob to be present, got ", missing)
+			}
+
+			if err := ba.Delete(ctx, "default", digest); err != nil {
+				t.Fatal("Delete failed: ", err)
+			}
+			if keys := s.Keys(); len(keys) != 0 {
+				t.Fatal("Expected all keys to be removed, got ", keys)
+			}
+		})
+	}
+}
+
+func TestRedisBlobAccessEvictedChunk(t *testing.T) {
+	ctx := context.Background()
+	ba, s := newMiniredisBlobAccess(t, 0)
+	defer s.Close()
+
+	// Blobs of which Redis has evicted a chunk must be reported as
+	// missing, so that clients upload them once more.
+	blob := make([]byte, 2500)
+	rand.Read(blob)
+	digest := util.SHA256DigestFunction.DigestFromData(blob)
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(blob))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	s.Del(getChunkKeys(s)[1])
+
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 {
+		t.Fatal("Expected blob to be missing, got ", missing)
+	}
+	if _, err := ioutil.ReadAll(ba.Get(ctx, "default", digest)); status.Code(err) != codes.NotFound {
+		t.Fatal("Expected Get to fail with NotFound, got ", err)
+	}
+}
+
+func TestRedisBlobAccessSizeMismatch(t *testing.T) {
+	ctx := context.Background()
+	ba, s := newMiniredisBlobAccess(t, 0)
+	defer s.Close()
+
+	// The data of a blob may be larger than the size in its digest
+	// (e.g., when compressed). Buffers need to be grown accordingly.
+	blob := make([]byte, 2500)
+	rand.Read(blob)
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(blob))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if chunkKeys := getChunkKeys(s); len(chunkKeys) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunkKeys))
+	}
+	data, err := ioutil.ReadAll(ba.Get(ctx, "default", digest))
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Fatalf("Expected %d bytes of data, got %d different bytes", len(blob), len(data))
+	}
+}
+
+func TestRedisBlobAccessKeyTTL(t *testing.T) {
+	ctx := context.Background()
+	ba, s := newMiniredisBlobAccess(t, time.Hour)
+	defer s.Close()
+
+	blob := make([]byte, 2500)
+	digest := util.SHA256DigestFunction.DigestFromData(blob)
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewReader(blob))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+
+	// Reporting the blob as present extends the expiration time of
+	// the manifest and all chunks.
+	s.FastForward(50 * time.Minute)
+	missing, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 0 {
+		t.Fatal("Expected blob to be present, got ", missing)
+	}
+	for _, key := range s.Keys() {
+		if ttl := s.TTL(key); ttl != time.Hour {
+			t.Fatalf("Expected key %#v to expire in an hour, got %s", key, ttl)
+		}
+	}
+
+	s.FastForward(2 * time.Hour)
+	missing, err = ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+	if err != nil {
+		t.Fatal("FindMissing failed: ", err)
+	}
+	if len(missing) != 1 {
+		t.Fatal("Expected blob to be missing, got ", missing)
+	}
+}
@@ -0,0 +1,71 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type remoteActionCacheBlobAccess struct {
+	actionCacheClient remoteexecution.ActionCacheClient
+}
+
+// NewRemoteActionCacheBlobAccess creates a BlobAccess that forwards all
+// requests to the Action Cache of another Remote Execution API server,
+// such as another instance of bbb_frontend. Action results are
+// obtained and stored using the ActionCache service, meaning that the
+// other server must permit clients to store action results.
+func NewRemoteActionCacheBlobAccess(client *grpc.ClientConn) BlobAccess {
+	return &remoteActionCacheBlobAccess{
+		actionCacheClient: remoteexecution.NewActionCacheClient(client),
+	}
+}
+
+func (ba *remoteActionCacheBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	actionResult, err := ba.actionCacheClient.GetActionResult(ctx, &remoteexecution.GetActionResultRequest{
+		InstanceName: instance,
+		ActionDigest: digest,
+	})
+	if err != nil {
+		return &errorReader{err: err}
+	}
+	data, err := proto.Marshal(actionResult)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data))
+}
+
+func (ba *remoteActionCacheBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	var actionResult remoteexecution.ActionResult
+	if err := proto.Unmarshal(data, &actionResult); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Failed to unmarshal action result: %s", err)
+	}
+	_, err = ba.actionCacheClient.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+		InstanceName: instance,
+		ActionDigest: digest,
+		ActionResult: &actionResult,
+	})
+	return err
+}
+
+func (ba *remoteActionCacheBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return status.Error(codes.Unimplemented, "The Remote Execution API does not support deleting action results")
+}
+
+func (ba *remoteActionCacheBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	return nil, status.Error(codes.Unimplemented, "The Remote Execution API does not support checking for the existence of action results")
+}
@@ -0,0 +1,102 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeActionCacheServer is an ActionCache service that stores action
+// results in memory.
+type fakeActionCacheServer struct {
+	lock          sync.Mutex
+	actionResults map[string]*remoteexecution.ActionResult
+}
+
+func (s *fakeActionCacheServer) GetActionResult(ctx context.Context, in *remoteexecution.GetActionResultRequest) (*remoteexecution.ActionResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	actionResult, ok := s.actionResults[in.InstanceName+"|"+in.ActionDigest.Hash]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Action result not found")
+	}
+	return actionResult, nil
+}
+
+func (s *fakeActionCacheServer) UpdateActionResult(ctx context.Context, in *remoteexecution.UpdateActionResultRequest) (*remoteexecution.ActionResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.actionResults[in.InstanceName+"|"+in.ActionDigest.Hash] = in.ActionResult
+	return in.ActionResult, nil
+}
+
+func TestRemoteActionCacheBlobAccess(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	remoteexecution.RegisterActionCacheServer(s, &fakeActionCacheServer{
+		actionResults: map[string]*remoteexecution.ActionResult{},
+	})
+	go s.Serve(l)
+	defer s.Stop()
+	client, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ba := NewRemoteActionCacheBlobAccess(client)
+	ctx := context.Background()
+
+	present := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 123}
+	absent := &remoteexecution.Digest{Hash: "5d41402abc4b2a76b9719d911017c592", SizeBytes: 123}
+	actionResult := &remoteexecution.ActionResult{ExitCode: 1, StdoutRaw: []byte("Hello")}
+	data, err := proto.Marshal(actionResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ba.Put(ctx, "default", present, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := ba.Put(ctx, "default", absent, ioutil.NopCloser(bytes.NewBufferString("\xff"))); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("Expected storing a malformed action result to fail, got ", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		instance string
+		digest   *remoteexecution.Digest
+		code     codes.Code
+	}{
+		{"Present", "default", present, codes.OK},
+		{"AbsentDigest", "default", absent, codes.NotFound},
+		{"OtherInstance", "other", present, codes.NotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := ioutil.ReadAll(ba.Get(ctx, test.instance, test.digest))
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("Expected code %s, got %s: %v", test.code, code, err)
+			}
+			if err == nil {
+				var got remoteexecution.ActionResult
+				if err := proto.Unmarshal(data, &got); err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(&got, actionResult) {
+					t.Fatalf("Expected action result %v, got %v", actionResult, &got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/satori/go.uuid"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type remoteBlobAccess struct {
+	byteStreamClient                bytestream.ByteStreamClient
+	contentAddressableStorageClient remoteexecution.ContentAddressableStorageClient
+}
+
+// NewRemoteBlobAccess creates a BlobAccess that forwards all requests
+// to the Content Addressable Storage of another Remote Execution API
+// server, such as another instance of bbb_frontend. Blobs are
+// transferred using the ByteStream service.
+func NewRemoteBlobAccess(client *grpc.ClientConn) BlobAccess {
+	return &remoteBlobAccess{
+		byteStreamClient:                bytestream.NewByteStreamClient(client),
+		contentAddressableStorageClient: remoteexecution.NewContentAddressableStorageClient(client),
+	}
+}
+
+// getResourceNamePrefix returns the prefix of ByteStream resource
+// names, which contains the instance name if provided.
+func getResourceNamePrefix(instance string) string {
+	if instance == "" {
+		return ""
+	}
+	return instance + "/"
+}
+
+// byteStreamClientReader converts the responses of a ByteStream.Read()
+// call to a stream of bytes.
+type byteStreamClientReader struct {
+	client bytestream.ByteStream_ReadClient
+	cancel context.CancelFunc
+	data   []byte
+	err    error
+}
+
+func (r *byteStreamClientReader) Read(p []byte) (int, error) {
+	for {
+		if len(r.data) > 0 {
+			n := copy(p, r.data)
+			r.data = r.data[n:]
+			return n, nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		response, err := r.client.Recv()
+		if err != nil {
+			r.err = err
+		} else {
+			r.data = response.Data
+		}
+	}
+}
+
+func (r *byteStreamClientReader) Close() error {
+	// Terminate the call in case not all data has been read.
+	r.cancel()
+	return nil
+}
+
+func (ba *remoteBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	ctxWithCancel, cancel := context.WithCancel(ctx)
+	client, err := ba.byteStreamClient.Read(ctxWithCancel, &bytestream.ReadRequest{
+		ResourceName: fmt.Sprintf("%sblobs/%s/%d", getResourceNamePrefix(instance), digest.Hash, digest.SizeBytes),
+	})
+	if err != nil {
+		cancel()
+		return &errorReader{err: err}
+	}
+	return &byteStreamClientReader{
+		client: client,
+		cancel: cancel,
+	}
+}
+
+func (ba *remoteBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	defer r.Close()
+
+	// Cancelling the context causes the upload to be aborted in case
+	// reading the blob fails.
+	ctxWithCancel, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client, err := ba.byteStreamClient.Write(ctxWithCancel)
+	if err != nil {
+		return err
+	}
+
+	resourceName := fmt.Sprintf("%suploads/%s/blobs/%s/%d", getResourceNamePrefix(instance), uuid.NewV4(), digest.Hash, digest.SizeBytes)
+	writeOffset := int64(0)
+	for {
+		var readBuf [readChunkSize]byte
+		n, err := io.ReadFull(r, readBuf[:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		finishWrite := err != nil
+		if err := client.Send(&bytestream.WriteRequest{
+			ResourceName: resourceName,
+			WriteOffset:  writeOffset,
+			FinishWrite:  finishWrite,
+			Data:         readBuf[:n],
+		}); err != nil {
+			// The server terminated the call. The actual error
+			// is returned by CloseAndRecv().
+			break
+		}
+		if finishWrite {
+			break
+		}
+		// The resource name only needs to be provided once.
+		resourceName = ""
+		writeOffset += int64(n)
+	}
+
+	_, err = client.CloseAndRecv()
+	if err == io.EOF {
+		// Server did not provide a response.
+		return nil
+	}
+	return err
+}
+
+func (ba *remoteBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return status.Error(codes.Unimplemented, "The Remote Execution API does not support deleting blobs")
+}
+
+func (ba *remoteBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	response, err := ba.contentAddressableStorageClient.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+		InstanceName: instance,
+		BlobDigests:  digests,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.MissingBlobDigests, nil
+}
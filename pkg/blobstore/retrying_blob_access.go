@@ -0,0 +1,212 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	retryingBlobAccessRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "retrying_blob_access_retries_total",
+			Help:      "Total number of times operations against a storage backend were retried.",
+		},
+		[]string{"name", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(retryingBlobAccessRetriesTotal)
+}
+
+// isContextError returns whether an error is likely caused by the
+// caller cancelling an operation or its deadline being exceeded.
+func isContextError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// isBackendFailure returns whether an error is likely caused by a
+// transient failure of a storage backend, as opposed to the operation
+// being invalid, the blob being absent or the caller giving up.
+// Backends are responsible for converting their errors to codes that
+// are classified correctly. Errors with code UNKNOWN are not
+// considered to be failures of the backend.
+func isBackendFailure(ctx context.Context, err error) bool {
+	if err == nil || isContextError(ctx, err) {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.Aborted, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+type retryingBlobAccess struct {
+	blobAccess            BlobAccess
+	name                  string
+	maxAttempts           int
+	initialBackoff        time.Duration
+	maxBackoff            time.Duration
+	maxPutBufferSizeBytes int64
+}
+
+// NewRetryingBlobAccess creates an adapter that retries operations
+// that fail due to transient failures of the backend, using jittered
+// exponential backoff. Get() is only retried if no data has been
+// returned yet. As the data provided to Put() can only be read once,
+// Put() is only retried for blobs of at most maxPutBufferSizeBytes in
+// size, which are buffered in memory.
+func NewRetryingBlobAccess(blobAccess BlobAccess, name string, maxAttempts int, initialBackoff time.Duration, maxBackoff time.Duration, maxPutBufferSizeBytes int64) BlobAccess {
+	return &retryingBlobAccess{
+		blobAccess:            blobAccess,
+		name:                  name,
+		maxAttempts:           maxAttempts,
+		initialBackoff:        initialBackoff,
+		maxBackoff:            maxBackoff,
+		maxPutBufferSizeBytes: maxPutBufferSizeBytes,
+	}
+}
+
+// shouldRetry determines whether an operation that failed with a
+// given error should be attempted once more. If so, it waits for the
+// backoff delay to pass. Operations are not retried if the context is
+// cancelled or its deadline would be exceeded while waiting.
+func (ba *retryingBlobAccess) shouldRetry(ctx context.Context, operation string, attempt int, err error) bool {
+	if attempt >= ba.maxAttempts || !isBackendFailure(ctx, err) {
+		return false
+	}
+
+	// Full jitter, as described in "Exponential Backoff And
+	// Jitter" on the AWS Architecture Blog.
+	backoff := ba.maxBackoff
+	if attempt < 32 && ba.initialBackoff<<uint(attempt-1) < ba.maxBackoff {
+		backoff = ba.initialBackoff << uint(attempt-1)
+	}
+	delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		retryingBlobAccessRetriesTotal.WithLabelValues(ba.name, operation).Inc()
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// multiReadCloser reads data from one reader, while closing another.
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// retryingReader calls Get() on a backend once more if the first read
+// fails, as long as no data has been returned.
+type retryingReader struct {
+	io.ReadCloser
+
+	ba       *retryingBlobAccess
+	ctx      context.Context
+	instance string
+	digest   *remoteexecution.Digest
+	attempt  int
+	decided  bool
+}
+
+func (r *retryingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.ReadCloser.Read(p)
+		if r.decided || n != 0 || err == nil || err == io.EOF {
+			r.decided = true
+			return n, err
+		}
+		if !r.ba.shouldRetry(r.ctx, "Get", r.attempt, err) {
+			r.decided = true
+			return n, err
+		}
+		r.ReadCloser.Close()
+		r.ReadCloser = r.ba.blobAccess.Get(r.ctx, r.instance, r.digest)
+		r.attempt++
+	}
+}
+
+func (ba *retryingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	return &retryingReader{
+		ReadCloser: ba.blobAccess.Get(ctx, instance, digest),
+		ba:         ba,
+		ctx:        ctx,
+		instance:   instance,
+		digest:     digest,
+		attempt:    1,
+	}
+}
+
+func (ba *retryingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	if digest.SizeBytes > ba.maxPutBufferSizeBytes {
+		return ba.blobAccess.Put(ctx, instance, digest, r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, ba.maxPutBufferSizeBytes+1))
+	if err != nil {
+		r.Close()
+		return err
+	}
+	if int64(len(data)) > ba.maxPutBufferSizeBytes {
+		// The blob does not fit in the buffer after all. Forward
+		// it without retrying, leaving it up to the backend to
+		// reject data that does not match the digest.
+		return ba.blobAccess.Put(ctx, instance, digest, &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(data), r),
+			Closer: r,
+		})
+	}
+	r.Close()
+	for attempt := 1; ; attempt++ {
+		err := ba.blobAccess.Put(ctx, instance, digest, ioutil.NopCloser(bytes.NewReader(data)))
+		if err == nil || !ba.shouldRetry(ctx, "Put", attempt, err) {
+			return err
+		}
+	}
+}
+
+func (ba *retryingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	for attempt := 1; ; attempt++ {
+		err := ba.blobAccess.Delete(ctx, instance, digest)
+		if err == nil || !ba.shouldRetry(ctx, "Delete", attempt, err) {
+			return err
+		}
+	}
+}
+
+func (ba *retryingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	for attempt := 1; ; attempt++ {
+		missing, err := ba.blobAccess.FindMissing(ctx, instance, digests)
+		if err == nil || !ba.shouldRetry(ctx, "FindMissing", attempt, err) {
+			return missing, err
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scriptedBlobAccess is a backend whose operations return errors from a
+// list, one for every call. Operations succeed once the list is
+// exhausted. Calls block while release is not closed, if set.
+type scriptedBlobAccess struct {
+	lock    sync.Mutex
+	errs    []error
+	calls   int
+	putData []byte
+	release chan struct{}
+
+	// Whether Get() returns data before failing.
+	failAfterData bool
+}
+
+func (ba *scriptedBlobAccess) next() error {
+	if ba.release != nil {
+		<-ba.release
+	}
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	ba.calls++
+	if len(ba.errs) == 0 {
+		return nil
+	}
+	err := ba.errs[0]
+	ba.errs = ba.errs[1:]
+	return err
+}
+
+func (ba *scriptedBlobAccess) getCalls() int {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	return ba.calls
+}
+
+// failingAfterDataReader returns data, followed by an error.
+type failingAfterDataReader struct {
+	io.Reader
+	err error
+}
+
+func (r *failingAfterDataReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func (r *failingAfterDataReader) Close() error {
+	return nil
+}
+
+func (ba *scriptedBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	err := ba.next()
+	if err == nil {
+		return ioutil.NopCloser(strings.NewReader("Hello"))
+	}
+	if ba.failAfterData {
+		return &failingAfterDataReader{Reader: strings.NewReader("Hel"), err: err}
+	}
+	return &errorReader{err: err}
+}
+
+func (ba *scriptedBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	ba.lock.Lock()
+	ba.putData = data
+	ba.lock.Unlock()
+	return ba.next()
+}
+
+func (ba *scriptedBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return ba.next()
+}
+
+func (ba *scriptedBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	if err := ba.next(); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// callBlobAccess calls an operation on a BlobAccess by name.
+func callBlobAccess(ctx context.Context, ba BlobAccess, operation string) error {
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	switch operation {
+	case "Get":
+		r := ba.Get(ctx, "default", digest)
+		_, err := ioutil.ReadAll(r)
+		r.Close()
+		return err
+	case "Put":
+		return ba.Put(ctx, "default", digest, ioutil.NopCloser(strings.NewReader("Hello")))
+	case "Delete":
+		return ba.Delete(ctx, "default", digest)
+	default:
+		_, err := ba.FindMissing(ctx, "default", []*remoteexecution.Digest{digest})
+		return err
+	}
+}
+
+func TestRetryingBlobAccess(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "Server not reachable")
+	for _, operation := range []string{"Get", "Put", "Delete", "FindMissing"} {
+		for _, test := range []struct {
+			name  string
+			errs  []error
+			calls int
+			code  codes.Code
+		}{
+			{"Success", nil, 1, codes.OK},
+			{"RecoveredFailure", []error{unavailable, unavailable}, 3, codes.OK},
+			{"PersistentFailure", []error{unavailable, unavailable, unavailable, unavailable}, 3, codes.Unavailable},
+			{"NotFound", []error{status.Error(codes.NotFound, "Blob not found")}, 1, codes.NotFound},
+			{"InvalidArgument", []error{status.Error(codes.InvalidArgument, "Bad digest")}, 1, codes.InvalidArgument},
+			{"Canceled", []error{status.Error(codes.Canceled, "Cancelled")}, 1, codes.Canceled},
+			{"DeadlineExceeded", []error{status.Error(codes.DeadlineExceeded, "Timeout")}, 1, codes.DeadlineExceeded},
+		} {
+			t.Run(operation+test.name, func(t *testing.T) {
+				backend := &scriptedBlobAccess{errs: test.errs}
+				ba := NewRetryingBlobAccess(backend, "test", 3, time.Millisecond, 10*time.Millisecond, 1<<20)
+				err := callBlobAccess(context.Background(), ba, operation)
+				if code := status.Code(err); code != test.code {
+					t.Fatalf("Expected code %s, got %s: %v", test.code, code, err)
+				}
+				if calls := backend.getCalls(); calls != test.calls {
+					t.Fatalf("Expected %d calls, got %d", test.calls, calls)
+				}
+			})
+		}
+	}
+}
+
+func TestRetryingBlobAccessBackoff(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "Server not reachable")
+	for _, test := range []struct {
+		name           string
+		initialBackoff time.Duration
+		maxBackoff     time.Duration
+		timeout        time.Duration
+		minCalls       int
+		maxCalls       int
+	}{
+		// The backoff is bounded by the maximum, even if the
+		// initial backoff is larger.
+		{"Capped", time.Hour, time.Millisecond, time.Minute, 4, 4},
+		// Operations are not retried if the backoff delay would
+		// exceed the deadline of the caller.
+		{"ExceedingDeadline", time.Hour, time.Hour, time.Second, 1, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &scriptedBlobAccess{errs: []error{unavailable, unavailable, unavailable, unavailable}}
+			ba := NewRetryingBlobAccess(backend, "test", 4, test.initialBackoff, test.maxBackoff, 1<<20)
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			start := time.Now()
+			if err := callBlobAccess(ctx, ba, "FindMissing"); status.Code(err) != codes.Unavailable {
+				t.Fatal("Expected FindMissing to fail with Unavailable, got ", err)
+			}
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Fatal("Retrying took ", elapsed)
+			}
+			if calls := backend.getCalls(); calls < test.minCalls || calls > test.maxCalls {
+				t.Fatalf("Expected between %d and %d calls, got %d", test.minCalls, test.maxCalls, calls)
+			}
+		})
+	}
+}
+
+func TestRetryingBlobAccessGetAfterData(t *testing.T) {
+	// Get() must not be retried once data has been returned, as
+	// the caller would otherwise receive data twice.
+	backend := &scriptedBlobAccess{
+		errs:          []error{status.Error(codes.Unavailable, "Connection reset")},
+		failAfterData: true,
+	}
+	ba := NewRetryingBlobAccess(backend, "test", 3, time.Millisecond, time.Millisecond, 1<<20)
+	data, err := ioutil.ReadAll(ba.Get(context.Background(), "default", &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}))
+	if status.Code(err) != codes.Unavailable {
+		t.Fatal("Expected Get to fail with Unavailable, got ", err)
+	}
+	if string(data) != "Hel" {
+		t.Fatalf("Expected data %#v, got %#v", "Hel", string(data))
+	}
+	if calls := backend.getCalls(); calls != 1 {
+		t.Fatalf("Expected 1 call, got %d", calls)
+	}
+}
+
+func TestRetryingBlobAccessPutOversized(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "Server not reachable")
+	data := []byte("Hello world")
+	for _, test := range []struct {
+		name      string
+		sizeBytes int64
+	}{
+		// Blobs that are too large to buffer are forwarded
+		// without retrying, both if the digest indicates this up
+		// front and if the data exceeds the size in the digest.
+		{"LargeDigest", int64(len(data))},
+		{"LargeData", 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &scriptedBlobAccess{errs: []error{unavailable}}
+			ba := NewRetryingBlobAccess(backend, "test", 3, time.Millisecond, time.Millisecond, 5)
+			digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: test.sizeBytes}
+			if err := ba.Put(context.Background(), "default", digest, ioutil.NopCloser(bytes.NewReader(data))); status.Code(err) != codes.Unavailable {
+				t.Fatal("Expected Put to fail with Unavailable, got ", err)
+			}
+			if calls := backend.getCalls(); calls != 1 {
+				t.Fatalf("Expected 1 call, got %d", calls)
+			}
+			if !bytes.Equal(backend.putData, data) {
+				t.Fatalf("Expected backend to receive %#v, got %#v", string(data), string(backend.putData))
+			}
+		})
+	}
+}
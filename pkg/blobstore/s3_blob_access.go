@@ -3,9 +3,15 @@ package blobstore
 import (
 	"context"
 	"io"
+	"log"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
@@ -14,14 +20,33 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// convertS3Error converts an error returned by the S3 client to a gRPC
+// error. Errors that the S3 client would retry itself, such as
+// connection failures, throttling and server errors, are converted to
+// codes that permit retrying.
 func convertS3Error(err error) error {
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			switch awsErr.Code() {
-			case s3.ErrCodeNoSuchKey, "NotFound":
-				err = status.Errorf(codes.NotFound, awsErr.Message())
-			}
-		}
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch awsErr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return status.Error(codes.NotFound, awsErr.Message())
+	case request.CanceledErrorCode:
+		return status.Error(codes.Canceled, err.Error())
+	case "AccessDenied", "Forbidden":
+		return status.Error(codes.PermissionDenied, err.Error())
+	case "SlowDown":
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if request.IsErrorThrottle(err) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if request.IsErrorRetryable(err) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if requestFailure, ok := err.(awserr.RequestFailure); ok && requestFailure.StatusCode() >= 500 {
+		return status.Error(codes.Unavailable, err.Error())
 	}
 	return err
 }
@@ -31,14 +56,38 @@ type s3BlobAccess struct {
 	uploader   *s3manager.Uploader
 	bucketName *string
 	blobKeyer  util.DigestKeyer
+
+	findMissingConcurrency      int
+	findMissingListPrefixLength int
+	findMissingListThreshold    int
+	touchAge                    time.Duration
 }
 
-func NewS3BlobAccess(s3 *s3.S3, uploader *s3manager.Uploader, bucketName *string, blobKeyer util.DigestKeyer) BlobAccess {
+// NewS3BlobAccess creates a BlobAccess that stores blobs in an S3
+// bucket. FindMissing() checks for the existence of blobs by issuing up
+// to findMissingConcurrency HEAD requests in parallel. When
+// findMissingListPrefixLength is non-zero, batches of at least
+// findMissingListThreshold digests are processed by listing the
+// objects in the bucket instead, grouped by the first
+// findMissingListPrefixLength characters of their keys. This is
+// efficient when the bucket contains few objects per prefix compared
+// to the number of digests per prefix.
+//
+// When touchAge is non-zero, objects that are reported present by
+// FindMissing() and were last modified longer than touchAge ago are
+// copied onto themselves. This prevents lifecycle rules from expiring
+// objects while builds use them.
+func NewS3BlobAccess(s3 *s3.S3, uploader *s3manager.Uploader, bucketName *string, blobKeyer util.DigestKeyer, findMissingConcurrency int, findMissingListPrefixLength int, findMissingListThreshold int, touchAge time.Duration) BlobAccess {
 	return &s3BlobAccess{
 		s3:         s3,
 		uploader:   uploader,
 		bucketName: bucketName,
 		blobKeyer:  blobKeyer,
+
+		findMissingConcurrency:      findMissingConcurrency,
+		findMissingListPrefixLength: findMissingListPrefixLength,
+		findMissingListThreshold:    findMissingListThreshold,
+		touchAge:                    touchAge,
 	}
 }
 
@@ -71,24 +120,169 @@ func (ba *s3BlobAccess) Put(ctx context.Context, instance string, digest *remote
 	return convertS3Error(err)
 }
 
+func (ba *s3BlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	key, err := ba.blobKeyer(instance, digest)
+	if err != nil {
+		return err
+	}
+	_, err = ba.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: ba.bucketName,
+		Key:    &key,
+	})
+	return convertS3Error(err)
+}
+
+// s3MaxCopyObjectSizeBytes is the maximum size of objects that can be
+// copied using a single CopyObject request.
+const s3MaxCopyObjectSizeBytes = 5 << 30
+
+// touchIfNeeded refreshes the modification time of an object if it
+// is older than touchAge. It returns whether the object may be
+// reported present. Objects that cannot be refreshed are reported
+// missing, so that clients upload them once more.
+//
+// Objects that are too large to be copied using CopyObject are not
+// refreshed, as reporting them missing would cause them to be
+// uploaded over and over again.
+func (ba *s3BlobAccess) touchIfNeeded(ctx context.Context, key string, lastModified *time.Time, sizeBytes *int64) bool {
+	if ba.touchAge == 0 || lastModified == nil || time.Since(*lastModified) < ba.touchAge {
+		return true
+	}
+	if sizeBytes != nil && *sizeBytes > s3MaxCopyObjectSizeBytes {
+		return true
+	}
+	_, err := ba.s3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            ba.bucketName,
+		Key:               &key,
+		CopySource:        aws.String(*ba.bucketName + "/" + url.PathEscape(key)),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	if err != nil {
+		log.Printf("Failed to touch object %#v: %s", key, convertS3Error(err))
+		return false
+	}
+	return true
+}
+
+// forEachConcurrently calls a function for every element in a range,
+// running up to a given number of calls in parallel. Calls that are
+// still running are cancelled after the first failure. At least one
+// call is run at a time, regardless of the concurrency provided.
+func forEachConcurrently(ctx context.Context, concurrency int, count int, f func(ctx context.Context, i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctxWithCancel, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var firstErr error
+	for i := 0; i < count && ctxWithCancel.Err() == nil; i++ {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctxWithCancel.Done():
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			if err := f(ctxWithCancel, i); err != nil {
+				lock.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				lock.Unlock()
+			}
+			<-semaphore
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// findMissingByListing determines which blobs are present by listing
+// the objects in the bucket, grouped by prefix.
+func (ba *s3BlobAccess) findMissingByListing(ctx context.Context, keys []string, present []bool) error {
+	indicesByPrefix := map[string]map[string][]int{}
+	for i, key := range keys {
+		prefix := key
+		if len(prefix) > ba.findMissingListPrefixLength {
+			prefix = prefix[:ba.findMissingListPrefixLength]
+		}
+		if indicesByPrefix[prefix] == nil {
+			indicesByPrefix[prefix] = map[string][]int{}
+		}
+		indicesByPrefix[prefix][key] = append(indicesByPrefix[prefix][key], i)
+	}
+	var prefixes []string
+	for prefix := range indicesByPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+
+	return forEachConcurrently(ctx, ba.findMissingConcurrency, len(prefixes), func(ctx context.Context, i int) error {
+		indicesByKey := indicesByPrefix[prefixes[i]]
+		return convertS3Error(ba.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: ba.bucketName,
+			Prefix: &prefixes[i],
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				if indices, ok := indicesByKey[*object.Key]; ok && ba.touchIfNeeded(ctx, *object.Key, object.LastModified, object.Size) {
+					for _, index := range indices {
+						present[index] = true
+					}
+				}
+			}
+			return true
+		}))
+	})
+}
+
 func (ba *s3BlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
-	var missing []*remoteexecution.Digest
+	var keys []string
 	for _, digest := range digests {
 		key, err := ba.blobKeyer(instance, digest)
 		if err != nil {
 			return nil, err
 		}
-		_, err = ba.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-			Bucket: ba.bucketName,
-			Key:    &key,
-		})
-		if err != nil {
-			err = convertS3Error(err)
-			if status.Code(err) == codes.NotFound {
-				missing = append(missing, digest)
-			} else {
-				return nil, err
+		keys = append(keys, key)
+	}
+
+	present := make([]bool, len(digests))
+	if ba.findMissingListPrefixLength > 0 && len(digests) >= ba.findMissingListThreshold {
+		if err := ba.findMissingByListing(ctx, keys, present); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := forEachConcurrently(ctx, ba.findMissingConcurrency, len(keys), func(ctx context.Context, i int) error {
+			result, err := ba.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: ba.bucketName,
+				Key:    &keys[i],
+			})
+			if err != nil {
+				err = convertS3Error(err)
+				if status.Code(err) == codes.NotFound {
+					return nil
+				}
+				return err
 			}
+			present[i] = ba.touchIfNeeded(ctx, keys[i], result.LastModified, result.ContentLength)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	var missing []*remoteexecution.Digest
+	for i, digest := range digests {
+		if !present[i] {
+			missing = append(missing, digest)
 		}
 	}
 	return missing, nil
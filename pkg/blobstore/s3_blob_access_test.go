@@ -0,0 +1,477 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const fakeS3Bucket = "content-addressable-storage"
+
+type fakeS3Object struct {
+	data         []byte
+	sizeBytes    int64
+	lastModified time.Time
+}
+
+// fakeS3Server implements the subset of the S3 API that is used by
+// s3BlobAccess, keeping track of the requests that it receives.
+type fakeS3Server struct {
+	lock            sync.Mutex
+	objects         map[string]*fakeS3Object
+	heads           int
+	runningHeads    int
+	maxRunningHeads int
+	lists           []string
+	copies          []string
+	failingCopies   map[string]bool
+	headDelay       time.Duration
+}
+
+func newFakeS3Server() *fakeS3Server {
+	return &fakeS3Server{
+		objects:       map[string]*fakeS3Object{},
+		failingCopies: map[string]bool{},
+	}
+}
+
+// add stores an object, claiming it to be of a given size without
+// storing that much data.
+func (s *fakeS3Server) add(key string, sizeBytes int64, lastModified time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[key] = &fakeS3Object{
+		sizeBytes:    sizeBytes,
+		lastModified: lastModified,
+	}
+}
+
+type fakeS3ListBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3ListBucketContents
+}
+
+type fakeS3ListBucketContents struct {
+	Key          string
+	LastModified string
+	Size         int64
+}
+
+type fakeS3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+func writeFakeS3XML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(data)
+}
+
+func writeFakeS3Error(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/"+fakeS3Bucket) {
+		writeFakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+fakeS3Bucket), "/")
+
+	if key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		prefix := r.URL.Query().Get("prefix")
+		s.lock.Lock()
+		s.lists = append(s.lists, prefix)
+		result := fakeS3ListBucketResult{Name: fakeS3Bucket, Prefix: prefix}
+		for objectKey, object := range s.objects {
+			if strings.HasPrefix(objectKey, prefix) {
+				result.Contents = append(result.Contents, fakeS3ListBucketContents{
+					Key:          objectKey,
+					LastModified: object.lastModified.UTC().Format(time.RFC3339),
+					Size:         object.sizeBytes,
+				})
+			}
+		}
+		s.lock.Unlock()
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		result.KeyCount = len(result.Contents)
+		writeFakeS3XML(w, result)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		s.lock.Lock()
+		s.heads++
+		s.runningHeads++
+		if s.maxRunningHeads < s.runningHeads {
+			s.maxRunningHeads = s.runningHeads
+		}
+		s.lock.Unlock()
+		time.Sleep(s.headDelay)
+		s.lock.Lock()
+		s.runningHeads--
+		object, ok := s.objects[key]
+		s.lock.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", object.sizeBytes))
+		w.Header().Set("Last-Modified", object.lastModified.UTC().Format(http.TimeFormat))
+	case http.MethodGet:
+		s.lock.Lock()
+		object, ok := s.objects[key]
+		s.lock.Unlock()
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(object.data)
+	case http.MethodPut:
+		if copySource := r.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+			// Objects may only be copied onto themselves.
+			if source, err := url.PathUnescape(copySource); err != nil || source != fakeS3Bucket+"/"+key {
+				writeFakeS3Error(w, http.StatusBadRequest, "InvalidRequest")
+				return
+			}
+			s.lock.Lock()
+			s.copies = append(s.copies, key)
+			object, ok := s.objects[key]
+			failing := s.failingCopies[key]
+			if ok && !failing {
+				object.lastModified = time.Now()
+			}
+			s.lock.Unlock()
+			if !ok {
+				writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			} else if failing {
+				writeFakeS3Error(w, http.StatusBadRequest, "InvalidRequest")
+			} else {
+				writeFakeS3XML(w, fakeS3CopyObjectResult{
+					LastModified: time.Now().UTC().Format(time.RFC3339),
+					ETag:         "\"etag\"",
+				})
+			}
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeFakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.lock.Lock()
+		s.objects[key] = &fakeS3Object{
+			data:         data,
+			sizeBytes:    int64(len(data)),
+			lastModified: time.Now(),
+		}
+		s.lock.Unlock()
+	case http.MethodDelete:
+		s.lock.Lock()
+		delete(s.objects, key)
+		s.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func newFakeS3BlobAccess(server *httptest.Server, findMissingConcurrency int, findMissingListPrefixLength int, findMissingListThreshold int, touchAge time.Duration) BlobAccess {
+	session := session.New(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("access-key-id", "secret-access-key", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("eu-west-1"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	return NewS3BlobAccess(
+		s3.New(session),
+		s3manager.NewUploader(session),
+		aws.String(fakeS3Bucket),
+		util.KeyDigestWithoutInstance,
+		findMissingConcurrency,
+		findMissingListPrefixLength,
+		findMissingListThreshold,
+		touchAge)
+}
+
+// newFakeS3Digests returns digests whose keys start with a variety of
+// prefixes.
+func newFakeS3Digests(count int) []*remoteexecution.Digest {
+	var digests []*remoteexecution.Digest
+	for i := 0; i < count; i++ {
+		digests = append(digests, &remoteexecution.Digest{
+			Hash:      fmt.Sprintf("%02x%030x", i%4, i),
+			SizeBytes: int64(i),
+		})
+	}
+	return digests
+}
+
+func expectMissing(t *testing.T, missing []*remoteexecution.Digest, expected []*remoteexecution.Digest) {
+	if len(missing) != len(expected) {
+		t.Fatalf("Expected %d missing blobs, got %d", len(expected), len(missing))
+	}
+	for i := range expected {
+		if missing[i] != expected[i] {
+			t.Fatalf("Expected blob %d to be %s, got %s", i, expected[i].Hash, missing[i].Hash)
+		}
+	}
+}
+
+func TestForEachConcurrently(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		concurrency    int
+		maxConcurrency int
+	}{
+		{"Negative", -1, 1},
+		{"Zero", 0, 1},
+		{"Sequential", 1, 1},
+		{"Parallel", 4, 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			called := make([]bool, 20)
+			running, maxRunning := 0, 0
+			done := make(chan error, 1)
+			go func() {
+				done <- forEachConcurrently(context.Background(), test.concurrency, len(called), func(ctx context.Context, i int) error {
+					lock.Lock()
+					called[i] = true
+					running++
+					if maxRunning < running {
+						maxRunning = running
+					}
+					lock.Unlock()
+					time.Sleep(time.Millisecond)
+					lock.Lock()
+					running--
+					lock.Unlock()
+					return nil
+				})
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal("forEachConcurrently failed: ", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("forEachConcurrently did not complete")
+			}
+			for i, c := range called {
+				if !c {
+					t.Fatalf("Function was not called for element %d", i)
+				}
+			}
+			if maxRunning > test.maxConcurrency {
+				t.Fatalf("Expected at most %d concurrent calls, got %d", test.maxConcurrency, maxRunning)
+			}
+		})
+	}
+}
+
+func TestForEachConcurrentlyFailure(t *testing.T) {
+	// The first failure is returned, while calls that are still
+	// running are cancelled.
+	errFailure := errors.New("Failure")
+	err := forEachConcurrently(context.Background(), 4, 100, func(ctx context.Context, i int) error {
+		if i == 10 {
+			return errFailure
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+			return nil
+		}
+	})
+	if err != errFailure {
+		t.Fatal("Expected the failure to be returned, got ", err)
+	}
+}
+
+func TestS3BlobAccess(t *testing.T) {
+	fakeS3 := newFakeS3Server()
+	server := httptest.NewServer(fakeS3)
+	defer server.Close()
+	ba := newFakeS3BlobAccess(server, 4, 0, 0, 0)
+	ctx := context.Background()
+
+	digest := &remoteexecution.Digest{Hash: "8b1a9953c4611296a827abf8c47804d7", SizeBytes: 5}
+	if err := ba.Put(ctx, "default", digest, ioutil.NopCloser(bytes.NewBufferString("Hello"))); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	r := ba.Get(ctx, "default", digest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal("Get failed: ", err)
+	}
+	if string(data) != "Hello" {
+		t.Fatalf("Expected data %#v, got %#v", "Hello", string(data))
+	}
+
+	if err := ba.Delete(ctx, "default", digest); err != nil {
+		t.Fatal("Delete failed: ", err)
+	}
+	r = ba.Get(ctx, "default", digest)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if code := status.Code(err); code != codes.NotFound {
+		t.Fatalf("Expected code %s, got %s: %v", codes.NotFound, code, err)
+	}
+}
+
+func TestS3BlobAccessFindMissing(t *testing.T) {
+	digests := newFakeS3Digests(20)
+	var expectedMissing []*remoteexecution.Digest
+	for i, digest := range digests {
+		if i%2 != 0 {
+			expectedMissing = append(expectedMissing, digest)
+		}
+	}
+	newServer := func() (*fakeS3Server, *httptest.Server) {
+		fakeS3 := newFakeS3Server()
+		fakeS3.headDelay = 10 * time.Millisecond
+		for i, digest := range digests {
+			if i%2 == 0 {
+				key, _ := util.KeyDigestWithoutInstance("", digest)
+				fakeS3.add(key, digest.SizeBytes, time.Now())
+			}
+		}
+		return fakeS3, httptest.NewServer(fakeS3)
+	}
+
+	t.Run("Head", func(t *testing.T) {
+		// Existence of blobs is checked by sending HEAD requests
+		// concurrently.
+		fakeS3, server := newServer()
+		defer server.Close()
+		missing, err := newFakeS3BlobAccess(server, 4, 2, 100, 0).FindMissing(context.Background(), "default", digests)
+		if err != nil {
+			t.Fatal("FindMissing failed: ", err)
+		}
+		expectMissing(t, missing, expectedMissing)
+		fakeS3.lock.Lock()
+		defer fakeS3.lock.Unlock()
+		if fakeS3.heads != len(digests) || len(fakeS3.lists) != 0 {
+			t.Fatalf("Expected %d HEAD requests and no listings, got %d and %d", len(digests), fakeS3.heads, len(fakeS3.lists))
+		}
+		if fakeS3.maxRunningHeads < 2 || fakeS3.maxRunningHeads > 4 {
+			t.Fatalf("Expected between 2 and 4 concurrent HEAD requests, got %d", fakeS3.maxRunningHeads)
+		}
+	})
+
+	t.Run("Listing", func(t *testing.T) {
+		// Batches of at least the threshold are processed by
+		// listing the objects for every prefix once.
+		// Duplicate digests should be reported consistently.
+		fakeS3, server := newServer()
+		defer server.Close()
+		duplicated := append(append([]*remoteexecution.Digest(nil), digests...), digests[0], digests[1])
+		missing, err := newFakeS3BlobAccess(server, 4, 2, 20, 0).FindMissing(context.Background(), "default", duplicated)
+		if err != nil {
+			t.Fatal("FindMissing failed: ", err)
+		}
+		expectMissing(t, missing, append(append([]*remoteexecution.Digest(nil), expectedMissing...), digests[1]))
+		fakeS3.lock.Lock()
+		defer fakeS3.lock.Unlock()
+		sort.Strings(fakeS3.lists)
+		if fakeS3.heads != 0 || strings.Join(fakeS3.lists, ",") != "00,01,02,03" {
+			t.Fatalf("Expected no HEAD requests and listings of prefixes 00 to 03, got %d and %v", fakeS3.heads, fakeS3.lists)
+		}
+	})
+}
+
+func TestS3BlobAccessFindMissingTouch(t *testing.T) {
+	fresh := &remoteexecution.Digest{Hash: "00000000000000000000000000000001", SizeBytes: 1}
+	old := &remoteexecution.Digest{Hash: "00000000000000000000000000000002", SizeBytes: 2}
+	oldLarge := &remoteexecution.Digest{Hash: "00000000000000000000000000000003", SizeBytes: 6 << 30}
+	oldFailing := &remoteexecution.Digest{Hash: "00000000000000000000000000000004", SizeBytes: 4}
+	digests := []*remoteexecution.Digest{fresh, old, oldLarge, oldFailing}
+
+	for _, test := range []struct {
+		name                     string
+		findMissingListThreshold int
+	}{
+		{"Head", 100},
+		{"Listing", 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fakeS3 := newFakeS3Server()
+			server := httptest.NewServer(fakeS3)
+			defer server.Close()
+			for _, digest := range digests {
+				key, _ := util.KeyDigestWithoutInstance("", digest)
+				lastModified := time.Now().Add(-2 * time.Hour)
+				if digest == fresh {
+					lastModified = time.Now()
+				}
+				fakeS3.add(key, digest.SizeBytes, lastModified)
+			}
+			oldKey, _ := util.KeyDigestWithoutInstance("", old)
+			oldLargeKey, _ := util.KeyDigestWithoutInstance("", oldLarge)
+			oldFailingKey, _ := util.KeyDigestWithoutInstance("", oldFailing)
+			fakeS3.failingCopies[oldFailingKey] = true
+
+			// Old objects are copied onto themselves. Objects
+			// that cannot be copied are reported missing, except
+			// ones that are too large to be copied at all.
+			missing, err := newFakeS3BlobAccess(server, 4, 2, test.findMissingListThreshold, time.Hour).FindMissing(context.Background(), "default", digests)
+			if err != nil {
+				t.Fatal("FindMissing failed: ", err)
+			}
+			expectMissing(t, missing, []*remoteexecution.Digest{oldFailing})
+
+			fakeS3.lock.Lock()
+			defer fakeS3.lock.Unlock()
+			sort.Strings(fakeS3.copies)
+			if strings.Join(fakeS3.copies, ",") != oldKey+","+oldFailingKey {
+				t.Fatalf("Expected copies of %#v and %#v, got %v", oldKey, oldFailingKey, fakeS3.copies)
+			}
+			if time.Since(fakeS3.objects[oldKey].lastModified) > time.Minute {
+				t.Fatal("Modification time of old object was not refreshed")
+			}
+			if time.Since(fakeS3.objects[oldLargeKey].lastModified) < time.Hour {
+				t.Fatal("Modification time of large object was refreshed")
+			}
+		})
+	}
+}
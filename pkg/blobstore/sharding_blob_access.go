@@ -0,0 +1,135 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+type shardingBlobAccess struct {
+	backends []BlobAccess
+	weights  []uint32
+}
+
+// NewShardingBlobAccess creates an adapter that spreads blobs across
+// multiple backends. Backends are selected using weighted rendezvous
+// hashing, meaning that adding a backend only causes blobs to be moved
+// to the new backend. As backends are identified by their index,
+// backends should only be appended to the list. Backends with weight
+// zero do not receive any blobs, though at least one backend must have
+// a positive weight.
+func NewShardingBlobAccess(backends []BlobAccess, weights []uint32) (BlobAccess, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("No backends provided")
+	}
+	if len(weights) != len(backends) {
+		return nil, fmt.Errorf("%d weights provided for %d backends", len(weights), len(backends))
+	}
+	hasPositiveWeight := false
+	for _, weight := range weights {
+		if weight > 0 {
+			hasPositiveWeight = true
+		}
+	}
+	if !hasPositiveWeight {
+		return nil, fmt.Errorf("None of the backends has a positive weight")
+	}
+	return &shardingBlobAccess{
+		backends: backends,
+		weights:  weights,
+	}, nil
+}
+
+// mixHash applies the finalizer of MurmurHash3 to a hash, so that
+// small differences in input affect all bits of the output.
+func mixHash(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// getShard returns the index of the backend that stores a blob. For
+// every backend, a score is computed based on a hash of the blob's
+// digest and the backend's index. The backend with the highest score
+// is selected.
+func (ba *shardingBlobAccess) getShard(digest *remoteexecution.Digest) int {
+	bestShard := 0
+	bestScore := math.Inf(-1)
+	for shard, weight := range ba.weights {
+		if weight == 0 {
+			continue
+		}
+		hasher := fnv.New64a()
+		var shardBytes [4]byte
+		binary.LittleEndian.PutUint32(shardBytes[:], uint32(shard))
+		hasher.Write(shardBytes[:])
+		var sizeBytes [8]byte
+		binary.LittleEndian.PutUint64(sizeBytes[:], uint64(digest.SizeBytes))
+		hasher.Write(sizeBytes[:])
+		hasher.Write([]byte(digest.Hash))
+
+		// Convert the hash to a number in (0, 1) and compute the
+		// score as described in "Weighted Distributed Hash Tables"
+		// by Schindelhauer and Schomaker.
+		position := (float64(mixHash(hasher.Sum64())>>11) + 0.5) / (1 << 53)
+		score := float64(weight) / -math.Log(position)
+		if score > bestScore {
+			bestShard = shard
+			bestScore = score
+		}
+	}
+	return bestShard
+}
+
+func (ba *shardingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	return ba.backends[ba.getShard(digest)].Get(ctx, instance, digest)
+}
+
+func (ba *shardingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	return ba.backends[ba.getShard(digest)].Put(ctx, instance, digest, r)
+}
+
+func (ba *shardingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	return ba.backends[ba.getShard(digest)].Delete(ctx, instance, digest)
+}
+
+func (ba *shardingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	// Split up digests by shard.
+	digestsPerShard := map[int][]*remoteexecution.Digest{}
+	for _, digest := range digests {
+		shard := ba.getShard(digest)
+		digestsPerShard[shard] = append(digestsPerShard[shard], digest)
+	}
+
+	// Forward FindMissing() to all shards concurrently.
+	resultsChan := make(chan findMissingResults, len(digestsPerShard))
+	for shard, shardDigests := range digestsPerShard {
+		go func(blobAccess BlobAccess, shardDigests []*remoteexecution.Digest) {
+			resultsChan <- callFindMissing(blobAccess, ctx, instance, shardDigests)
+		}(ba.backends[shard], shardDigests)
+	}
+
+	// Recombine results.
+	var missing []*remoteexecution.Digest
+	var err error
+	for i := 0; i < len(digestsPerShard); i++ {
+		results := <-resultsChan
+		if results.err != nil {
+			err = results.err
+		} else {
+			missing = append(missing, results.missing...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
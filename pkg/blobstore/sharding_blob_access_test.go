@@ -0,0 +1,57 @@
+package blobstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+func TestNewShardingBlobAccess(t *testing.T) {
+	backend := NewMemoryBlobAccess(util.KeyDigestWithoutInstance, 1<<20)
+	for _, test := range []struct {
+		name     string
+		backends []BlobAccess
+		weights  []uint32
+		valid    bool
+	}{
+		{"NoBackends", nil, nil, false},
+		{"TooFewWeights", []BlobAccess{backend, backend}, []uint32{1}, false},
+		{"TooManyWeights", []BlobAccess{backend}, []uint32{1, 1}, false},
+		{"NoPositiveWeights", []BlobAccess{backend, backend}, []uint32{0, 0}, false},
+		{"Valid", []BlobAccess{backend, backend}, []uint32{1, 0}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewShardingBlobAccess(test.backends, test.weights)
+			if valid := err == nil; valid != test.valid {
+				t.Fatalf("Expected validity %v, got error %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestShardingBlobAccessDistribution(t *testing.T) {
+	before := &shardingBlobAccess{weights: []uint32{1, 1, 2, 0}}
+	after := &shardingBlobAccess{weights: []uint32{1, 1, 2, 1}}
+	counts := make([]int, 4)
+	for i := 0; i < 100000; i++ {
+		digest := &remoteexecution.Digest{Hash: fmt.Sprintf("%064x", i), SizeBytes: 5}
+		shardBefore, shardAfter := before.getShard(digest), after.getShard(digest)
+		counts[shardBefore]++
+		// Increasing the weight of a backend may only cause
+		// blobs to move to that backend.
+		if shardBefore != shardAfter && shardAfter != 3 {
+			t.Fatalf("Blob %s moved from backend %d to backend %d", digest.Hash, shardBefore, shardAfter)
+		}
+	}
+
+	// Blobs are spread proportionally to the weights of the
+	// backends. Backends with weight zero receive no blobs.
+	for shard, expected := range []int{25000, 25000, 50000, 0} {
+		if counts[shard] < expected*95/100 || counts[shard] > expected*105/100 {
+			t.Errorf("Expected backend %d to receive about %d blobs, got %d", shard, expected, counts[shard])
+		}
+	}
+}
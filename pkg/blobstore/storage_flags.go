@@ -0,0 +1,515 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/go-redis/redis"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
+
+	"google.golang.org/grpc"
+)
+
+// StorageFlags contains the command line flags that configure the
+// Content Addressable Storage and the Action Cache. They are shared by
+// all processes that access storage directly.
+type StorageFlags struct {
+	redisEndpoint           string
+	redisShardEndpoints     util.StringList
+	redisMirrorEndpoint     string
+	redisSentinelMasterName string
+	redisCluster            bool
+	redisChunkSizeBytes     int
+	redisKeyTTL             time.Duration
+
+	s3Endpoint                    string
+	s3AccessKeyID                 string
+	s3SecretAccessKey             string
+	s3Region                      string
+	s3DisableSSL                  bool
+	s3FindMissingConcurrency      int
+	s3FindMissingListPrefixLength int
+	s3FindMissingListThreshold    int
+	s3TouchAge                    time.Duration
+	s3HedgeDelay                  time.Duration
+	s3HedgePercentile             float64
+
+	cloudBucketURL              string
+	cloudFindMissingConcurrency int
+
+	retryMaxAttempts               int
+	retryInitialBackoff            time.Duration
+	retryMaxBackoff                time.Duration
+	retryMaxPutBufferSizeBytes     int64
+	circuitBreakerFailureThreshold int
+	circuitBreakerOpenDuration     time.Duration
+
+	localPath         string
+	localMaxSizeBytes int64
+
+	remoteCasEndpoint string
+
+	httpCacheEndpoint               string
+	httpCacheBasicAuth              string
+	httpCacheBearerToken            string
+	httpCacheFindMissingConcurrency int
+
+	diskCachePath string
+
+	boltPath               string
+	boltMaxSizeBytes       int64
+	boltMaxInlineSizeBytes int64
+
+	compression                  string
+	compressionAllowUncompressed bool
+	encryptionKeyFile            string
+	encryptionAllowUnencrypted   bool
+
+	localCachePath              string
+	localCacheMaxSizeBytes      int64
+	memoryCacheMaxSizeBytes     int64
+	memoryCacheMaxBlobSizeBytes int64
+}
+
+// RegisterStorageFlags registers the command line flags that configure
+// storage. Exactly one of -redis-endpoint, -local-path,
+// -remote-cas-endpoint, -http-cache-endpoint, -disk-cache-path and
+// -bolt-path needs to be provided to select a storage backend.
+func RegisterStorageFlags() *StorageFlags {
+	var sf StorageFlags
+	flag.StringVar(&sf.redisEndpoint, "redis-endpoint", "", "Redis endpoint for the Content Addressable Storage and the Action Cache. A comma separated list of endpoints may be provided in combination with -redis-cluster or -redis-sentinel-master-name")
+	flag.Var(&sf.redisShardEndpoints, "redis-shard-endpoint", "Additional Redis endpoint across which data stored in Redis is sharded, optionally followed by a weight. Example: hostname-of-redis:6379|2")
+	flag.StringVar(&sf.redisMirrorEndpoint, "redis-mirror-endpoint", "", "Optional second Redis endpoint, to which all data stored in Redis is mirrored")
+	flag.StringVar(&sf.redisSentinelMasterName, "redis-sentinel-master-name", "", "Name of the Redis master monitored by Redis Sentinel. When provided, Redis endpoints refer to Sentinel instances")
+	flag.BoolVar(&sf.redisCluster, "redis-cluster", false, "Whether Redis endpoints refer to nodes of a Redis Cluster, from which the other nodes are discovered")
+	flag.IntVar(&sf.redisChunkSizeBytes, "redis-chunk-size-bytes", 1<<20, "Size of the chunks in which large blobs are stored in Redis")
+	flag.DurationVar(&sf.redisKeyTTL, "redis-key-ttl", 0, "When non-zero, the amount of time after which data stored in Redis expires. The expiration time of blobs is extended every time they are reported present to clients")
+
+	flag.StringVar(&sf.s3Endpoint, "s3-endpoint", "", "S3 compatible object storage endpoint for Content Addressable Storage objects exceeding 1 MiB in size. When not provided, these objects are stored in Redis as well")
+	flag.StringVar(&sf.s3AccessKeyID, "s3-access-key-id", "", "Access key for the object storage")
+	flag.StringVar(&sf.s3SecretAccessKey, "s3-secret-access-key", "", "Secret key for the object storage")
+	flag.StringVar(&sf.s3Region, "s3-region", "", "Region of the object storage")
+	flag.BoolVar(&sf.s3DisableSSL, "s3-disable-ssl", false, "Whether to use HTTP for the object storage instead of HTTPS")
+	flag.IntVar(&sf.s3FindMissingConcurrency, "s3-find-missing-concurrency", 32, "Maximum number of concurrent requests issued against the object storage to check for the existence of objects")
+	flag.IntVar(&sf.s3FindMissingListPrefixLength, "s3-find-missing-list-prefix-length", 0, "When non-zero, check for the existence of large numbers of objects by listing objects by key prefix of this length, instead of requesting objects individually")
+	flag.IntVar(&sf.s3FindMissingListThreshold, "s3-find-missing-list-threshold", 1000, "Minimum number of objects for which to check for existence by listing objects")
+	flag.DurationVar(&sf.s3TouchAge, "s3-touch-age", 0, "When non-zero, objects older than this age are copied onto themselves when reported present to clients, so that lifecycle rules do not expire objects that are in use. Objects larger than 5 GiB cannot be copied and are not refreshed")
+	flag.DurationVar(&sf.s3HedgeDelay, "s3-hedge-delay", 0, "When non-zero, the amount of time after which a second request is sent to the object storage if the first request has not returned any data")
+	flag.Float64Var(&sf.s3HedgePercentile, "s3-hedge-percentile", 0, "When non-zero, send second requests to the object storage after this percentile (e.g., 0.95) of recently observed latencies, instead of after a fixed delay. Requires -s3-hedge-delay to be set, which is used until enough latencies have been observed")
+
+	flag.StringVar(&sf.cloudBucketURL, "cloud-bucket-url", "", "URL of a Google Cloud Storage (gs://), S3 (s3://) or local (file://) bucket for Content Addressable Storage objects exceeding 1 MiB in size, as an alternative to S3 with static credentials")
+	flag.IntVar(&sf.cloudFindMissingConcurrency, "cloud-find-missing-concurrency", 32, "Maximum number of concurrent requests issued against the bucket to check for the existence of objects")
+
+	flag.IntVar(&sf.retryMaxAttempts, "retry-max-attempts", 1, "Maximum number of attempts of operations against Redis, S3 and remote storage that fail due to transient errors")
+	flag.DurationVar(&sf.retryInitialBackoff, "retry-initial-backoff", 100*time.Millisecond, "Maximum delay before retrying a failed operation for the first time, doubled for every subsequent attempt")
+	flag.DurationVar(&sf.retryMaxBackoff, "retry-max-backoff", 5*time.Second, "Maximum delay before retrying a failed operation")
+	flag.Int64Var(&sf.retryMaxPutBufferSizeBytes, "retry-max-put-buffer-size-bytes", 1<<20, "Maximum size of blobs whose uploads are buffered in memory, so that they can be retried")
+	flag.IntVar(&sf.circuitBreakerFailureThreshold, "circuit-breaker-failure-threshold", 0, "When non-zero, the number of consecutive failed operations after which no further operations are sent to Redis, S3 or remote storage for some time")
+	flag.DurationVar(&sf.circuitBreakerOpenDuration, "circuit-breaker-open-duration", 10*time.Second, "Amount of time during which no operations are sent to storage after the circuit breaker is opened")
+
+	flag.StringVar(&sf.localPath, "local-path", "", "Directory in which to store the Content Addressable Storage and the Action Cache, instead of using Redis and S3")
+	flag.Int64Var(&sf.localMaxSizeBytes, "local-max-size-bytes", 10<<30, "Maximum size of the Content Addressable Storage and the Action Cache when stored locally, each")
+
+	flag.StringVar(&sf.remoteCasEndpoint, "remote-cas-endpoint", "", "Address of another Remote Execution API server (e.g., bbb_frontend) whose Content Addressable Storage and Action Cache should be used, instead of Redis, S3 or a local directory. The other server must permit storing action results (e.g., bbb_frontend with -allow-ac-updates)")
+
+	flag.StringVar(&sf.httpCacheEndpoint, "http-cache-endpoint", "", "URL of a server implementing Bazel's HTTP caching protocol (e.g., nginx or bazel-remote) that should be used to store the Content Addressable Storage and the Action Cache, instead of Redis, S3 or a local directory")
+	flag.StringVar(&sf.httpCacheBasicAuth, "http-cache-basic-auth", "", "Credentials for HTTP basic authentication against the HTTP cache. Example: username:password")
+	flag.StringVar(&sf.httpCacheBearerToken, "http-cache-bearer-token", "", "Bearer token provided to the HTTP cache")
+	flag.IntVar(&sf.httpCacheFindMissingConcurrency, "http-cache-find-missing-concurrency", 32, "Maximum number of concurrent requests issued against the HTTP cache to check for the existence of objects")
+
+	flag.StringVar(&sf.diskCachePath, "disk-cache-path", "", "Directory in which to store the Content Addressable Storage and the Action Cache using the layout of Bazel's --disk_cache flag, instead of Redis, S3 or a local directory")
+
+	flag.StringVar(&sf.boltPath, "bolt-path", "", "Directory in which to store the Content Addressable Storage and the Action Cache using an embedded bbolt database, instead of Redis, S3 or a local directory")
+	flag.Int64Var(&sf.boltMaxSizeBytes, "bolt-max-size-bytes", 10<<30, "Maximum size of the Content Addressable Storage and the Action Cache when stored using bbolt, each")
+	flag.Int64Var(&sf.boltMaxInlineSizeBytes, "bolt-max-inline-size-bytes", 1<<16, "Maximum size of blobs stored in the bbolt database itself. Larger blobs are stored as separate files")
+
+	flag.StringVar(&sf.compression, "compression", "", "Algorithm used to compress blobs stored in the Content Addressable Storage: zstd, gzip, or empty to store blobs uncompressed. Only supported when storing blobs in Redis, S3, a local directory or bbolt")
+	flag.BoolVar(&sf.compressionAllowUncompressed, "compression-allow-uncompressed", false, "Return blobs that lack a compression header as is, so that blobs stored before enabling compression remain readable. Uncompressed blobs that happen to start with a compression header are misinterpreted, meaning that this should only be enabled while migrating")
+	flag.StringVar(&sf.encryptionKeyFile, "encryption-key-file", "", "File containing keys used to encrypt blobs stored in the Content Addressable Storage, one per line. The last key is used for encryption. Example line: 2018-08|hexadecimal-aes-key. Only supported when storing blobs in Redis, S3, a local directory or bbolt")
+	flag.BoolVar(&sf.encryptionAllowUnencrypted, "encryption-allow-unencrypted", false, "Return blobs that lack an encryption header as is, so that blobs stored before enabling encryption remain readable. This permits anyone with access to storage to provide unauthenticated data, meaning that this should only be enabled while migrating")
+
+	flag.StringVar(&sf.localCachePath, "local-cache-path", "", "Directory in which to cache blobs from the Content Addressable Storage")
+	flag.Int64Var(&sf.localCacheMaxSizeBytes, "local-cache-max-size-bytes", 10<<30, "Maximum size of the local cache of the Content Addressable Storage")
+	flag.Int64Var(&sf.memoryCacheMaxSizeBytes, "memory-cache-max-size-bytes", 0, "Maximum size of the in-memory cache of small blobs in the Content Addressable Storage, or zero to disable it")
+	flag.Int64Var(&sf.memoryCacheMaxBlobSizeBytes, "memory-cache-max-blob-size-bytes", 1<<16, "Maximum size of blobs stored in the in-memory cache")
+	return &sf
+}
+
+// newHedgingBlobAccess optionally sends second requests to a backend
+// that is slow to respond.
+func (sf *StorageFlags) newHedgingBlobAccess(blobAccess BlobAccess, name string) BlobAccess {
+	if sf.s3HedgeDelay > 0 {
+		blobAccess = NewHedgingBlobAccess(blobAccess, name, sf.s3HedgeDelay, sf.s3HedgePercentile)
+	}
+	return blobAccess
+}
+
+// newFaultTolerantBlobAccess optionally retries operations against a
+// remote backend and stops sending operations to it while it fails.
+func (sf *StorageFlags) newFaultTolerantBlobAccess(blobAccess BlobAccess, name string) BlobAccess {
+	if sf.retryMaxAttempts > 1 {
+		blobAccess = NewRetryingBlobAccess(blobAccess, name, sf.retryMaxAttempts, sf.retryInitialBackoff, sf.retryMaxBackoff, sf.retryMaxPutBufferSizeBytes)
+	}
+	if sf.circuitBreakerFailureThreshold > 0 {
+		blobAccess = NewCircuitBreakingBlobAccess(blobAccess, name, sf.circuitBreakerFailureThreshold, sf.circuitBreakerOpenDuration)
+	}
+	return blobAccess
+}
+
+// NewBlobAccesses creates the Content Addressable Storage and the
+// Action Cache, as configured through the command line flags. It
+// returns an error if the flags select no storage backend, multiple
+// storage backends, or options not supported by the storage backend.
+func (sf *StorageFlags) NewBlobAccesses() (BlobAccess, BlobAccess, error) {
+	var backends []string
+	for _, backend := range []struct {
+		flag  string
+		value string
+	}{
+		{"-redis-endpoint", sf.redisEndpoint},
+		{"-local-path", sf.localPath},
+		{"-remote-cas-endpoint", sf.remoteCasEndpoint},
+		{"-http-cache-endpoint", sf.httpCacheEndpoint},
+		{"-disk-cache-path", sf.diskCachePath},
+		{"-bolt-path", sf.boltPath},
+	} {
+		if backend.value != "" {
+			backends = append(backends, backend.flag)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, nil, fmt.Errorf("No storage backend provided. One of -redis-endpoint, -local-path, -remote-cas-endpoint, -http-cache-endpoint, -disk-cache-path and -bolt-path must be provided")
+	}
+	if len(backends) > 1 {
+		return nil, nil, fmt.Errorf("Conflicting storage backends provided: %s", strings.Join(backends, ", "))
+	}
+	if sf.redisEndpoint == "" && (sf.redisMirrorEndpoint != "" || len(sf.redisShardEndpoints) > 0 || sf.redisCluster || sf.s3Endpoint != "" || sf.cloudBucketURL != "") {
+		return nil, nil, fmt.Errorf("-redis-mirror-endpoint, -redis-shard-endpoint, -redis-cluster, -s3-endpoint and -cloud-bucket-url can only be used in combination with -redis-endpoint, while %s was provided", backends[0])
+	}
+	if sf.redisCluster && sf.redisSentinelMasterName != "" {
+		return nil, nil, fmt.Errorf("-redis-cluster and -redis-sentinel-master-name cannot be used at the same time")
+	}
+	if sf.s3Endpoint != "" && sf.cloudBucketURL != "" {
+		return nil, nil, fmt.Errorf("-s3-endpoint and -cloud-bucket-url cannot be used at the same time")
+	}
+	if sf.httpCacheBasicAuth != "" && sf.httpCacheBearerToken != "" {
+		return nil, nil, fmt.Errorf("-http-cache-basic-auth and -http-cache-bearer-token cannot be used at the same time")
+	}
+	if sf.s3HedgeDelay < 0 {
+		return nil, nil, fmt.Errorf("-s3-hedge-delay cannot be negative, while %s was provided", sf.s3HedgeDelay)
+	}
+	if sf.s3HedgePercentile < 0 || sf.s3HedgePercentile > 1 {
+		return nil, nil, fmt.Errorf("-s3-hedge-percentile must be between 0 and 1, while %g was provided", sf.s3HedgePercentile)
+	}
+	if sf.s3HedgePercentile != 0 && sf.s3HedgeDelay == 0 {
+		return nil, nil, fmt.Errorf("-s3-hedge-percentile can only be used in combination with -s3-hedge-delay, which is used until enough latencies have been observed")
+	}
+	for _, concurrency := range []struct {
+		flag  string
+		value int
+	}{
+		{"-s3-find-missing-concurrency", sf.s3FindMissingConcurrency},
+		{"-cloud-find-missing-concurrency", sf.cloudFindMissingConcurrency},
+		{"-http-cache-find-missing-concurrency", sf.httpCacheFindMissingConcurrency},
+	} {
+		if concurrency.value < 1 {
+			return nil, nil, fmt.Errorf("%s must be at least 1, while %d was provided", concurrency.flag, concurrency.value)
+		}
+	}
+
+	// Blobs stored by other servers and in directories shared with
+	// Bazel must remain readable by them, meaning that they cannot
+	// be compressed or encrypted.
+	if (sf.compression != "" || sf.encryptionKeyFile != "") && (sf.remoteCasEndpoint != "" || sf.httpCacheEndpoint != "" || sf.diskCachePath != "") {
+		return nil, nil, fmt.Errorf("-compression and -encryption-key-file cannot be used in combination with %s, as the blobs stored by it need to remain readable by other software", backends[0])
+	}
+
+	var contentAddressableStorage, actionCache BlobAccess
+	switch {
+	case sf.redisEndpoint != "":
+		var err error
+		contentAddressableStorage, actionCache, err = sf.newRedisBlobAccesses()
+		if err != nil {
+			return nil, nil, err
+		}
+	case sf.localPath != "":
+		localContentAddressableStorage, err := NewLocalBlobAccess(
+			path.Join(sf.localPath, "cas"), util.KeyDigestWithoutInstance, sf.localMaxSizeBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open local Content Addressable Storage: %s", err)
+		}
+		contentAddressableStorage = NewMetricsBlobAccess(localContentAddressableStorage, "cas_local")
+		localActionCache, err := NewLocalBlobAccess(
+			path.Join(sf.localPath, "ac"), util.KeyDigestWithInstance, sf.localMaxSizeBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open local Action Cache: %s", err)
+		}
+		actionCache = NewMetricsBlobAccess(localActionCache, "ac_local")
+	case sf.remoteCasEndpoint != "":
+		// Let another server store the blobs.
+		remoteCas, err := grpc.Dial(
+			sf.remoteCasEndpoint,
+			grpc.WithInsecure(),
+			grpc.WithUnaryInterceptor(util.ChainUnaryClientInterceptors(util.TracingUnaryClientInterceptor, grpc_prometheus.UnaryClientInterceptor)),
+			grpc.WithStreamInterceptor(util.ChainStreamClientInterceptors(util.TracingStreamClientInterceptor, grpc_prometheus.StreamClientInterceptor)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to create Content Addressable Storage RPC client: %s", err)
+		}
+		contentAddressableStorage = sf.newFaultTolerantBlobAccess(
+			NewMetricsBlobAccess(NewRemoteBlobAccess(remoteCas), "cas_remote"),
+			"cas_remote")
+		actionCache = sf.newFaultTolerantBlobAccess(
+			NewMetricsBlobAccess(NewRemoteActionCacheBlobAccess(remoteCas), "ac_remote"),
+			"ac_remote")
+	case sf.httpCacheEndpoint != "":
+		// Use an existing HTTP cache to store the blobs.
+		var authorization string
+		if sf.httpCacheBasicAuth != "" {
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(sf.httpCacheBasicAuth))
+		} else if sf.httpCacheBearerToken != "" {
+			authorization = "Bearer " + sf.httpCacheBearerToken
+		}
+		contentAddressableStorage = sf.newFaultTolerantBlobAccess(
+			NewMetricsBlobAccess(
+				NewHTTPBlobAccess(http.DefaultClient, sf.httpCacheEndpoint, "cas", authorization, sf.httpCacheFindMissingConcurrency),
+				"cas_http"),
+			"cas_http")
+		actionCache = sf.newFaultTolerantBlobAccess(
+			NewMetricsBlobAccess(
+				NewHTTPBlobAccess(http.DefaultClient, sf.httpCacheEndpoint, "ac", authorization, sf.httpCacheFindMissingConcurrency),
+				"ac_http"),
+			"ac_http")
+	case sf.diskCachePath != "":
+		// Store blobs in a directory that can also be used by
+		// Bazel's --disk_cache flag.
+		diskCacheContentAddressableStorage, err := NewDiskCacheBlobAccess(sf.diskCachePath, "cas")
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open disk cache Content Addressable Storage: %s", err)
+		}
+		contentAddressableStorage = NewMetricsBlobAccess(diskCacheContentAddressableStorage, "cas_disk_cache")
+		diskCacheActionCache, err := NewDiskCacheBlobAccess(sf.diskCachePath, "ac")
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open disk cache Action Cache: %s", err)
+		}
+		actionCache = NewMetricsBlobAccess(diskCacheActionCache, "ac_disk_cache")
+	case sf.boltPath != "":
+		// Store blobs in an embedded key-value store.
+		boltContentAddressableStorage, err := NewBoltBlobAccess(
+			path.Join(sf.boltPath, "cas"), util.KeyDigestWithoutInstance, sf.boltMaxSizeBytes, sf.boltMaxInlineSizeBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open bbolt Content Addressable Storage: %s", err)
+		}
+		contentAddressableStorage = NewMetricsBlobAccess(boltContentAddressableStorage, "cas_bolt")
+		boltActionCache, err := NewBoltBlobAccess(
+			path.Join(sf.boltPath, "ac"), util.KeyDigestWithInstance, sf.boltMaxSizeBytes, sf.boltMaxInlineSizeBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open bbolt Action Cache: %s", err)
+		}
+		actionCache = NewMetricsBlobAccess(boltActionCache, "ac_bolt")
+	}
+
+	// Optional encryption of blobs. Blobs are compressed before
+	// being encrypted, as encrypted data cannot be compressed.
+	if sf.encryptionKeyFile != "" {
+		encryptionKeys, err := ReadEncryptionKeyFile(sf.encryptionKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read encryption keys: %s", err)
+		}
+		contentAddressableStorage, err = NewEncryptingBlobAccess(contentAddressableStorage, encryptionKeys, sf.encryptionAllowUnencrypted)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to create encrypting storage: %s", err)
+		}
+	}
+
+	// Optional compression of blobs. Blobs stored in caches are kept
+	// uncompressed to reduce the amount of CPU time spent.
+	switch sf.compression {
+	case "":
+	case "zstd":
+		contentAddressableStorage = NewCompressingBlobAccess(contentAddressableStorage, CompressionAlgorithmZstd, sf.compressionAllowUncompressed)
+	case "gzip":
+		contentAddressableStorage = NewCompressingBlobAccess(contentAddressableStorage, CompressionAlgorithmGzip, sf.compressionAllowUncompressed)
+	default:
+		return nil, nil, fmt.Errorf("Unknown compression algorithm: %s", sf.compression)
+	}
+
+	// Optional caching of blobs in faster storage tiers.
+	if sf.localCachePath != "" {
+		localCache, err := NewLocalBlobAccess(sf.localCachePath, util.KeyDigestWithoutInstance, sf.localCacheMaxSizeBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open local cache: %s", err)
+		}
+		contentAddressableStorage = NewReadCachingBlobAccess(
+			NewMetricsBlobAccess(localCache, "cas_local_cache"),
+			contentAddressableStorage,
+			false)
+	}
+	if sf.memoryCacheMaxSizeBytes > 0 {
+		contentAddressableStorage = NewSizeDistinguishingBlobAccess(
+			NewReadCachingBlobAccess(
+				NewMetricsBlobAccess(
+					NewMemoryBlobAccess(util.KeyDigestWithoutInstance, sf.memoryCacheMaxSizeBytes),
+					"cas_memory_cache"),
+				contentAddressableStorage,
+				false),
+			contentAddressableStorage,
+			sf.memoryCacheMaxBlobSizeBytes)
+	}
+
+	// Let concurrent requests for the same blob share a single
+	// request against storage.
+	contentAddressableStorage = NewDeduplicatingBlobAccess(contentAddressableStorage, util.KeyDigestWithoutInstance)
+	return contentAddressableStorage, actionCache, nil
+}
+
+// newRedisBlobAccesses creates the Content Addressable Storage and the
+// Action Cache backed by Redis, optionally storing large blobs in the
+// Content Addressable Storage in S3 or a bucket.
+func (sf *StorageFlags) newRedisBlobAccesses() (BlobAccess, BlobAccess, error) {
+	redisEndpoints := []string{sf.redisEndpoint}
+	redisWeights := []uint32{1}
+	for _, redisShardEntry := range sf.redisShardEndpoints {
+		components := strings.SplitN(redisShardEntry, "|", 2)
+		weight := uint64(1)
+		if len(components) == 2 {
+			var err error
+			weight, err = strconv.ParseUint(components[1], 10, 32)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid Redis shard weight: %s", redisShardEntry)
+			}
+		}
+		redisEndpoints = append(redisEndpoints, components[0])
+		redisWeights = append(redisWeights, uint32(weight))
+	}
+	if !sf.redisCluster && sf.redisSentinelMasterName == "" {
+		for _, endpoint := range append(redisEndpoints, sf.redisMirrorEndpoint) {
+			if strings.Contains(endpoint, ",") {
+				return nil, nil, fmt.Errorf("Redis endpoint %#v consists of multiple addresses, which requires -redis-cluster or -redis-sentinel-master-name", endpoint)
+			}
+		}
+	}
+
+	// Redis Cluster does not support multiple databases, meaning
+	// that the database number is ignored. Keys of the Content
+	// Addressable Storage and the Action Cache do not overlap, so
+	// that they may share a single database.
+	newRedisClient := func(endpoint string, db int) redis.Cmdable {
+		if sf.redisCluster {
+			return redis.NewClusterClient(
+				&redis.ClusterOptions{
+					Addrs: strings.Split(endpoint, ","),
+				})
+		}
+		return redis.NewUniversalClient(
+			&redis.UniversalOptions{
+				Addrs:      strings.Split(endpoint, ","),
+				MasterName: sf.redisSentinelMasterName,
+				DB:         db,
+			})
+	}
+	newRedisBlobAccess := func(db int, blobKeyer util.DigestKeyer) (BlobAccess, error) {
+		var shards []BlobAccess
+		for _, endpoint := range redisEndpoints {
+			shards = append(shards, NewRedisBlobAccess(
+				newRedisClient(endpoint, db),
+				blobKeyer,
+				sf.redisChunkSizeBytes,
+				sf.redisKeyTTL))
+		}
+		blobAccess := shards[0]
+		if len(shards) > 1 {
+			var err error
+			blobAccess, err = NewShardingBlobAccess(shards, redisWeights)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create sharded Redis storage: %s", err)
+			}
+		}
+		if sf.redisMirrorEndpoint != "" {
+			blobAccess = NewMirroredBlobAccess(
+				blobAccess,
+				NewRedisBlobAccess(
+					newRedisClient(sf.redisMirrorEndpoint, db),
+					blobKeyer,
+					sf.redisChunkSizeBytes,
+					sf.redisKeyTTL))
+		}
+		return blobAccess, nil
+	}
+
+	redisContentAddressableStorage, err := newRedisBlobAccess(0, util.KeyDigestWithoutInstance)
+	if err != nil {
+		return nil, nil, err
+	}
+	contentAddressableStorage := sf.newFaultTolerantBlobAccess(
+		NewMetricsBlobAccess(redisContentAddressableStorage, "cas_redis"),
+		"cas_redis")
+	if sf.s3Endpoint != "" {
+		// Create an S3 client. Set the uploader concurrency to 1 to
+		// drastically reduce memory usage.
+		session := session.New(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials(sf.s3AccessKeyID, sf.s3SecretAccessKey, ""),
+			Endpoint:         aws.String(sf.s3Endpoint),
+			Region:           aws.String(sf.s3Region),
+			DisableSSL:       aws.Bool(sf.s3DisableSSL),
+			S3ForcePathStyle: aws.Bool(true),
+		})
+		uploader := s3manager.NewUploader(session)
+		uploader.Concurrency = 1
+		contentAddressableStorage = NewSizeDistinguishingBlobAccess(
+			contentAddressableStorage,
+			sf.newFaultTolerantBlobAccess(
+				sf.newHedgingBlobAccess(
+					NewMetricsBlobAccess(
+						NewS3BlobAccess(
+							s3.New(session),
+							uploader,
+							aws.String("content-addressable-storage"),
+							util.KeyDigestWithoutInstance,
+							sf.s3FindMissingConcurrency,
+							sf.s3FindMissingListPrefixLength,
+							sf.s3FindMissingListThreshold,
+							sf.s3TouchAge),
+						"cas_s3"),
+					"cas_s3"),
+				"cas_s3"),
+			1<<20)
+	} else if sf.cloudBucketURL != "" {
+		bucket, localDirectory, err := OpenCloudBucket(context.Background(), sf.cloudBucketURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to open bucket: %s", err)
+		}
+		contentAddressableStorage = NewSizeDistinguishingBlobAccess(
+			contentAddressableStorage,
+			sf.newFaultTolerantBlobAccess(
+				NewMetricsBlobAccess(
+					NewCloudBlobAccess(
+						bucket,
+						localDirectory,
+						util.KeyDigestWithoutInstance,
+						sf.cloudFindMissingConcurrency),
+					"cas_cloud"),
+				"cas_cloud"),
+			1<<20)
+	}
+	redisActionCache, err := newRedisBlobAccess(1, util.KeyDigestWithInstance)
+	if err != nil {
+		return nil, nil, err
+	}
+	actionCache := sf.newFaultTolerantBlobAccess(
+		NewMetricsBlobAccess(redisActionCache, "ac_redis"),
+		"ac_redis")
+	return contentAddressableStorage, actionCache, nil
+}
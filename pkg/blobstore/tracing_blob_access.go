@@ -0,0 +1,102 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"go.opencensus.io/trace"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+type tracingBlobAccess struct {
+	blobAccess BlobAccess
+	name       string
+}
+
+// NewTracingBlobAccess creates an adapter that creates an OpenCensus span
+// for every operation performed against a backend. The span of
+// Get() ends once the blob has been read entirely, reading fails or the
+// reader is closed.
+func NewTracingBlobAccess(blobAccess BlobAccess, name string) BlobAccess {
+	return &tracingBlobAccess{
+		blobAccess: blobAccess,
+		name:       name,
+	}
+}
+
+func (ba *tracingBlobAccess) start(ctx context.Context, operation string, instance string, attributes ...trace.Attribute) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, "BlobAccess."+operation)
+	span.AddAttributes(
+		trace.StringAttribute("blobstore.name", ba.name),
+		trace.StringAttribute("blobstore.instance", instance))
+	span.AddAttributes(attributes...)
+	return ctx, span
+}
+
+func digestAttributes(digest *remoteexecution.Digest) []trace.Attribute {
+	return []trace.Attribute{
+		trace.StringAttribute("blobstore.digest.hash", digest.Hash),
+		trace.Int64Attribute("blobstore.digest.size_bytes", digest.SizeBytes),
+	}
+}
+
+type tracingReader struct {
+	io.ReadCloser
+
+	span  *trace.Span
+	ended bool
+}
+
+func (r *tracingReader) end(err error) {
+	if !r.ended {
+		r.ended = true
+		util.EndSpan(r.span, err)
+	}
+}
+
+func (r *tracingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.end(nil)
+	} else if err != nil {
+		r.end(err)
+	}
+	return n, err
+}
+
+func (r *tracingReader) Close() error {
+	r.end(nil)
+	return r.ReadCloser.Close()
+}
+
+func (ba *tracingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	ctx, span := ba.start(ctx, "Get", instance, digestAttributes(digest)...)
+	return &tracingReader{
+		ReadCloser: ba.blobAccess.Get(ctx, instance, digest),
+		span:       span,
+	}
+}
+
+func (ba *tracingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, r io.ReadCloser) error {
+	ctx, span := ba.start(ctx, "Put", instance, digestAttributes(digest)...)
+	err := ba.blobAccess.Put(ctx, instance, digest, r)
+	util.EndSpan(span, err)
+	return err
+}
+
+func (ba *tracingBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	ctx, span := ba.start(ctx, "Delete", instance, digestAttributes(digest)...)
+	err := ba.blobAccess.Delete(ctx, instance, digest)
+	util.EndSpan(span, err)
+	return err
+}
+
+func (ba *tracingBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	ctx, span := ba.start(ctx, "FindMissing", instance, trace.Int64Attribute("blobstore.digests", int64(len(digests))))
+	missing, err := ba.blobAccess.FindMissing(ctx, instance, digests)
+	span.AddAttributes(trace.Int64Attribute("blobstore.missing", int64(len(missing))))
+	util.EndSpan(span, err)
+	return missing, err
+}
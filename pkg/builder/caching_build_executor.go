@@ -11,21 +11,23 @@ import (
 )
 
 type cachingBuildExecutor struct {
-	base        BuildExecutor
-	actionCache ac.ActionCache
+	base                   BuildExecutor
+	actionCache            ac.ActionCache
+	digestFunctionSelector util.DigestFunctionSelector
 }
 
-func NewCachingBuildExecutor(base BuildExecutor, actionCache ac.ActionCache) BuildExecutor {
+func NewCachingBuildExecutor(base BuildExecutor, actionCache ac.ActionCache, digestFunctionSelector util.DigestFunctionSelector) BuildExecutor {
 	return &cachingBuildExecutor{
-		base:        base,
-		actionCache: actionCache,
+		base:                   base,
+		actionCache:            actionCache,
+		digestFunctionSelector: digestFunctionSelector,
 	}
 }
 
 func (be *cachingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) *remoteexecution.ExecuteResponse {
 	response := be.base.Execute(ctx, request)
 	if !request.Action.DoNotCache && status.ErrorProto(response.Status) == nil && response.Result.ExitCode == 0 {
-		digest, err := util.DigestFromMessage(request.Action)
+		digest, err := be.digestFunctionSelector(request.InstanceName).DigestFromMessage(request.Action)
 		if err != nil {
 			return convertErrorToExecuteResponse(err)
 		}
@@ -15,6 +15,7 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opencensus.io/trace"
 
 	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
 )
@@ -52,11 +53,13 @@ func joinPathSafe(elem ...string) (string, error) {
 
 type localBuildExecutor struct {
 	contentAddressableStorage cas.ContentAddressableStorage
+	digestFunctionSelector    util.DigestFunctionSelector
 }
 
-func NewLocalBuildExecutor(contentAddressableStorage cas.ContentAddressableStorage) BuildExecutor {
+func NewLocalBuildExecutor(contentAddressableStorage cas.ContentAddressableStorage, digestFunctionSelector util.DigestFunctionSelector) BuildExecutor {
 	return &localBuildExecutor{
 		contentAddressableStorage: contentAddressableStorage,
+		digestFunctionSelector:    digestFunctionSelector,
 	}
 }
 
@@ -186,7 +189,7 @@ func (be *localBuildExecutor) uploadDirectory(ctx context.Context, instance stri
 			if err != nil {
 				return nil, err
 			}
-			digest, err := util.DigestFromMessage(child)
+			digest, err := be.digestFunctionSelector(instance).DigestFromMessage(child)
 			if err != nil {
 				return nil, err
 			}
@@ -222,7 +225,10 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 	timeStart := time.Now()
 
 	// Set up inputs.
-	if err := be.prepareFilesystem(ctx, request); err != nil {
+	ctxPrepareFilesystem, span := trace.StartSpan(ctx, "prepare_filesystem")
+	err := be.prepareFilesystem(ctxPrepareFilesystem, request)
+	util.EndSpan(span, err)
+	if err != nil {
 		return convertErrorToExecuteResponse(err)
 	}
 	timeAfterPrepareFilesytem := time.Now()
@@ -231,19 +237,26 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 
 	// Invoke command.
 	exitCode := 0
-	if err := be.runCommand(ctx, request); err != nil {
+	ctxRunCommand, span := trace.StartSpan(ctx, "run_command")
+	err = be.runCommand(ctxRunCommand, request)
+	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			waitStatus := exitError.Sys().(syscall.WaitStatus)
 			exitCode = waitStatus.ExitStatus()
 		} else {
+			util.EndSpan(span, err)
 			return convertErrorToExecuteResponse(err)
 		}
 	}
+	span.AddAttributes(trace.Int64Attribute("exit_code", int64(exitCode)))
+	span.End()
 	timeAfterRunCommand := time.Now()
 	localBuildExecutorDurationSeconds.WithLabelValues("run_command").Observe(
 		timeAfterRunCommand.Sub(timeAfterPrepareFilesytem).Seconds())
 
 	// Upload command output.
+	ctx, span = trace.StartSpan(ctx, "upload_output")
+	defer span.End()
 	stdoutDigest, _, err := be.contentAddressableStorage.PutFile(ctx, request.InstanceName, pathStdout)
 	if err != nil {
 		return convertErrorToExecuteResponse(err)
@@ -4,11 +4,14 @@ import (
 	"context"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/satori/go.uuid"
+	"go.opencensus.io/trace"
 
 	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
 	"google.golang.org/genproto/googleapis/longrunning"
@@ -17,11 +20,27 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+var (
+	workerBuildQueueQueuedActions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "worker_build_queue_queued_actions",
+			Help:      "Number of actions that are queued for execution.",
+		},
+		[]string{"instance"})
+)
+
+func init() {
+	prometheus.MustRegister(workerBuildQueueQueuedActions)
+}
+
 type workerBuildJob struct {
 	name             string
 	actionDigest     *remoteexecution.Digest
 	deduplicationKey string
 	executeRequest   remoteexecution.ExecuteRequest
+	traceContext     map[string]string
 
 	stage                   remoteexecution.ExecuteOperationMetadata_Stage
 	executeResponse         *remoteexecution.ExecuteResponse
@@ -60,30 +79,36 @@ func (job *workerBuildJob) waitForTransition() {
 }
 
 type WorkerBuildQueue struct {
-	deduplicationKeyer util.DigestKeyer
-	jobsPendingMax     uint
+	deduplicationKeyer     util.DigestKeyer
+	digestFunctionSelector util.DigestFunctionSelector
+	jobsPendingMax         uint
+	quotaSelector          util.QuotaSelector
 
 	jobsLock                   sync.Mutex
 	jobsNameMap                map[string]*workerBuildJob
 	jobsDeduplicationMap       map[string]*workerBuildJob
 	jobsPending                []*workerBuildJob
+	jobsPendingPerInstance     map[string]int
 	jobsPendingInsertionWakeup *sync.Cond
 }
 
-func NewWorkerBuildQueue(deduplicationKeyer util.DigestKeyer, jobsPendingMax uint) *WorkerBuildQueue {
+func NewWorkerBuildQueue(deduplicationKeyer util.DigestKeyer, digestFunctionSelector util.DigestFunctionSelector, jobsPendingMax uint, quotaSelector util.QuotaSelector) *WorkerBuildQueue {
 	bq := &WorkerBuildQueue{
-		deduplicationKeyer: deduplicationKeyer,
-		jobsPendingMax:     jobsPendingMax,
-
-		jobsNameMap:          map[string]*workerBuildJob{},
-		jobsDeduplicationMap: map[string]*workerBuildJob{},
+		deduplicationKeyer:     deduplicationKeyer,
+		digestFunctionSelector: digestFunctionSelector,
+		jobsPendingMax:         jobsPendingMax,
+		quotaSelector:          quotaSelector,
+
+		jobsNameMap:            map[string]*workerBuildJob{},
+		jobsDeduplicationMap:   map[string]*workerBuildJob{},
+		jobsPendingPerInstance: map[string]int{},
 	}
 	bq.jobsPendingInsertionWakeup = sync.NewCond(&bq.jobsLock)
 	return bq
 }
 
 func (bq *WorkerBuildQueue) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*longrunning.Operation, error) {
-	actionDigest, err := util.DigestFromMessage(request.Action)
+	actionDigest, err := bq.digestFunctionSelector(request.InstanceName).DigestFromMessage(request.Action)
 	if err != nil {
 		return nil, err
 	}
@@ -101,18 +126,24 @@ func (bq *WorkerBuildQueue) Execute(ctx context.Context, request *remoteexecutio
 		if uint(len(bq.jobsPending)) >= bq.jobsPendingMax {
 			return nil, status.Errorf(codes.Unavailable, "Too many jobs pending")
 		}
+		if maxQueuedActions := bq.quotaSelector(request.InstanceName).MaxQueuedActions; maxQueuedActions > 0 && bq.jobsPendingPerInstance[request.InstanceName] >= maxQueuedActions {
+			return nil, util.NewQuotaExceededError(time.Second, "Exceeded the maximum number of queued actions of instance %#v", request.InstanceName)
+		}
 
 		job = &workerBuildJob{
 			name:             uuid.NewV4().String(),
 			actionDigest:     actionDigest,
 			deduplicationKey: deduplicationKey,
 			executeRequest:   *request,
+			traceContext:     util.InjectTraceContext(ctx),
 			stage:            remoteexecution.ExecuteOperationMetadata_QUEUED,
 			executeTransitionWakeup: sync.NewCond(&bq.jobsLock),
 		}
 		bq.jobsNameMap[job.name] = job
 		bq.jobsDeduplicationMap[deduplicationKey] = job
 		bq.jobsPending = append(bq.jobsPending, job)
+		bq.jobsPendingPerInstance[request.InstanceName]++
+		workerBuildQueueQueuedActions.WithLabelValues(request.InstanceName).Inc()
 		bq.jobsPendingInsertionWakeup.Signal()
 	}
 	return job.getCurrentState(), nil
@@ -150,15 +181,25 @@ func (bq *WorkerBuildQueue) Watch(in *watcher.Request, out watcher.Watcher_Watch
 	}
 }
 
-func executeOnWorker(stream scheduler.Scheduler_GetWorkServer, request *remoteexecution.ExecuteRequest) *remoteexecution.ExecuteResponse {
+func executeOnWorker(stream scheduler.Scheduler_GetWorkServer, job *workerBuildJob) *remoteexecution.ExecuteResponse {
+	// Continue the trace of the client that requested execution.
+	ctx, span := util.StartSpanWithTraceContext(stream.Context(), "WorkerBuildQueue.executeOnWorker", job.traceContext)
+	span.AddAttributes(trace.StringAttribute("operation", job.name))
+
 	// TODO(edsch): Any way we can set a timeout here?
-	if err := stream.Send(request); err != nil {
+	if err := stream.Send(&scheduler.WorkRequest{
+		ExecuteRequest: &job.executeRequest,
+		TraceContext:   util.InjectTraceContext(ctx),
+	}); err != nil {
+		util.EndSpan(span, err)
 		return convertErrorToExecuteResponse(err)
 	}
 	response, err := stream.Recv()
 	if err != nil {
+		util.EndSpan(span, err)
 		return convertErrorToExecuteResponse(err)
 	}
+	span.End()
 	return response
 }
 
@@ -181,11 +222,17 @@ func (bq *WorkerBuildQueue) GetWork(stream scheduler.Scheduler_GetWorkServer) er
 		// Extract job from queue.
 		job := bq.jobsPending[0]
 		bq.jobsPending = bq.jobsPending[1:]
+		instance := job.executeRequest.InstanceName
+		bq.jobsPendingPerInstance[instance]--
+		if bq.jobsPendingPerInstance[instance] == 0 {
+			delete(bq.jobsPendingPerInstance, instance)
+		}
+		workerBuildQueueQueuedActions.WithLabelValues(instance).Dec()
 		job.stage = remoteexecution.ExecuteOperationMetadata_EXECUTING
 
 		// Perform execution of the job.
 		bq.jobsLock.Unlock()
-		executeResponse := executeOnWorker(stream, &job.executeRequest)
+		executeResponse := executeOnWorker(stream, job)
 		bq.jobsLock.Lock()
 
 		// Mark completion.
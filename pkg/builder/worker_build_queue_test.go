@@ -0,0 +1,106 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// blockingGetWorkServer is a worker that reports the jobs it receives,
+// but never completes them.
+type blockingGetWorkServer struct {
+	grpc.ServerStream
+
+	ctx      context.Context
+	requests chan *scheduler.WorkRequest
+}
+
+func (s *blockingGetWorkServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *blockingGetWorkServer) Send(request *scheduler.WorkRequest) error {
+	s.requests <- request
+	return nil
+}
+
+func (s *blockingGetWorkServer) Recv() (*remoteexecution.ExecuteResponse, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func executeCommand(bq *WorkerBuildQueue, instance string, command string) error {
+	_, err := bq.Execute(context.Background(), &remoteexecution.ExecuteRequest{
+		InstanceName: instance,
+		Action: &remoteexecution.Action{
+			CommandDigest: util.SHA256DigestFunction.DigestFromData([]byte(command)),
+		},
+	})
+	return err
+}
+
+func TestWorkerBuildQueueMaxQueuedActions(t *testing.T) {
+	digestFunctionSelector := util.NewDigestFunctionSelector(util.SHA256DigestFunction, nil)
+	quotaSelector, err := util.ParseQuotaSelector("", []string{"limited|max-queued-actions=2"}, util.SchedulerQuotaKeys)
+	if err != nil {
+		t.Fatal("ParseQuotaSelector failed: ", err)
+	}
+	bq := NewWorkerBuildQueue(util.KeyDigestWithInstance, digestFunctionSelector, 16, quotaSelector)
+
+	for _, command := range []string{"a", "b"} {
+		if err := executeCommand(bq, "limited", command); err != nil {
+			t.Fatal("Execute failed: ", err)
+		}
+	}
+
+	// The queue of the instance is full. Actions that are already
+	// queued can still be deduplicated against.
+	err = executeCommand(bq, "limited", "c")
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("Expected code %s, got %s: %v", codes.ResourceExhausted, code, err)
+	}
+	if err := executeCommand(bq, "limited", "a"); err != nil {
+		t.Fatal("Execute failed: ", err)
+	}
+
+	// Other instances are not affected.
+	for _, command := range []string{"a", "b", "c"} {
+		if err := executeCommand(bq, "other", command); err != nil {
+			t.Fatal("Execute failed: ", err)
+		}
+	}
+
+	// Actions that are being executed no longer count towards the
+	// limit, as they are no longer queued.
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &blockingGetWorkServer{
+		ctx:      ctx,
+		requests: make(chan *scheduler.WorkRequest),
+	}
+	done := make(chan error)
+	go func() {
+		done <- bq.GetWork(stream)
+	}()
+	if request := <-stream.requests; request.ExecuteRequest.InstanceName != "limited" {
+		t.Fatalf("Expected worker to receive an action of instance %#v, got %#v", "limited", request.ExecuteRequest.InstanceName)
+	}
+	if err := executeCommand(bq, "limited", "c"); err != nil {
+		t.Fatal("Execute failed: ", err)
+	}
+	err = executeCommand(bq, "limited", "d")
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("Expected code %s, got %s: %v", codes.ResourceExhausted, code, err)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected GetWork to fail with %v, got %v", context.Canceled, err)
+	}
+}
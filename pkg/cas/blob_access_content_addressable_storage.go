@@ -3,7 +3,6 @@ package cas
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
@@ -17,12 +16,14 @@ import (
 )
 
 type blobAccessContentAddressableStorage struct {
-	blobAccess blobstore.BlobAccess
+	blobAccess             blobstore.BlobAccess
+	digestFunctionSelector util.DigestFunctionSelector
 }
 
-func NewBlobAccessContentAddressableStorage(blobAccess blobstore.BlobAccess) ContentAddressableStorage {
+func NewBlobAccessContentAddressableStorage(blobAccess blobstore.BlobAccess, digestFunctionSelector util.DigestFunctionSelector) ContentAddressableStorage {
 	return &blobAccessContentAddressableStorage{
-		blobAccess: blobAccess,
+		blobAccess:             blobAccess,
+		digestFunctionSelector: digestFunctionSelector,
 	}
 }
 
@@ -90,7 +91,7 @@ func (cas *blobAccessContentAddressableStorage) PutFile(ctx context.Context, ins
 	}
 
 	// Walk through the file to compute the digest.
-	hasher := sha256.New()
+	hasher := cas.digestFunctionSelector(instance).NewHasher()
 	if _, err := io.Copy(hasher, file); err != nil {
 		file.Close()
 		return nil, false, err
@@ -116,7 +117,7 @@ func (cas *blobAccessContentAddressableStorage) PutTree(ctx context.Context, ins
 	if err != nil {
 		return nil, err
 	}
-	digest := util.DigestFromData(data)
+	digest := cas.digestFunctionSelector(instance).DigestFromData(data)
 	if err := cas.blobAccess.Put(ctx, instance, digest, ioutil.NopCloser(bytes.NewBuffer(data))); err != nil {
 		return nil, err
 	}
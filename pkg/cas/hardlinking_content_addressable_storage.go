@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 
@@ -19,9 +20,11 @@ type hardlinkingContentAddressableStorage struct {
 	maxFiles    int
 	maxSize     int64
 
+	lock                  sync.Mutex
 	filesPresentList      []string
 	filesPresentSize      map[string]int64
 	filesPresentTotalSize int64
+	fetches               util.CallDeduplicator
 }
 
 func NewHardlinkingContentAddressableStorage(base ContentAddressableStorage, digestKeyer util.DigestKeyer, path string, maxFiles int, maxSize int64) ContentAddressableStorage {
@@ -56,6 +59,35 @@ func (cas *hardlinkingContentAddressableStorage) makeSpace(size int64) error {
 	return nil
 }
 
+// fetchFile downloads a file into the cache directory. Space for the
+// file is reserved up front, so that concurrent downloads of other
+// files do not cause the cache to exceed its maximum size.
+func (cas *hardlinkingContentAddressableStorage) fetchFile(ctx context.Context, instance string, digest *remoteexecution.Digest, key string, cachePath string, isExecutable bool) error {
+	cas.lock.Lock()
+	if _, ok := cas.filesPresentSize[key]; ok {
+		cas.lock.Unlock()
+		return nil
+	}
+	if err := cas.makeSpace(digest.SizeBytes); err != nil {
+		cas.lock.Unlock()
+		return err
+	}
+	cas.filesPresentTotalSize += digest.SizeBytes
+	cas.lock.Unlock()
+
+	err := cas.ContentAddressableStorage.GetFile(ctx, instance, digest, cachePath, isExecutable)
+
+	cas.lock.Lock()
+	defer cas.lock.Unlock()
+	if err != nil {
+		cas.filesPresentTotalSize -= digest.SizeBytes
+		return err
+	}
+	cas.filesPresentList = append(cas.filesPresentList, key)
+	cas.filesPresentSize[key] = digest.SizeBytes
+	return nil
+}
+
 func (cas *hardlinkingContentAddressableStorage) GetFile(ctx context.Context, instance string, digest *remoteexecution.Digest, outputPath string, isExecutable bool) error {
 	key, err := cas.digestKeyer(instance, digest)
 	if err != nil {
@@ -68,16 +100,30 @@ func (cas *hardlinkingContentAddressableStorage) GetFile(ctx context.Context, in
 	}
 
 	cachePath := path.Join(cas.path, key)
-	if _, ok := cas.filesPresentSize[key]; !ok {
-		if err := cas.makeSpace(digest.SizeBytes); err != nil {
+	for {
+		// Link the file into place while holding the lock, so
+		// that it cannot be removed from the cache in the
+		// meantime.
+		cas.lock.Lock()
+		if _, ok := cas.filesPresentSize[key]; ok {
+			err := os.Link(cachePath, outputPath)
+			cas.lock.Unlock()
+			return err
+		}
+		cas.lock.Unlock()
+
+		// Let concurrent calls for the same file share a
+		// single download. Only propagate errors of downloads
+		// that were started by us, as a download started by
+		// somebody else may have been cancelled.
+		called, err := cas.fetches.Call(key, func() error {
+			return cas.fetchFile(ctx, instance, digest, key, cachePath, isExecutable)
+		})
+		if called && err != nil {
 			return err
 		}
-		if err := cas.ContentAddressableStorage.GetFile(ctx, instance, digest, cachePath, isExecutable); err != nil {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		cas.filesPresentList = append(cas.filesPresentList, key)
-		cas.filesPresentSize[key] = digest.SizeBytes
-		cas.filesPresentTotalSize += digest.SizeBytes
 	}
-	return os.Link(cachePath, outputPath)
 }
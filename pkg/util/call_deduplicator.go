@@ -0,0 +1,47 @@
+package util
+
+import (
+	"sync"
+)
+
+type deduplicatedCall struct {
+	done chan struct{}
+	err  error
+}
+
+// CallDeduplicator ensures that at most one call for a given key is in
+// flight at a time. Callers that attempt to make a call while another
+// call for the same key is in flight wait for that call to complete
+// and obtain its result. The zero value is ready for use.
+type CallDeduplicator struct {
+	lock  sync.Mutex
+	calls map[string]*deduplicatedCall
+}
+
+// Call invokes a function, unless a call for the same key is already in
+// flight. The boolean return value indicates whether the function was
+// invoked by this caller.
+func (d *CallDeduplicator) Call(key string, f func() error) (bool, error) {
+	d.lock.Lock()
+	if call, ok := d.calls[key]; ok {
+		d.lock.Unlock()
+		<-call.done
+		return false, call.err
+	}
+	if d.calls == nil {
+		d.calls = map[string]*deduplicatedCall{}
+	}
+	call := &deduplicatedCall{
+		done: make(chan struct{}),
+	}
+	d.calls[key] = call
+	d.lock.Unlock()
+
+	call.err = f()
+
+	d.lock.Lock()
+	delete(d.calls, key)
+	d.lock.Unlock()
+	close(call.done)
+	return true, call.err
+}
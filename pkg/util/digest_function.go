@@ -0,0 +1,133 @@
+package util
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"lukechampine.com/blake3"
+
+	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+)
+
+// DigestFunction is a hashing algorithm that is used to compute the
+// digests of objects stored in the Content Addressable Storage.
+type DigestFunction struct {
+	name      string
+	size      int
+	newHasher func() hash.Hash
+}
+
+var (
+	SHA1DigestFunction = &DigestFunction{
+		name:      "sha1",
+		size:      sha1.Size,
+		newHasher: sha1.New,
+	}
+	SHA256DigestFunction = &DigestFunction{
+		name:      "sha256",
+		size:      sha256.Size,
+		newHasher: sha256.New,
+	}
+	SHA384DigestFunction = &DigestFunction{
+		name:      "sha384",
+		size:      sha512.Size384,
+		newHasher: sha512.New384,
+	}
+	BLAKE3DigestFunction = &DigestFunction{
+		name: "blake3",
+		size: 32,
+		newHasher: func() hash.Hash {
+			return blake3.New(32, nil)
+		},
+	}
+
+	digestFunctions = map[string]*DigestFunction{
+		SHA1DigestFunction.name:   SHA1DigestFunction,
+		SHA256DigestFunction.name: SHA256DigestFunction,
+		SHA384DigestFunction.name: SHA384DigestFunction,
+		BLAKE3DigestFunction.name: BLAKE3DigestFunction,
+	}
+)
+
+// DigestFunctionFromName looks up a digest function by the name that
+// is also used by Bazel's --digest_function flag (e.g., "sha256").
+func DigestFunctionFromName(name string) (*DigestFunction, error) {
+	digestFunction, ok := digestFunctions[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown digest function: %s", name)
+	}
+	return digestFunction, nil
+}
+
+func (f *DigestFunction) Name() string {
+	return f.name
+}
+
+// Size returns the number of bytes of the checksums computed by this
+// digest function.
+func (f *DigestFunction) Size() int {
+	return f.size
+}
+
+func (f *DigestFunction) NewHasher() hash.Hash {
+	return f.newHasher()
+}
+
+func (f *DigestFunction) DigestFromData(data []byte) *remoteexecution.Digest {
+	hasher := f.newHasher()
+	hasher.Write(data)
+	return &remoteexecution.Digest{
+		Hash:      hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes: int64(len(data)),
+	}
+}
+
+func (f *DigestFunction) DigestFromMessage(pb proto.Message) (*remoteexecution.Digest, error) {
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		return nil, err
+	}
+	return f.DigestFromData(data), nil
+}
+
+// DigestFunctionSelector returns the digest function that is used by
+// clients of a given instance.
+type DigestFunctionSelector func(instance string) *DigestFunction
+
+func NewDigestFunctionSelector(defaultDigestFunction *DigestFunction, instanceDigestFunctions map[string]*DigestFunction) DigestFunctionSelector {
+	return func(instance string) *DigestFunction {
+		if digestFunction, ok := instanceDigestFunctions[instance]; ok {
+			return digestFunction
+		}
+		return defaultDigestFunction
+	}
+}
+
+// ParseDigestFunctionSelector creates a DigestFunctionSelector based on
+// command line flags. Instance specific entries have the form
+// ${instance}|${digest_function}.
+func ParseDigestFunctionSelector(defaultName string, instanceEntries []string) (DigestFunctionSelector, error) {
+	defaultDigestFunction, err := DigestFunctionFromName(defaultName)
+	if err != nil {
+		return nil, err
+	}
+	instanceDigestFunctions := map[string]*DigestFunction{}
+	for _, instanceEntry := range instanceEntries {
+		components := strings.SplitN(instanceEntry, "|", 2)
+		if len(components) != 2 {
+			return nil, fmt.Errorf("Invalid instance digest function entry: %s", instanceEntry)
+		}
+		digestFunction, err := DigestFunctionFromName(components[1])
+		if err != nil {
+			return nil, err
+		}
+		instanceDigestFunctions[components[0]] = digestFunction
+	}
+	return NewDigestFunctionSelector(defaultDigestFunction, instanceDigestFunctions), nil
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseDigestFunctionSelector(t *testing.T) {
+	digestFunctionSelector, err := ParseDigestFunctionSelector("sha256", []string{"legacy|sha1", "fast|BLAKE3"})
+	if err != nil {
+		t.Fatal("ParseDigestFunctionSelector failed: ", err)
+	}
+	for instance, expected := range map[string]*DigestFunction{
+		"":       SHA256DigestFunction,
+		"other":  SHA256DigestFunction,
+		"legacy": SHA1DigestFunction,
+		"fast":   BLAKE3DigestFunction,
+	} {
+		if digestFunction := digestFunctionSelector(instance); digestFunction != expected {
+			t.Fatalf("Expected digest function %s for instance %#v, got %s", expected.Name(), instance, digestFunction.Name())
+		}
+	}
+
+	for _, test := range []struct {
+		name            string
+		defaultName     string
+		instanceEntries []string
+	}{
+		{"UnknownDefault", "md5", nil},
+		{"UnknownInstance", "sha256", []string{"legacy|md5"}},
+		{"MissingSeparator", "sha256", []string{"legacy"}},
+		{"MissingDigestFunction", "sha256", []string{"legacy|"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseDigestFunctionSelector(test.defaultName, test.instanceEntries); err == nil {
+				t.Fatal("ParseDigestFunctionSelector succeeded unexpectedly")
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"go.opencensus.io/trace"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// endRPCSpan records the outcome of an RPC in a span and ends it.
+func endRPCSpan(span *trace.Span, err error) {
+	span.AddAttributes(trace.StringAttribute("rpc.grpc.status_code", status.Code(err).String()))
+	EndSpan(span, err)
+}
+
+func startServerSpan(ctx context.Context, fullMethod string) (context.Context, *trace.Span) {
+	var traceParent string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md[traceParentKey]; len(values) > 0 {
+		traceParent = values[0]
+	}
+	return startSpanWithTraceParent(ctx, fullMethod, traceParent, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+func startClientSpan(ctx context.Context, fullMethod string) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, fullMethod, trace.WithSpanKind(trace.SpanKindClient))
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md[traceParentKey] = []string{formatTraceParent(span.SpanContext())}
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+// TracingUnaryServerInterceptor creates a span for every unary RPC
+// handled by a server, continuing the trace of the client.
+func TracingUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := startServerSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	endRPCSpan(span, err)
+	return resp, err
+}
+
+type tracingServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracingServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// TracingStreamServerInterceptor creates a span for every streaming
+// RPC handled by a server, continuing the trace of the client.
+func TracingStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+	err := handler(srv, &tracingServerStream{ServerStream: ss, ctx: ctx})
+	endRPCSpan(span, err)
+	return err
+}
+
+// TracingUnaryClientInterceptor creates a span for every unary RPC
+// performed by a client, propagating its trace context to the server.
+func TracingUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := startClientSpan(ctx, method)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	endRPCSpan(span, err)
+	return err
+}
+
+// tracingClientStream ends the span of a streaming RPC once the server
+// has terminated the stream. For RPCs where the server only sends a
+// single response, the stream is terminated upon receiving it.
+type tracingClientStream struct {
+	grpc.ClientStream
+	desc *grpc.StreamDesc
+	span *trace.Span
+	once sync.Once
+}
+
+func (s *tracingClientStream) end(err error) {
+	s.once.Do(func() { endRPCSpan(s.span, err) })
+}
+
+func (s *tracingClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.end(nil)
+	} else if err != nil || !s.desc.ServerStreams {
+		s.end(err)
+	}
+	return err
+}
+
+// TracingStreamClientInterceptor creates a span for every streaming
+// RPC performed by a client, propagating its trace context to the
+// server.
+func TracingStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, span := startClientSpan(ctx, method)
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		endRPCSpan(span, err)
+		return nil, err
+	}
+	s := &tracingClientStream{ClientStream: cs, desc: desc, span: span}
+	// The context of the stream is cancelled when the stream
+	// terminates. End the span of streams that are abandoned by
+	// cancelling the context of the client, instead of being
+	// drained through RecvMsg().
+	go func() {
+		<-cs.Context().Done()
+		switch ctx.Err() {
+		case context.Canceled:
+			s.end(status.Error(codes.Canceled, ctx.Err().Error()))
+		case context.DeadlineExceeded:
+			s.end(status.Error(codes.DeadlineExceeded, ctx.Err().Error()))
+		}
+	}()
+	return s, nil
+}
+
+// ChainUnaryServerInterceptors combines multiple unary server
+// interceptors into one, as gRPC only permits a single interceptor to
+// be installed. The first interceptor is the outermost.
+func ChainUnaryServerInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// ChainStreamServerInterceptors combines multiple stream server
+// interceptors into one. The first interceptor is the outermost.
+func ChainStreamServerInterceptors(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, next)
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// ChainUnaryClientInterceptors combines multiple unary client
+// interceptors into one. The first interceptor is the outermost.
+func ChainUnaryClientInterceptors(interceptors ...grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], invoker
+			invoker = func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return interceptor(ctx, method, req, reply, cc, next, opts...)
+			}
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// ChainStreamClientInterceptors combines multiple stream client
+// interceptors into one. The first interceptor is the outermost.
+func ChainStreamClientInterceptors(interceptors ...grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], streamer
+			streamer = func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return interceptor(ctx, desc, cc, method, next, opts...)
+			}
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
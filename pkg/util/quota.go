@@ -0,0 +1,149 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Quota contains limits on the resources that may be used by clients
+// of an instance. Limits that are zero are not enforced.
+type Quota struct {
+	// Maximum number of storage requests per second for all clients
+	// of the instance combined.
+	RequestsPerSecond float64
+	// Maximum number of storage requests per second for every
+	// individual client of the instance.
+	ClientRequestsPerSecond float64
+	// Maximum number of blobs that may be uploaded concurrently.
+	ConcurrentUploads int
+	// Maximum size of blobs that may be uploaded.
+	MaxBlobSizeBytes int64
+	// Maximum number of actions that may be queued for execution.
+	MaxQueuedActions int
+}
+
+var (
+	// StorageQuotaKeys are the quotas that are enforced by
+	// services that provide access to storage.
+	StorageQuotaKeys = []string{
+		"requests-per-second",
+		"client-requests-per-second",
+		"concurrent-uploads",
+		"max-blob-size-bytes",
+	}
+	// SchedulerQuotaKeys are the quotas that are enforced by
+	// services that queue actions for execution.
+	SchedulerQuotaKeys = []string{
+		"max-queued-actions",
+	}
+)
+
+// ParseQuota parses a quota of the form
+// requests-per-second=100,concurrent-uploads=10. Valid keys are
+// requests-per-second, client-requests-per-second, concurrent-uploads,
+// max-blob-size-bytes and max-queued-actions. As quotas are enforced by
+// different services, only the keys in supportedKeys are accepted, so
+// that quotas are never silently ignored.
+func ParseQuota(value string, supportedKeys []string) (Quota, error) {
+	var quota Quota
+	if value == "" {
+		return quota, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		components := strings.SplitN(entry, "=", 2)
+		if len(components) != 2 {
+			return Quota{}, fmt.Errorf("Invalid quota entry: %s", entry)
+		}
+		var err error
+		var negative bool
+		switch components[0] {
+		case "requests-per-second":
+			quota.RequestsPerSecond, err = strconv.ParseFloat(components[1], 64)
+			negative = quota.RequestsPerSecond < 0
+		case "client-requests-per-second":
+			quota.ClientRequestsPerSecond, err = strconv.ParseFloat(components[1], 64)
+			negative = quota.ClientRequestsPerSecond < 0
+		case "concurrent-uploads":
+			quota.ConcurrentUploads, err = strconv.Atoi(components[1])
+			negative = quota.ConcurrentUploads < 0
+		case "max-blob-size-bytes":
+			quota.MaxBlobSizeBytes, err = strconv.ParseInt(components[1], 10, 64)
+			negative = quota.MaxBlobSizeBytes < 0
+		case "max-queued-actions":
+			quota.MaxQueuedActions, err = strconv.Atoi(components[1])
+			negative = quota.MaxQueuedActions < 0
+		default:
+			return Quota{}, fmt.Errorf("Unknown quota: %s", components[0])
+		}
+		if err != nil {
+			return Quota{}, fmt.Errorf("Invalid value for quota %s: %s", components[0], err)
+		}
+		if negative {
+			return Quota{}, fmt.Errorf("Invalid value for quota %s: %s is negative", components[0], components[1])
+		}
+		if !isSupportedQuotaKey(components[0], supportedKeys) {
+			return Quota{}, fmt.Errorf("Quota %s is not enforced by this service", components[0])
+		}
+	}
+	return quota, nil
+}
+
+func isSupportedQuotaKey(key string, supportedKeys []string) bool {
+	for _, supportedKey := range supportedKeys {
+		if key == supportedKey {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaSelector returns the quota that applies to clients of a given
+// instance.
+type QuotaSelector func(instance string) Quota
+
+// ParseQuotaSelector creates a QuotaSelector based on command line
+// flags. Instance specific entries have the form ${instance}|${quota}.
+func ParseQuotaSelector(defaultValue string, instanceEntries []string, supportedKeys []string) (QuotaSelector, error) {
+	defaultQuota, err := ParseQuota(defaultValue, supportedKeys)
+	if err != nil {
+		return nil, err
+	}
+	instanceQuotas := map[string]Quota{}
+	for _, instanceEntry := range instanceEntries {
+		components := strings.SplitN(instanceEntry, "|", 2)
+		if len(components) != 2 {
+			return nil, fmt.Errorf("Invalid instance quota entry: %s", instanceEntry)
+		}
+		quota, err := ParseQuota(components[1], supportedKeys)
+		if err != nil {
+			return nil, err
+		}
+		instanceQuotas[components[0]] = quota
+	}
+	return func(instance string) Quota {
+		if quota, ok := instanceQuotas[instance]; ok {
+			return quota
+		}
+		return defaultQuota
+	}, nil
+}
+
+// NewQuotaExceededError creates a RESOURCE_EXHAUSTED error that informs
+// clients after how much time they may retry.
+func NewQuotaExceededError(retryDelay time.Duration, format string, a ...interface{}) error {
+	s := status.Newf(codes.ResourceExhausted, format, a...)
+	if sWithDetails, err := s.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: ptypes.DurationProto(retryDelay),
+	}); err == nil {
+		s = sWithDetails
+	}
+	return s.Err()
+}
@@ -0,0 +1,229 @@
+package util
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// quotaEnforcerMaxIdleClients is the number of clients for
+	// which rate limiting state is tracked, after which state of
+	// clients that are not being limited is discarded.
+	quotaEnforcerMaxIdleClients = 10000
+	// quotaEnforcerUploadRetryDelay is the amount of time after
+	// which clients are asked to retry uploads, if the maximum
+	// number of concurrent uploads is exceeded.
+	quotaEnforcerUploadRetryDelay = time.Second
+)
+
+var (
+	quotaEnforcerRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "util",
+			Name:      "quota_enforcer_requests_total",
+			Help:      "Total number of storage requests subject to quotas.",
+		},
+		[]string{"instance"})
+	quotaEnforcerRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "util",
+			Name:      "quota_enforcer_rejected_total",
+			Help:      "Total number of requests rejected, as they would exceed a quota.",
+		},
+		[]string{"instance", "quota"})
+	quotaEnforcerConcurrentUploads = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "util",
+			Name:      "quota_enforcer_concurrent_uploads",
+			Help:      "Number of blobs that are currently being uploaded.",
+		},
+		[]string{"instance"})
+)
+
+func init() {
+	prometheus.MustRegister(quotaEnforcerRequestsTotal)
+	prometheus.MustRegister(quotaEnforcerRejectedTotal)
+	prometheus.MustRegister(quotaEnforcerConcurrentUploads)
+}
+
+// tokenBucket is a rate limiter that permits bursts of up to one
+// second worth of requests.
+type tokenBucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+func getBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// take attempts to obtain a token from the bucket. If no token is
+// available, it returns the amount of time until one becomes
+// available.
+func (b *tokenBucket) take(rate float64, now time.Time) (bool, time.Duration) {
+	burst := getBurst(rate)
+	if b.lastUpdate.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.lastUpdate).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.lastUpdate = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// isFull returns whether a token bucket has been refilled completely,
+// meaning that discarding it has no effect on rate limiting.
+func (b *tokenBucket) isFull(rate float64, now time.Time) bool {
+	return now.Sub(b.lastUpdate).Seconds()*rate+b.tokens >= getBurst(rate)
+}
+
+type clientKey struct {
+	instance string
+	client   string
+}
+
+// QuotaEnforcer keeps track of the resources used by clients of
+// instances, rejecting requests that would cause them to exceed their
+// quota.
+type QuotaEnforcer struct {
+	quotaSelector QuotaSelector
+
+	lock              sync.Mutex
+	instanceBuckets   map[string]*tokenBucket
+	clientBuckets     map[clientKey]*tokenBucket
+	concurrentUploads map[string]int
+}
+
+// NewQuotaEnforcer creates a QuotaEnforcer that enforces the quotas
+// returned by a QuotaSelector.
+func NewQuotaEnforcer(quotaSelector QuotaSelector) *QuotaEnforcer {
+	return &QuotaEnforcer{
+		quotaSelector: quotaSelector,
+
+		instanceBuckets:   map[string]*tokenBucket{},
+		clientBuckets:     map[clientKey]*tokenBucket{},
+		concurrentUploads: map[string]int{},
+	}
+}
+
+// getClientIdentity returns the identity of the client that performs
+// the request associated with a context. Clients are identified by
+// their IP address, if known.
+func getClientIdentity(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", false
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host, true
+	}
+	return p.Addr.String(), true
+}
+
+func (qe *QuotaEnforcer) reject(instance string, quota string, retryDelay time.Duration, format string, a ...interface{}) error {
+	quotaEnforcerRejectedTotal.WithLabelValues(instance, quota).Inc()
+	return NewQuotaExceededError(retryDelay, format, a...)
+}
+
+// AllowRequest checks whether a client may perform a storage request
+// against an instance, without exceeding the number of requests per
+// second for the instance and the client.
+func (qe *QuotaEnforcer) AllowRequest(ctx context.Context, instance string) error {
+	quotaEnforcerRequestsTotal.WithLabelValues(instance).Inc()
+	quota := qe.quotaSelector(instance)
+	if quota.RequestsPerSecond <= 0 && quota.ClientRequestsPerSecond <= 0 {
+		return nil
+	}
+
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+
+	now := time.Now()
+	if quota.ClientRequestsPerSecond > 0 {
+		if client, ok := getClientIdentity(ctx); ok {
+			key := clientKey{instance: instance, client: client}
+			bucket, ok := qe.clientBuckets[key]
+			if !ok {
+				if len(qe.clientBuckets) >= quotaEnforcerMaxIdleClients {
+					qe.discardIdleClients(now)
+				}
+				bucket = &tokenBucket{}
+				qe.clientBuckets[key] = bucket
+			}
+			if ok, retryDelay := bucket.take(quota.ClientRequestsPerSecond, now); !ok {
+				return qe.reject(instance, "client_requests_per_second", retryDelay, "Client %s exceeded the maximum number of requests per second of instance %#v", client, instance)
+			}
+		}
+	}
+	if quota.RequestsPerSecond > 0 {
+		bucket, ok := qe.instanceBuckets[instance]
+		if !ok {
+			bucket = &tokenBucket{}
+			qe.instanceBuckets[instance] = bucket
+		}
+		if ok, retryDelay := bucket.take(quota.RequestsPerSecond, now); !ok {
+			return qe.reject(instance, "requests_per_second", retryDelay, "Exceeded the maximum number of requests per second of instance %#v", instance)
+		}
+	}
+	return nil
+}
+
+func (qe *QuotaEnforcer) discardIdleClients(now time.Time) {
+	for key, bucket := range qe.clientBuckets {
+		if bucket.isFull(qe.quotaSelector(key.instance).ClientRequestsPerSecond, now) {
+			delete(qe.clientBuckets, key)
+		}
+	}
+}
+
+// AcquireUpload checks whether a blob of a given size may be uploaded
+// to an instance. If so, it reserves one of the concurrent uploads of
+// the instance, which must be released by calling the function that is
+// returned.
+func (qe *QuotaEnforcer) AcquireUpload(instance string, sizeBytes int64) (func(), error) {
+	quota := qe.quotaSelector(instance)
+	if quota.MaxBlobSizeBytes > 0 && sizeBytes > quota.MaxBlobSizeBytes {
+		// Retrying does not help, so don't provide RetryInfo.
+		quotaEnforcerRejectedTotal.WithLabelValues(instance, "max_blob_size_bytes").Inc()
+		return nil, status.Errorf(codes.ResourceExhausted, "Blob is %d bytes in size, while instance %#v permits blobs of at most %d bytes", sizeBytes, instance, quota.MaxBlobSizeBytes)
+	}
+
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+
+	if quota.ConcurrentUploads > 0 && qe.concurrentUploads[instance] >= quota.ConcurrentUploads {
+		return nil, qe.reject(instance, "concurrent_uploads", quotaEnforcerUploadRetryDelay, "Exceeded the maximum number of concurrent uploads of instance %#v", instance)
+	}
+	qe.concurrentUploads[instance]++
+	quotaEnforcerConcurrentUploads.WithLabelValues(instance).Inc()
+	return func() {
+		qe.lock.Lock()
+		defer qe.lock.Unlock()
+		qe.concurrentUploads[instance]--
+		if qe.concurrentUploads[instance] == 0 {
+			delete(qe.concurrentUploads, instance)
+		}
+		quotaEnforcerConcurrentUploads.WithLabelValues(instance).Dec()
+	}, nil
+}
@@ -0,0 +1,177 @@
+package util
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	// A new bucket permits a burst of one second worth of requests.
+	var b tokenBucket
+	for i := 0; i < 10; i++ {
+		if ok, _ := b.take(10, start); !ok {
+			t.Fatalf("Request %d was rejected", i)
+		}
+	}
+	if b.isFull(10, start) {
+		t.Fatal("Drained bucket is full")
+	}
+	ok, retryDelay := b.take(10, start)
+	if ok {
+		t.Fatal("Request exceeding the burst was permitted")
+	}
+	if retryDelay != 100*time.Millisecond {
+		t.Fatalf("Expected retry delay %s, got %s", 100*time.Millisecond, retryDelay)
+	}
+
+	// Tokens are refilled over time, up to the burst size.
+	if ok, _ := b.take(10, start.Add(100*time.Millisecond)); !ok {
+		t.Fatal("Request was rejected after refilling a token")
+	}
+	if b.isFull(10, start.Add(999*time.Millisecond)) {
+		t.Fatal("Bucket is full before being refilled completely")
+	}
+	if !b.isFull(10, start.Add(1100*time.Millisecond)) {
+		t.Fatal("Bucket is not full after being refilled completely")
+	}
+	if !b.isFull(10, start.Add(time.Hour)) {
+		t.Fatal("Bucket is not full after being idle")
+	}
+
+	// Rates below one request per second still permit a single
+	// request.
+	var slow tokenBucket
+	if ok, _ := slow.take(0.5, start); !ok {
+		t.Fatal("Request was rejected")
+	}
+	ok, retryDelay = slow.take(0.5, start)
+	if ok {
+		t.Fatal("Request exceeding the burst was permitted")
+	}
+	if retryDelay != 2*time.Second {
+		t.Fatalf("Expected retry delay %s, got %s", 2*time.Second, retryDelay)
+	}
+}
+
+func newTestQuotaEnforcer(t *testing.T, instanceEntries ...string) *QuotaEnforcer {
+	quotaSelector, err := ParseQuotaSelector("", instanceEntries, StorageQuotaKeys)
+	if err != nil {
+		t.Fatal("ParseQuotaSelector failed: ", err)
+	}
+	return NewQuotaEnforcer(quotaSelector)
+}
+
+func newClientContext(ip string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345},
+	})
+}
+
+func expectQuotaExceeded(t *testing.T, err error, retryInfo bool) {
+	s := status.Convert(err)
+	if s.Code() != codes.ResourceExhausted {
+		t.Fatalf("Expected code %s, got %s: %v", codes.ResourceExhausted, s.Code(), err)
+	}
+	hasRetryInfo := false
+	for _, detail := range s.Details() {
+		if _, ok := detail.(*errdetails.RetryInfo); ok {
+			hasRetryInfo = true
+		}
+	}
+	if hasRetryInfo != retryInfo {
+		t.Fatalf("Expected retry info to be present: %t, got %t", retryInfo, hasRetryInfo)
+	}
+}
+
+func TestQuotaEnforcerAllowRequest(t *testing.T) {
+	t.Run("Unlimited", func(t *testing.T) {
+		qe := newTestQuotaEnforcer(t)
+		for i := 0; i < 100; i++ {
+			if err := qe.AllowRequest(newClientContext("192.0.2.1"), "default"); err != nil {
+				t.Fatal("AllowRequest failed: ", err)
+			}
+		}
+	})
+
+	t.Run("Instance", func(t *testing.T) {
+		// Requests per second are limited for all clients of an
+		// instance combined, but not for other instances.
+		qe := newTestQuotaEnforcer(t, "limited|requests-per-second=2")
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+			if err := qe.AllowRequest(newClientContext(ip), "limited"); err != nil {
+				t.Fatal("AllowRequest failed: ", err)
+			}
+		}
+		expectQuotaExceeded(t, qe.AllowRequest(newClientContext("192.0.2.3"), "limited"), true)
+		if err := qe.AllowRequest(newClientContext("192.0.2.3"), "other"); err != nil {
+			t.Fatal("AllowRequest failed: ", err)
+		}
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		// Requests per second are limited for every client
+		// individually.
+		qe := newTestQuotaEnforcer(t, "limited|client-requests-per-second=1")
+		if err := qe.AllowRequest(newClientContext("192.0.2.1"), "limited"); err != nil {
+			t.Fatal("AllowRequest failed: ", err)
+		}
+		expectQuotaExceeded(t, qe.AllowRequest(newClientContext("192.0.2.1"), "limited"), true)
+		if err := qe.AllowRequest(newClientContext("192.0.2.2"), "limited"); err != nil {
+			t.Fatal("AllowRequest failed: ", err)
+		}
+
+		// Clients of unknown identity are not limited.
+		for i := 0; i < 10; i++ {
+			if err := qe.AllowRequest(context.Background(), "limited"); err != nil {
+				t.Fatal("AllowRequest failed: ", err)
+			}
+		}
+	})
+}
+
+func TestQuotaEnforcerAcquireUpload(t *testing.T) {
+	qe := newTestQuotaEnforcer(t, "limited|concurrent-uploads=2,max-blob-size-bytes=100")
+
+	// Blobs that are too large are rejected, regardless of the
+	// number of uploads in progress. Retrying does not help.
+	_, err := qe.AcquireUpload("limited", 101)
+	expectQuotaExceeded(t, err, false)
+
+	release1, err := qe.AcquireUpload("limited", 100)
+	if err != nil {
+		t.Fatal("AcquireUpload failed: ", err)
+	}
+	release2, err := qe.AcquireUpload("limited", 1)
+	if err != nil {
+		t.Fatal("AcquireUpload failed: ", err)
+	}
+	_, err = qe.AcquireUpload("limited", 1)
+	expectQuotaExceeded(t, err, true)
+	if _, err := qe.AcquireUpload("other", 1000); err != nil {
+		t.Fatal("AcquireUpload failed: ", err)
+	}
+
+	// Releasing an upload permits another one to start.
+	release1()
+	release3, err := qe.AcquireUpload("limited", 1)
+	if err != nil {
+		t.Fatal("AcquireUpload failed: ", err)
+	}
+	_, err = qe.AcquireUpload("limited", 1)
+	expectQuotaExceeded(t, err, true)
+
+	release2()
+	release3()
+	if n := qe.concurrentUploads["limited"]; n != 0 {
+		t.Fatalf("Expected no uploads in progress, got %d", n)
+	}
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	allKeys := append(append([]string(nil), StorageQuotaKeys...), SchedulerQuotaKeys...)
+
+	quota, err := ParseQuota("requests-per-second=100.5,client-requests-per-second=10,concurrent-uploads=64,max-blob-size-bytes=1073741824,max-queued-actions=1000", allKeys)
+	if err != nil {
+		t.Fatal("ParseQuota failed: ", err)
+	}
+	if expected := (Quota{
+		RequestsPerSecond:       100.5,
+		ClientRequestsPerSecond: 10,
+		ConcurrentUploads:       64,
+		MaxBlobSizeBytes:        1073741824,
+		MaxQueuedActions:        1000,
+	}); quota != expected {
+		t.Fatalf("Expected quota %#v, got %#v", expected, quota)
+	}
+
+	quota, err = ParseQuota("", nil)
+	if err != nil {
+		t.Fatal("ParseQuota failed: ", err)
+	}
+	if quota != (Quota{}) {
+		t.Fatalf("Expected empty quota, got %#v", quota)
+	}
+
+	for _, test := range []struct {
+		name          string
+		value         string
+		supportedKeys []string
+	}{
+		{"MissingValue", "requests-per-second", allKeys},
+		{"UnknownKey", "requests-per-minute=10", allKeys},
+		{"InvalidNumber", "concurrent-uploads=1.5", allKeys},
+		{"NegativeRate", "requests-per-second=-1", allKeys},
+		{"NegativeCount", "max-queued-actions=-1", allKeys},
+		{"NegativeSize", "max-blob-size-bytes=-1", allKeys},
+		{"NotEnforcedByStorage", "max-queued-actions=10", StorageQuotaKeys},
+		{"NotEnforcedByScheduler", "requests-per-second=10", SchedulerQuotaKeys},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseQuota(test.value, test.supportedKeys); err == nil {
+				t.Fatalf("ParseQuota of %#v succeeded unexpectedly", test.value)
+			}
+		})
+	}
+}
+
+func TestParseQuotaSelector(t *testing.T) {
+	quotaSelector, err := ParseQuotaSelector("max-queued-actions=100", []string{"limited|max-queued-actions=10", "unlimited|"}, SchedulerQuotaKeys)
+	if err != nil {
+		t.Fatal("ParseQuotaSelector failed: ", err)
+	}
+	for instance, expected := range map[string]int{
+		"":          100,
+		"other":     100,
+		"limited":   10,
+		"unlimited": 0,
+	} {
+		if quota := quotaSelector(instance); quota.MaxQueuedActions != expected {
+			t.Fatalf("Expected instance %#v to permit %d queued actions, got %d", instance, expected, quota.MaxQueuedActions)
+		}
+	}
+
+	if _, err := ParseQuotaSelector("", []string{"max-queued-actions=10"}, SchedulerQuotaKeys); err == nil {
+		t.Fatal("ParseQuotaSelector accepted an entry without an instance name")
+	}
+	if _, err := ParseQuotaSelector("", []string{"limited|concurrent-uploads=10"}, SchedulerQuotaKeys); err == nil {
+		t.Fatal("ParseQuotaSelector accepted a quota that is not enforced")
+	}
+}
@@ -0,0 +1,18 @@
+package util
+
+import (
+	"strings"
+)
+
+// StringList is a flag.Value that may be provided multiple times on the
+// command line, accumulating all of its values.
+type StringList []string
+
+func (i *StringList) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *StringList) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
@@ -0,0 +1,161 @@
+package util
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"google.golang.org/grpc/status"
+)
+
+// traceParentKey is the key under which trace context is stored, both
+// in gRPC metadata and in messages sent to other processes. Its value
+// uses the format of the W3C Trace Context specification.
+const traceParentKey = "traceparent"
+
+// InitializeTracing sets up OpenCensus tracing for a process. Trace
+// context is always propagated, so that traces are not interrupted by
+// processes that do not record spans themselves. If path is non-empty,
+// spans recorded by the process are written to that file as JSON, one
+// span per line, so that they may be forwarded to a collector.
+func InitializeTracing(serviceName string, path string) error {
+	if path == "" {
+		// Only continue traces that have been sampled by others.
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(0)})
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	trace.RegisterExporter(&jsonSpanExporter{
+		serviceName: serviceName,
+		encoder:     json.NewEncoder(f),
+	})
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	return nil
+}
+
+// jsonSpan is the representation of a span written by
+// jsonSpanExporter.
+type jsonSpan struct {
+	ServiceName   string                 `json:"service_name"`
+	Name          string                 `json:"name"`
+	Kind          string                 `json:"kind,omitempty"`
+	TraceID       string                 `json:"trace_id"`
+	SpanID        string                 `json:"span_id"`
+	ParentSpanID  string                 `json:"parent_span_id,omitempty"`
+	StartTime     time.Time              `json:"start_time"`
+	EndTime       time.Time              `json:"end_time"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	StatusCode    int32                  `json:"status_code,omitempty"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+}
+
+// jsonSpanExporter writes spans to a file as JSON, one span per line.
+type jsonSpanExporter struct {
+	serviceName string
+
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func (e *jsonSpanExporter) ExportSpan(s *trace.SpanData) {
+	span := jsonSpan{
+		ServiceName:   e.serviceName,
+		Name:          s.Name,
+		TraceID:       s.TraceID.String(),
+		SpanID:        s.SpanID.String(),
+		StartTime:     s.StartTime,
+		EndTime:       s.EndTime,
+		Attributes:    s.Attributes,
+		StatusCode:    s.Code,
+		StatusMessage: s.Message,
+	}
+	switch s.SpanKind {
+	case trace.SpanKindServer:
+		span.Kind = "server"
+	case trace.SpanKindClient:
+		span.Kind = "client"
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+
+	e.lock.Lock()
+	e.encoder.Encode(&span)
+	e.lock.Unlock()
+}
+
+func formatTraceParent(sc trace.SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, uint32(sc.TraceOptions)&1)
+}
+
+func parseTraceParent(traceParent string) (trace.SpanContext, bool) {
+	var sc trace.SpanContext
+	fields := strings.Split(traceParent, "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(fields[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(fields[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.TraceOptions = trace.TraceOptions(flags[0] & 1)
+	if sc.TraceID == (trace.TraceID{}) || sc.SpanID == (trace.SpanID{}) {
+		return sc, false
+	}
+	return sc, true
+}
+
+// startSpanWithTraceParent starts a span that continues the trace
+// described by a W3C traceparent value. A new trace is started if the
+// value is absent or malformed.
+func startSpanWithTraceParent(ctx context.Context, name string, traceParent string, o ...trace.StartOption) (context.Context, *trace.Span) {
+	if parent, ok := parseTraceParent(traceParent); ok {
+		return trace.StartSpanWithRemoteParent(ctx, name, parent, o...)
+	}
+	return trace.StartSpan(ctx, name, o...)
+}
+
+// EndSpan marks a span as failed if an error occurred and ends it.
+func EndSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(status.Code(err)), Message: err.Error()})
+	}
+	span.End()
+}
+
+// InjectTraceContext returns the trace context of a Context, so that it
+// can be embedded into messages sent to other processes.
+func InjectTraceContext(ctx context.Context) map[string]string {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	return map[string]string{traceParentKey: formatTraceParent(span.SpanContext())}
+}
+
+// StartSpanWithTraceContext starts a span that continues the trace
+// obtained from InjectTraceContext().
+func StartSpanWithTraceContext(ctx context.Context, name string, traceContext map[string]string, o ...trace.StartOption) (context.Context, *trace.Span) {
+	return startSpanWithTraceParent(ctx, name, traceContext[traceParentKey], o...)
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"context"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		traceParent string
+		sampled     bool
+	}{
+		{"Sampled", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true},
+		{"NotSampled", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sc, ok := parseTraceParent(test.traceParent)
+			if !ok {
+				t.Fatalf("Failed to parse %#v", test.traceParent)
+			}
+			if sampled := sc.IsSampled(); sampled != test.sampled {
+				t.Fatalf("Expected sampled to be %t, got %t", test.sampled, sampled)
+			}
+			if traceParent := formatTraceParent(sc); traceParent != test.traceParent {
+				t.Fatalf("Expected %#v, got %#v", test.traceParent, traceParent)
+			}
+		})
+	}
+}
+
+func TestParseTraceParentCompatibility(t *testing.T) {
+	// Future versions may add fields, while flags other than
+	// sampling are unknown to us.
+	for _, traceParent := range []string{
+		"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-future",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-03",
+	} {
+		sc, ok := parseTraceParent(traceParent)
+		if !ok {
+			t.Fatalf("Failed to parse %#v", traceParent)
+		}
+		if expected := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"; formatTraceParent(sc) != expected {
+			t.Fatalf("Expected %#v, got %#v", expected, formatTraceParent(sc))
+		}
+	}
+}
+
+func TestParseTraceParentMalformed(t *testing.T) {
+	for _, traceParent := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"0-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333x-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-0x",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+	} {
+		if _, ok := parseTraceParent(traceParent); ok {
+			t.Fatalf("Parsing %#v succeeded unexpectedly", traceParent)
+		}
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	ctx, span := trace.StartSpan(context.Background(), "parent", trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+	traceContext := InjectTraceContext(ctx)
+
+	// Spans started from injected trace context should be part of
+	// the same trace.
+	_, child := StartSpanWithTraceContext(context.Background(), "child", traceContext)
+	defer child.End()
+	if child.SpanContext().TraceID != span.SpanContext().TraceID {
+		t.Fatal("Span did not continue the trace of its parent")
+	}
+
+	// Absent trace context should start a new trace.
+	if InjectTraceContext(context.Background()) != nil {
+		t.Fatal("Trace context injected without a span")
+	}
+	_, other := StartSpanWithTraceContext(context.Background(), "other", nil)
+	defer other.End()
+	if other.SpanContext().TraceID == span.SpanContext().TraceID {
+		t.Fatal("Span without trace context continued an existing trace")
+	}
+}